@@ -5,12 +5,18 @@ import (
 	"flag"
 	"github.com/jetblack87/maestro/data"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
-	"strings"
 	"path"
-	"github.com/samuel/go-zookeeper/zk"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"log"
 )
@@ -20,25 +26,45 @@ const APP_VERSION = "0.1"
 // The flag package provides a default help printer via -h switch
 var versionFlag *bool = flag.Bool("v", false, "Print the version number.")
 var zookeeper *string = flag.String("zookeeper", "localhost:2181", "The ZooKeeper connection string (defaults to 'localhost:2182').")
+var storeURL *string = flag.String("store", "", "The configuration store URL, e.g. 'zk://localhost:2181', 'etcd://localhost:2379' or 'file:///var/lib/maestro/maestro.db' (defaults to the -zookeeper connection).")
 var agentName *string = flag.String("name", "", "REQUIRED: The name of the agent.")
 var domainName *string = flag.String("domain", "", "REQUIRED: The name of the domain in which this agent lives.")
 var agentConfig *string = flag.String("agentConfig", "", "Supply a json file that contains specific configuration for this agent.")
 var processesConfig *string = flag.String("processesConfig", "", "Supply a json file that contains specific configuration any processes.")
 var logfilePath *string = flag.String("logfile", "stdout", "The path to the logfile.")
-
-var zkdao data.ZkDAO
+var logDir *string = flag.String("logDir", "/var/log/maestro", "The directory in which the output of the processes is captured, in a '<domain>-<agent>' directory.")
+var logMaxSize *int64 = flag.Int64("logMaxSize", 10*1024*1024, "The size in bytes at which a process output file is rotated.")
+var logMaxFiles *int = flag.Int("logMaxFiles", 5, "The number of rotated output files kept for each process.")
+var listen *string = flag.String("listen", "127.0.0.1:8090", "The address on which process output is served to the server, empty to disable.")
+var listenToken *string = flag.String("listenToken", "", "A file holding the token the server sends to read process output, required when -listen is not a loopback address.")
+var listenCert *string = flag.String("listenCert", "", "The certificate file with which process output is served over HTTPS, along with -listenKey.")
+var listenKey *string = flag.String("listenKey", "", "The private key file of -listenCert.")
+var stateDir *string = flag.String("stateDir", "/var/lib/maestro", "The directory of the state file, empty to disable the state file unless -stateFile is given.")
+var stateFile *string = flag.String("stateFile", "", "The file in which the agent keeps its running processes, to adopt them when it is restarted after a crash (defaults to '<domain>-<agent>.state' in -stateDir).")
+var cgroupSlice *string = flag.String("cgroupSlice", "/sys/fs/cgroup/maestro.slice", "The cgroups v2 slice under which the agent places its processes, empty to disable.")
+var execUmask *string = flag.String("execUmask", "", "Used by the agent to start a process with a umask: sets the umask and executes the command given after '--'. The agent executable, and the directories above it, must be executable by the users of the processes that have a umask.")
+var usageInterval *time.Duration = flag.Duration("usageInterval", 10*time.Second, "How often the resource usage of the processes is published.")
+
+var store data.Store
 var request *processStartRequest
 
 
 const MAX_START_RETRIES = 3 
 
+// How often the agent looks for its configuration while it does not exist,
+// as it is not allowed to create it
+const AGENT_CONFIG_RETRY_INTERVAL = 5 * time.Second
+
 func main() {
 
 	flag.Parse() // Scan the arguments list
+	if *execUmask != "" {
+		execWithUmask(*execUmask, flag.Args())
+	}
 
 	// Setup signal channel
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, os.Interrupt, os.Kill)
+	signal.Notify(signalChannel, os.Interrupt, os.Kill, syscall.SIGTERM)
 
 
     // Setup logging
@@ -62,14 +88,26 @@ func main() {
 	if *domainName == "" {
 		panic("-domain is required")
 	}
-	
+
 	log.Printf("maestro agent starting for domain '%s' and agent '%s'\n", *domainName, *domainName)
 
-	zkdao, err := data.NewZkDAO(strings.Split(*zookeeper, ","))
+	setupStateFile()
+	setupLogDir()
+
+	if *storeURL == "" {
+		*storeURL = "zk://" + *zookeeper
+	}
+	var err error
+	store, err = data.OpenStore(*storeURL)
 	if err != nil {
 		panic(err)
 	}
 
+	// The processes keep running while the store is not connected, the store
+	// creates the ephemeral node and sets the watches again when it is back
+	stateChannel := make(chan data.ConnectionState, 1)
+	store.WatchState(stateChannel)
+
 	// Load config into ZK
 	err = loadAgentConfig(*agentConfig, *agentName, *domainName)
 	if err != nil {
@@ -83,44 +121,100 @@ func main() {
 	}
 
 	log.Println("Loading the agent configuration")
-	agent, err := zkdao.LoadAgent(data.PathToKey("/maestro/"+*domainName+"/config/agents/"+*agentName), true)
-	if err != nil {
+	agent, err := store.LoadAgent(data.PathToKey("/maestro/"+*domainName+"/config/agents/"+*agentName), true)
+	if err == data.ErrNoNode {
+		// Processes can be assigned to the agent once it runs
+		log.Println("The agent has no configuration yet")
+	} else if err != nil {
 		panic(err)
 	}
 
 	// Create channel used for watching ZK nodes
-	watchChannel := make(chan zk.Event, 1)
+	watchChannel := make(chan data.Event, 1)
+
+	// Keep the run history of the jobs across restarts of the agent
+	runHistory := make(map[string][]data.Run)
+	previous, err := store.LoadAgent(data.PathToKey("/maestro/"+*domainName+"/runtime/agents/"+agent.Name), true)
+	if err == nil {
+		for _, process := range previous.Processes {
+			runHistory[process.Name] = process.Runs
+		}
+	}
 
-	// Remove old runtime config for this agent
-	err = zkdao.RemoveRecursive("/maestro/"+*domainName+"/runtime/agents/"+agent.Name)
-	if err != nil {
+	// Remove old runtime config for this agent. Only the nodes below its
+	// runtime node are removed, which is all the ACLs of the store may let it
+	// remove.
+	runtimePath := "/maestro/" + *domainName + "/runtime/agents/" + agent.Name
+	children, err := store.Children(runtimePath)
+	if err != nil && err != data.ErrNoNode {
 		log.Printf("Failed to remove agent runtime configuration")
 		panic(err)
 	}
+	for _, child := range children {
+		err = store.RemoveRecursive(runtimePath + "/" + child)
+		if err != nil {
+			log.Printf("Failed to remove agent runtime configuration")
+			panic(err)
+		}
+	}
 
-	// Add processes to the runtime configuration, adding watches to admin_state
-	for key := range agent.Processes {
-		log.Println("Loading processes from config: " + agent.Processes[key].ProcessClass)
-		agent.Processes[key], err = zkdao.LoadProcess(data.PathToKey(agent.Processes[key].ProcessClass), true)
+	// Load the definitions of the processes
+	assigned := agent.Processes
+	agent.Processes = nil
+	for _, process := range assigned {
+		log.Println("Loading processes from config: " + process.ProcessClass)
+		definition, err := loadDefinition(process.ProcessClass)
+		if err == data.ErrNoNode {
+			log.Printf("Process definition '%s' does not exist, skipping it\n", process.ProcessClass)
+			continue
+		}
 		if err != nil {
 			panic(err)
 		}
-		agent.Processes[key].Key = data.PathToKey("/maestro/"+*domainName+"/runtime/agents/"+agent.Name+"/processes/"+agent.Processes[key].Name)
-		if agent.Processes[key].AdminState == "" {
-			// Default to on
-			log.Println("Defaulting admin_state to 'on'")
-			agent.Processes[key].AdminState = "on"
+		agent.Processes = append(agent.Processes, definition)
+	}
+
+	// Serve the output of the processes, the server proxies requests here
+	if *listen != "" {
+		serveLogs(*listen)
+		agent.Address = advertisedAddress(*listen)
+	}
+
+	if *cgroupSlice != "" {
+		setupCgroups(*cgroupSlice, *domainName, agent.Name)
+	}
+
+	// Processes are started in the order of their dependencies
+	definitions, err := data.SortByDependencies(agent.Processes)
+	if err != nil {
+		panic(err)
+	}
+
+	// Add the instances of the processes to the runtime configuration
+	agent.OS = runtime.GOOS
+	agent.Processes = nil
+	for _, definition := range definitions {
+		instanceCounts[definition.ProcessClass] = data.InstanceCount(definition)
+		for i := 0; i < data.InstanceCount(definition); i++ {
+			process := newInstance(definition, i)
+			process.Runs = runHistory[process.Name]
+			agent.Processes = append(agent.Processes, process)
 		}
-		agent.Processes[key].OperState = "off"
 	}
 
 	log.Println("Adding agent to runtime configuration")
-	err = zkdao.UpdateAgent(data.PathToKey("/maestro/"+*domainName+"/runtime/agents/"+agent.Name), agent, true)
+	err = store.UpdateAgent(data.PathToKey("/maestro/"+*domainName+"/runtime/agents/"+agent.Name), agent, false)
 	if err != nil {
 		panic(err)
 	}
-	
-	str, err := zkdao.CreateEphemeral("/maestro/"+*domainName+"/runtime/agents/"+agent.Name+"/eph", []byte("I am alive"))
+	for _, process := range agent.Processes {
+		err = store.UpdateProcess(process.Key, process, true)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	str, err := store.CreateEphemeral("/maestro/"+*domainName+"/runtime/agents/"+agent.Name+"/eph", []byte("I am alive"))
 	if err != nil {
 		errMsg := "Error creating ephemeral node: " + str
 		log.Println(errMsg)
@@ -128,87 +222,230 @@ func main() {
 	}
 
 	// Add watches for all admin_state nodes
-	for key := range agent.Processes {
-		adminStatePath := data.KeyToPath(agent.Processes[key].Key)+"/admin_state"
-		log.Println("Adding watch to node: " + adminStatePath)
-		err := zkdao.Watch(adminStatePath, watchChannel)
-		if err != nil {
-			log.Println("Failed to add watch to process node:\n" + err.Error())
-		}
+	for _, process := range agent.Processes {
+		watchProcess(process, watchChannel)
 	}
-	
+
+	// Watch the definitions of the processes, including their number of
+	// instances
+	for _, definition := range definitions {
+		loadedDefinitions[definition.ProcessClass] = definition
+		watchDefinition(definition, watchChannel)
+	}
+
+	// Watch the configuration of the agent for the processes assigned to it,
+	// by hand or by the scheduler
+	agentConfigPath := "/maestro/" + *domainName + "/config/agents/" + agent.Name
+	agentConfigWatched := watchAgentConfig(agentConfigPath, watchChannel)
+
 	log.Println("Starting process monitoring")
 
 	// Create out request (including channels)
 	request = &processStartRequest{
-		processes : agent.Processes,
-		commandChan : make(chan *command, 1),
-		resultChan : make(chan *result, 1)}
+		processes:    agent.Processes,
+		commands:     newCommandQueue(),
+		resultChan:   make(chan *result, 1),
+		shutdownChan: make(chan bool, 1),
+		doneChan:     make(chan bool, 1),
+		electionChan: make(chan *election, 1)}
+
+	// Campaign for the locks of the singleton processes
+	err = store.UpdateRuntimeConfig(data.PathToKey("/maestro/"+*domainName+"/runtime"), data.RuntimeConfig{}, false)
+	if err != nil {
+		log.Println("Failed to create the locks node:\n" + err.Error())
+	}
+	for _, definition := range definitions {
+		campaign(definition)
+	}
 
 	go startAndMonitorProcesses(request)
 
 	log.Println("Process monitoring started, waiting on channels")
+	agentConfigRetry := time.NewTicker(AGENT_CONFIG_RETRY_INTERVAL)
+	shuttingDown := false
 	for {
 		select {
-			case w := <-watchChannel:
-			if w.Type.String() == "EventNodeDataChanged" {
-				adminState, err := zkdao.GetValue(w.Path)
+		case w := <-watchChannel:
+			if w.Path == agentConfigPath || strings.HasPrefix(w.Path, agentConfigPath+"/") {
+				if w.Path == agentConfigPath && w.Type == data.EventNodeDeleted {
+					agentConfigWatched = false
+				}
+				settle(agentConfigPath)
+			} else if class := definitionClass(w.Path); class != "" {
+				if w.Path == class && w.Type == data.EventNodeDeleted {
+					// Watched again if it is written again
+					watchedDefinitions[class] = false
+				}
+				settle(class)
+			} else if w.Type == data.EventNodeDataChanged && path.Base(w.Path) == "run_requested" {
+				process, err := store.LoadProcess(data.PathToKey(path.Dir(w.Path)), true)
+				if err != nil {
+					log.Printf("Error loading process '%s': %s\n", w.Path, err)
+				} else {
+					request.commands.push(&command{process: process, run: true})
+				}
+			} else if w.Type == data.EventNodeDataChanged {
+				adminState, err := store.GetValue(w.Path)
 				if err != nil {
 					log.Printf("Error getting data for path '%s': %s\n", w.Path, err.Error())
 				} else {
-					process, err2 := zkdao.LoadProcess(data.PathToKey(path.Dir(w.Path)), true)
+					process, err2 := store.LoadProcess(data.PathToKey(path.Dir(w.Path)), true)
 					if err2 != nil {
 						log.Printf("Error loading process '%s': %s\n", w.Path, err2)
 					} else {
-						request.commandChan <- &command{process : process, adminState : string(adminState)}
+						request.commands.push(&command{process: process, adminState: string(adminState)})
 					}
 				}
 			}
-			case r := <-request.resultChan:
-			if r.err != nil {
-				log.Printf("An error occured running a process:%s\n", r.err.Error())
-				// Failed to start, turn off
-				r.process.OperState = "off"
-				r.process.AdminState = "off"
-				zkdao.UpdateProcess(r.process.Key, r.process, false)
+		case nodepath := <-settledChan:
+			delete(pendingChanges, nodepath)
+			if nodepath != agentConfigPath {
+				applyDefinition(nodepath, watchChannel)
 			} else {
-				var p data.Process
-	    		// Update the admin_state and pid in ZK
-				if r.process.Key != "" {
-					p = r.process
-				} else {
-					p,err = zkdao.LoadProcess(r.key, false)
-					if err != nil {
-						log.Printf("Failed to load process: %s\n", err.Error())	
-					} else {
-						p.OperState = r.operState
-					}
+				if !agentConfigWatched {
+					agentConfigWatched = watchAgentConfig(agentConfigPath, watchChannel)
 				}
-				log.Printf("Process '%s' oper_state = '%s'\n", p.Key, p.OperState)
-	    		zkdao.UpdateProcess(r.process.Key, r.process, false)
-	    		
-	    		// Touch the admin_state node to get process turned back on
-	    		if p.AdminState == "on" && p.OperState == "off" {
-	    			zkdao.SetValue(data.KeyToPath(p.Key) + "/admin_state", []byte(p.AdminState))
-	    		}
+				assignProcesses(watchChannel)
 			}
-			case <-signalChannel:
-			log.Println("Received signal to end")
-			a,err := zkdao.LoadAgent(data.PathToKey("/maestro/"+*domainName+"/runtime/agents/"+agent.Name),true)
-			if err != nil {
-				log.Println("Error retrieving agent")
-			} else {
-				for _, process := range a.Processes {
-					request.commandChan <- &command{process : process, adminState : "off"}
+		case <-agentConfigRetry.C:
+			// The configuration may have been created in the meantime
+			if !agentConfigWatched {
+				agentConfigWatched = watchAgentConfig(agentConfigPath, watchChannel)
+				if agentConfigWatched {
+					settle(agentConfigPath)
 				}
 			}
-			// Give process monitor time to kill children
-			time.Sleep(10 * time.Second)		   
+		case r := <-request.resultChan:
+			recordResult(r)
+		case state := <-stateChannel:
+			log.Println("Store connection state changed: " + state.String())
+		case <-signalChannel:
+			if shuttingDown {
+				log.Println("Already shutting down, waiting on processes to stop")
+				break
+			}
+			log.Println("Received signal to end")
+			shuttingDown = true
+			// The process monitor stops the children and tells us when they are gone
+			request.shutdownChan <- true
+		case <-request.doneChan:
+			log.Println("All processes have stopped")
+			// Record the results that are still queued before exiting
+			for len(request.resultChan) > 0 {
+				recordResult(<-request.resultChan)
+			}
 			os.Exit(0)
 		}
 	}
 }
 
+// watchAgentConfig watches the configuration of the agent. It returns false
+// if the watch failed, such as when the configuration does not exist: only
+// existing nodes can be watched and the ACLs do not let the agent create it,
+// so the watch is tried again every AGENT_CONFIG_RETRY_INTERVAL.
+func watchAgentConfig(agentConfigPath string, watchChannel chan<- data.Event) bool {
+	err := store.WatchTree(agentConfigPath, watchChannel)
+	if err != nil {
+		if _, getErr := store.GetValue(agentConfigPath); getErr != data.ErrNoNode {
+			log.Println("Failed to add watch to the agent configuration:\n" + err.Error())
+		}
+		return false
+	}
+	return true
+}
+
+// watchProcess watches the admin_state of the process, and the requests to
+// run it for a job
+func watchProcess(process data.Process, watchChannel chan<- data.Event) {
+	nodepaths := []string{data.KeyToPath(process.Key) + "/admin_state"}
+	if isJob(process) {
+		nodepaths = append(nodepaths, data.KeyToPath(process.Key)+"/run_requested")
+	}
+	for _, nodepath := range nodepaths {
+		log.Println("Adding watch to node: " + nodepath)
+		err := store.Watch(nodepath, watchChannel)
+		if err != nil {
+			log.Println("Failed to add watch to process node:\n" + err.Error())
+		}
+	}
+}
+
+// recordResult writes the outcome reported by the process monitor to ZK
+func recordResult(r *result) {
+	if r.removed {
+		log.Printf("Removing process '%s'\n", r.process.Key)
+		err := store.RemoveRecursive(data.KeyToPath(r.process.Key))
+		if err != nil {
+			log.Printf("Failed to remove process '%s': %s\n", r.process.Key, err.Error())
+		}
+		instanceRemoved(r.process)
+	} else if r.err != nil {
+		log.Printf("An error occured running a process:%s\n", r.err.Error())
+		// Failed to start, turn off
+		r.process.OperState = "off"
+		r.process.AdminState = "off"
+		store.UpdateProcess(r.process.Key, r.process, false)
+	} else {
+		// Update the oper_state and pid in ZK
+		log.Printf("Process '%s' oper_state = '%s'\n", r.process.Key, r.process.OperState)
+		store.UpdateProcess(r.process.Key, r.process, false)
+	}
+}
+
+// serveLogs serves the output of the processes on the address. Anything but
+// a loopback address requires the token the server sends.
+func serveLogs(address string) {
+	if (*listenCert == "") != (*listenKey == "") {
+		panic("-listenCert and -listenKey must be given together")
+	}
+	handler := logsHandler{}
+	if *listenToken != "" {
+		token, err := ioutil.ReadFile(*listenToken)
+		if err != nil {
+			panic(err)
+		}
+		handler.token = strings.TrimSpace(string(token))
+		if handler.token == "" {
+			panic("No token found in " + *listenToken)
+		}
+	} else if !loopbackAddress(address) {
+		panic("-listenToken is required to serve process output on " + address)
+	}
+	http.Handle("/logs/", handler)
+	go func() {
+		if *listenCert == "" {
+			log.Println(http.ListenAndServe(address, nil))
+		} else {
+			log.Println(http.ListenAndServeTLS(address, *listenCert, *listenKey, nil))
+		}
+	}()
+}
+
+// loopbackAddress is true if only the local host can connect to the address
+func loopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// advertisedAddress is the address at which other hosts can reach listen
+func advertisedAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host, _ = os.Hostname()
+	}
+	return net.JoinHostPort(host, port)
+}
+
 func loadAgentConfig(agentConfig, agentName, domainName string) error {
 	// Load the file if it was supplied
 	if agentConfig != "" {
@@ -222,7 +459,7 @@ func loadAgentConfig(agentConfig, agentName, domainName string) error {
 		if err != nil {
 			return err
 		}
-		err = zkdao.UpdateAgent(data.PathToKey("/maestro/"+domainName+"/config/agents/"+agentName), agent, true)
+		err = store.UpdateAgent(data.PathToKey("/maestro/"+domainName+"/config/agents/"+agentName), agent, true)
 		if err != nil {
 			return err
 		}
@@ -244,7 +481,7 @@ func loadProcessesConfig(processesConfig, domainName string) error {
 			return err
 		}
 		for _, process := range processes {
-			err = zkdao.UpdateProcess(data.PathToKey("/maestro/"+domainName+"/config/processes/"+process.Name), process, true)
+			err = store.UpdateProcess(data.PathToKey("/maestro/"+domainName+"/config/processes/"+process.Name), process, true)
 			if err != nil {
 				return err
 			}
@@ -253,121 +490,140 @@ func loadProcessesConfig(processesConfig, domainName string) error {
 	return nil
 }
 
-func startAndMonitorProcesses (startRequest *processStartRequest) {
-	// Mapping of process key (string) to command
-	processMap := make(map[string]*exec.Cmd)
-	// Start all of the processes
-	for key := range startRequest.processes {
-		if startRequest.processes[key].AdminState == "on" {
-        	log.Println("Starting process: " + startRequest.processes[key].Key)
-			cmd, err := startProcess(startRequest.processes[key])
-			if err != nil {
-				log.Printf("Error starting process:\n%s\n", err.Error())
-				startRequest.resultChan <- &result{process : startRequest.processes[key], err : err}
-			} else {
-				processMap[startRequest.processes[key].Key] = cmd
-				// Send the result back
-				startRequest.processes[key].OperState = "on"
-				startRequest.processes[key].Pid = cmd.Process.Pid
-				startRequest.resultChan <- &result{process : startRequest.processes[key]}
-			}
-		}
-	}
-	
-	// Monitor the processes
-	log.Println("Monitoring command channel and processes")
-	for {
-		select {
-			case c := <-startRequest.commandChan:
-		    	switch c.adminState {
-		    	case "off":
-		    		log.Println("Killing process: " + c.process.Key)
-		    		if processMap[c.process.Key] != nil {
-				        processMap[c.process.Key].Process.Kill()
-				        delete(processMap, c.process.Key)
-				        c.process.OperState = "off"
-       				    startRequest.resultChan <- &result{process : c.process}
-				    } else {
-				    	log.Println("Process is already stopped: " + c.process.Key)
-				    }				    
-		    	case "on":
-		        	if processMap[c.process.Key] == nil {
-			        	log.Println("Starting process: " + c.process.Key)
-		        		cmd, err := startProcess(c.process)
-						if err != nil {
-							log.Printf("Error starting process:\n%s", err.Error())
-							c.process.OperState = "off"
-							startRequest.resultChan <- &result{process : c.process,
-															   err : err}
-						} else {
-							processMap[c.process.Key] = cmd
-							// Send the result back
-							c.process.OperState = "on"
-							c.process.Pid = processMap[c.process.Key].Process.Pid
-							startRequest.resultChan <- &result{process : c.process}
-						}
-		        	} else {
-		        		log.Println("Process is already running: " + c.process.Key)
-		        	}
-		    	}
-			default:
-			   // Check running processes
-			   log.Println("Checking processes")
-			   for key,process := range processMap {
-			   	if process.ProcessState != nil && process.ProcessState.Exited() {
-			   		startRequest.resultChan <- &result{key : key,
-			   										   operState : "off",
-			   										   success : process.ProcessState.Success()}
-                    delete(processMap, key)
-			   	}
-			   }
-			   time.Sleep(5 * time.Second)		   
-		}
-	}
-}
-
-func startProcess (process data.Process) (*exec.Cmd, error) {
+func startProcess(process data.Process, stdout, stderr *os.File, cg *cgroup) (*exec.Cmd, error) {
 	log.Println("Process command: " + process.Command)
 	var cmd *exec.Cmd
-	if process.Arguments != "" {
-		cmd = exec.Command(process.Command, process.Arguments)
-	} else {
-		cmd = exec.Command(process.Command)
-	}
-	success := false
 	var err error
-	for i:=0; i<MAX_START_RETRIES && !success; i++ {
+	for i := 0; i < MAX_START_RETRIES; i++ {
+		cmd = buildCommand(process)
+		err = applyCredential(cmd, process)
+		if err != nil {
+			return cmd, err
+		}
+		setProcessGroup(cmd)
+		if process.Singleton {
+			killWithAgent(cmd)
+		}
+		if stdout != nil {
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+		}
+		err = cg.prepare(cmd)
+		if err != nil {
+			log.Printf("Failed to place process '%s' in its cgroup: %s\n", process.Key, err.Error())
+		}
 		log.Println("Attempting to start: " + process.Name)
-		err = cmd.Start()
-		// Create new thread to wait on this process in order to reap it
-		go cmd.Wait()
+		err = startWithUmask(cmd, process.Umask)
+		cg.release()
 		if err == nil {
-			success = true
+			break
 		}
-        if !success {
-	        time.Sleep(5 * time.Second)		   
-        }
+		time.Sleep(5 * time.Second)
 	}
 	return cmd, err
 }
 
+// buildCommand sets up the command line, environment and working directory
+// of the process
+func buildCommand(process data.Process) *exec.Cmd {
+	args := process.Args
+	if len(args) == 0 && process.Arguments != "" {
+		// Legacy form of the arguments
+		args = strings.Fields(process.Arguments)
+	}
+	cmd := exec.Command(process.Command, args...)
+	cmd.Dir = process.WorkingDir
+	env := []string{}
+	if !process.ClearEnv {
+		env = os.Environ()
+	}
+	// The last value of a variable is the one used
+	env = append(env, userEnv(process)...)
+	names := make([]string, 0, len(process.Env))
+	for name := range process.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+process.Env[name])
+	}
+	cmd.Env = append(env, "MAESTRO_INSTANCE="+strconv.Itoa(process.Instance))
+	return cmd
+}
+
 // Private structures for communication
 
 type processStartRequest struct {
-	processes[] data.Process
-	commandChan chan *command
+	processes []data.Process
+	// The commands of the main goroutine, which never blocks sending them
+	commands   *commandQueue
 	resultChan chan *result
+	// Tells the monitor to stop all processes, it answers on doneChan
+	// once they have all exited
+	shutdownChan chan bool
+	doneChan     chan bool
+	// Tells the monitor when the agent gains or loses the lock of a singleton
+	electionChan chan *election
 }
 
 type command struct {
-	process data.Process
+	process    data.Process
 	adminState string
+	// Stop the process and remove it from the runtime configuration
+	remove bool
+	// Start a run of the job, adminState is ignored
+	run bool
+	// The definition of the process changed, adminState is ignored
+	update bool
+	// The names of the processes assigned to the agent, replacing those the
+	// monitor knows, when set. The other fields are ignored.
+	names map[string]bool
+}
+
+// commandQueue passes the commands to the monitor in the order they are
+// sent. It is unbounded so that sending never blocks: the monitor may itself
+// be blocked sending a result to the main goroutine.
+type commandQueue struct {
+	mutex    sync.Mutex
+	commands []*command
+	// Receives a value when commands are added to the queue
+	ready chan bool
+}
+
+func newCommandQueue() *commandQueue {
+	return &commandQueue{ready: make(chan bool, 1)}
+}
+
+func (q *commandQueue) push(c *command) {
+	q.mutex.Lock()
+	q.commands = append(q.commands, c)
+	q.mutex.Unlock()
+	select {
+	case q.ready <- true:
+	default:
+		// The monitor is already told
+	}
+}
+
+// pop removes and returns the queued commands, oldest first
+func (q *commandQueue) pop() []*command {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	commands := q.commands
+	q.commands = nil
+	return commands
+}
+
+// The outcome of the election of a singleton process, by its definition name
+type election struct {
+	name   string
+	leader bool
 }
 
 type result struct {
-	key string
-	operState string
 	process data.Process
 	success bool
-	err error
+	err     error
+	// The process has stopped and is to be removed
+	removed bool
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/jetblack87/maestro/data"
+	"strconv"
+	"testing"
+)
+
+// TestCommandQueue checks that sending never blocks and that the commands
+// are received in the order they were sent
+func TestCommandQueue(t *testing.T) {
+	queue := newCommandQueue()
+	var received []string
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			queue.push(&command{process: data.Process{Name: strconv.Itoa(round*100 + i)}})
+		}
+		<-queue.ready
+		for _, c := range queue.pop() {
+			received = append(received, c.process.Name)
+		}
+	}
+	if len(received) != 300 {
+		t.Fatalf("Received %d commands, want 300", len(received))
+	}
+	for i, name := range received {
+		if name != strconv.Itoa(i) {
+			t.Fatalf("Command %d is %s", i, name)
+		}
+	}
+	select {
+	case <-queue.ready:
+		t.Error("The queue is ready while it is empty")
+	default:
+	}
+}
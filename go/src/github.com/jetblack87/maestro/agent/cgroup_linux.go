@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/jetblack87/maestro/data"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The controllers enabled for the cgroups of the processes
+var cgroupControllers = []string{"cpu", "memory", "pids", "io"}
+
+// The period used for cpu.max, in microseconds
+const CGROUP_CPU_PERIOD = 100000
+
+// How long a cgroup is waited on to be empty before it is removed, and how
+// often it is checked
+const CGROUP_REMOVE_TIMEOUT = 10 * time.Second
+const CGROUP_REMOVE_POLL_INTERVAL = 20 * time.Millisecond
+
+// agentCgroup is the directory of the cgroup that holds the cgroups of the
+// processes, empty when processes are not placed in cgroups
+var agentCgroup string
+
+// setupCgroups creates the cgroup of the agent under slice and enables the
+// controllers for it. Processes are not placed in cgroups when it fails, e.g.
+// when the host does not use cgroups v2 or the agent may not write to slice.
+func setupCgroups(slice, domainName, agentName string) {
+	root := filepath.Dir(slice)
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		log.Printf("'%s' is not a cgroups v2 hierarchy, not using cgroups\n", root)
+		return
+	}
+	dir := filepath.Join(slice, domainName+"-"+agentName)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Printf("Failed to create cgroup '%s', not using cgroups: %s\n", dir, err.Error())
+		return
+	}
+	for _, parent := range []string{root, slice, dir} {
+		enableControllers(parent)
+	}
+	log.Println("Placing processes in cgroups under: " + dir)
+	agentCgroup = dir
+}
+
+// enableControllers enables the controllers available in dir for its children
+func enableControllers(dir string) {
+	content, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		log.Printf("Failed to read the controllers of cgroup '%s': %s\n", dir, err.Error())
+		return
+	}
+	available := strings.Fields(string(content))
+	for _, controller := range cgroupControllers {
+		for _, name := range available {
+			if name != controller {
+				continue
+			}
+			err := writeCgroupFile(dir, "cgroup.subtree_control", "+"+controller)
+			if err != nil {
+				log.Printf("Failed to enable controller '%s' for cgroup '%s': %s\n", controller, dir, err.Error())
+			}
+		}
+	}
+}
+
+// cgroup is the cgroup of one run of a process
+type cgroup struct {
+	dir string
+	// The open directory while the process is being started
+	file *os.File
+	// The number of OOM kills when the cgroup was set up
+	oomKills int
+}
+
+// newCgroup creates the cgroup of the process and applies its resource
+// limits, it returns nil when processes are not placed in cgroups. It fails
+// when the limits cannot be applied, the process must not be started then.
+func newCgroup(process data.Process) (*cgroup, error) {
+	if agentCgroup == "" {
+		return nil, validateResources(process)
+	}
+	cg := &cgroup{dir: filepath.Join(agentCgroup, process.Name)}
+	err := os.MkdirAll(cg.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	cg.oomKills = cg.readOOMKills()
+	err = cg.setLimits(process.Resources)
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+	return cg, nil
+}
+
+// adoptCgroup returns the cgroup of a process started by a previous run of
+// the agent, as saved by identity
+func adoptCgroup(dir string, oomKills int) *cgroup {
+	if dir == "" {
+		return nil
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil
+	}
+	return &cgroup{dir: dir, oomKills: oomKills}
+}
+
+// identity returns what is needed to adopt the cgroup
+func (cg *cgroup) identity() (dir string, oomKills int) {
+	if cg == nil {
+		return "", 0
+	}
+	return cg.dir, cg.oomKills
+}
+
+// cgroupLimit is the value written to a limit file of a cgroup
+type cgroupLimit struct {
+	file  string
+	value string
+	// Whether the limit was given, a limit that was not is only reset
+	set bool
+}
+
+// cgroupLimits converts the resources to the values of the limit files, the
+// limits that are not set take their defaults
+func cgroupLimits(resources data.Resources) ([]cgroupLimit, error) {
+	limits := []cgroupLimit{
+		{"cpu.max", "max", resources.CPUQuota != ""},
+		{"memory.max", "max", resources.MemoryMax != ""},
+		{"pids.max", "max", resources.PidsMax != 0},
+		{"io.weight", "default 100", resources.IOWeight != 0},
+	}
+	if resources.CPUQuota != "" {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(resources.CPUQuota, "%"), 64)
+		if err != nil || percent <= 0 {
+			return nil, errors.New("Invalid CPU quota: " + resources.CPUQuota)
+		}
+		limits[0].value = fmt.Sprintf("%d %d", int64(percent*CGROUP_CPU_PERIOD/100), CGROUP_CPU_PERIOD)
+	}
+	if resources.MemoryMax != "" {
+		bytes, err := parseBytes(resources.MemoryMax)
+		if err != nil {
+			return nil, err
+		}
+		limits[1].value = strconv.FormatInt(bytes, 10)
+	}
+	if resources.PidsMax < 0 {
+		return nil, errors.New("Invalid PidsMax: " + strconv.Itoa(resources.PidsMax))
+	} else if resources.PidsMax > 0 {
+		limits[2].value = strconv.Itoa(resources.PidsMax)
+	}
+	if resources.IOWeight < 0 || resources.IOWeight > 10000 {
+		return nil, errors.New("Invalid IOWeight, it must be between 1 and 10000: " + strconv.Itoa(resources.IOWeight))
+	} else if resources.IOWeight > 0 {
+		limits[3].value = "default " + strconv.Itoa(resources.IOWeight)
+	}
+	return limits, nil
+}
+
+// validateResources checks that the resource limits of the process can be
+// applied, a process whose limits cannot be applied is not started
+func validateResources(process data.Process) error {
+	if process.Resources == (data.Resources{}) {
+		return nil
+	}
+	if agentCgroup == "" {
+		return errors.New("Resources are set but the agent does not place processes in cgroups")
+	}
+	_, err := cgroupLimits(process.Resources)
+	return err
+}
+
+// setLimits writes the limits to the cgroup, the limits that are not set are
+// reset to their defaults when the controller is enabled
+func (cg *cgroup) setLimits(resources data.Resources) error {
+	limits, err := cgroupLimits(resources)
+	if err != nil {
+		return err
+	}
+	for _, limit := range limits {
+		err := writeCgroupFile(cg.dir, limit.file, limit.value)
+		if err != nil && limit.set {
+			return fmt.Errorf("Failed to set '%s' of cgroup '%s': %s", limit.file, cg.dir, err.Error())
+		}
+	}
+	return nil
+}
+
+// prepare makes the command start in the cgroup, release must be called once
+// the command has been started
+func (cg *cgroup) prepare(cmd *exec.Cmd) error {
+	if cg == nil {
+		return nil
+	}
+	file, err := os.Open(cg.dir)
+	if err != nil {
+		return err
+	}
+	cg.file = file
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(file.Fd())
+	return nil
+}
+
+func (cg *cgroup) release() {
+	if cg != nil && cg.file != nil {
+		cg.file.Close()
+		cg.file = nil
+	}
+}
+
+// usage reads what the processes of the cgroup currently use
+func (cg *cgroup) usage() data.ResourceUsage {
+	var usage data.ResourceUsage
+	if cg == nil {
+		return usage
+	}
+	usage.MemoryCurrent, _ = readCgroupInt(cg.dir, "memory.current")
+	usage.PidsCurrent, _ = readCgroupInt(cg.dir, "pids.current")
+	usage.CPUUsage, _ = readCgroupKey(cg.dir, "cpu.stat", "usage_usec")
+	return usage
+}
+
+// procs lists the processes in the cgroup
+func (cg *cgroup) procs() []int {
+	if cg == nil {
+		return nil
+	}
+	content, err := os.ReadFile(filepath.Join(cg.dir, "cgroup.procs"))
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(content)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// oomKilled tells whether the kernel killed a process of the cgroup for going
+// over its memory limit
+func (cg *cgroup) oomKilled() bool {
+	return cg != nil && cg.readOOMKills() > cg.oomKills
+}
+
+func (cg *cgroup) readOOMKills() int {
+	kills, _ := readCgroupKey(cg.dir, "memory.events", "oom_kill")
+	return kills
+}
+
+// remove kills what is left in the cgroup and deletes it once it is empty.
+// Killed processes leave the cgroup asynchronously, and a cgroup cannot be
+// deleted while it holds processes.
+func (cg *cgroup) remove() {
+	if cg == nil {
+		return
+	}
+	// Not available before Linux 5.14, the strays were killed one by one
+	writeCgroupFile(cg.dir, "cgroup.kill", "1")
+	deadline := time.Now().Add(CGROUP_REMOVE_TIMEOUT)
+	for {
+		populated, err := readCgroupKey(cg.dir, "cgroup.events", "populated")
+		if err != nil || populated == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Cgroup '%s' still holds processes after %s\n", cg.dir, CGROUP_REMOVE_TIMEOUT)
+			break
+		}
+		time.Sleep(CGROUP_REMOVE_POLL_INTERVAL)
+	}
+	err := os.Remove(cg.dir)
+	if err != nil {
+		log.Printf("Failed to remove cgroup '%s': %s\n", cg.dir, err.Error())
+	}
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	return os.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
+
+func readCgroupInt(dir, name string) (int, error) {
+	content, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
+
+// readCgroupKey reads the value of key from a flat keyed file such as cpu.stat
+func readCgroupKey(dir, name, key string) (int, error) {
+	file, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	return 0, errors.New("No '" + key + "' in " + name)
+}
+
+// parseBytes parses a size in bytes with an optional K, M or G suffix
+func parseBytes(value string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.ToUpper(strings.TrimSpace(value))
+	switch {
+	case strings.HasSuffix(number, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(number, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(number, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		number = number[:len(number)-1]
+	}
+	bytes, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || bytes <= 0 {
+		return 0, errors.New("Invalid memory size: " + value)
+	}
+	return bytes * multiplier, nil
+}
@@ -0,0 +1,59 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"github.com/jetblack87/maestro/data"
+	"log"
+	"os/exec"
+)
+
+// Resource limits need cgroups v2, which only exist on Linux
+
+func setupCgroups(slice, domainName, agentName string) {
+	log.Println("Cgroups are only available on Linux")
+}
+
+type cgroup struct{}
+
+// validateResources refuses the processes with resource limits
+func validateResources(process data.Process) error {
+	if process.Resources != (data.Resources{}) {
+		return errors.New("Resources are set but cgroups are only available on Linux")
+	}
+	return nil
+}
+
+func newCgroup(process data.Process) (*cgroup, error) {
+	return nil, validateResources(process)
+}
+
+func adoptCgroup(dir string, oomKills int) *cgroup {
+	return nil
+}
+
+func (cg *cgroup) identity() (dir string, oomKills int) {
+	return "", 0
+}
+
+func (cg *cgroup) prepare(cmd *exec.Cmd) error {
+	return nil
+}
+
+func (cg *cgroup) release() {}
+
+func (cg *cgroup) usage() data.ResourceUsage {
+	return data.ResourceUsage{}
+}
+
+func (cg *cgroup) procs() []int {
+	return nil
+}
+
+func (cg *cgroup) oomKilled() bool {
+	return false
+}
+
+func (cg *cgroup) remove() {}
@@ -0,0 +1,114 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestMain runs the test binary as the umask wrapper when startWithUmask
+// starts it, as it does the agent executable
+func TestMain(m *testing.M) {
+	if len(os.Args) > 3 && os.Args[1] == "-execUmask" && os.Args[3] == "--" {
+		execWithUmask(os.Args[2], os.Args[4:])
+	}
+	os.Exit(m.Run())
+}
+
+// TestParseUmask checks the accepted umasks
+func TestParseUmask(t *testing.T) {
+	tests := []struct {
+		umask string
+		mask  int
+		valid bool
+	}{
+		{"", -1, true},
+		{"022", 022, true},
+		{"0027", 027, true},
+		{"777", 0777, true},
+		{"1000", 0, false},
+		{"8", 0, false},
+		{"-1", 0, false},
+	}
+	for _, test := range tests {
+		mask, err := parseUmask(test.umask)
+		if (err == nil) != test.valid {
+			t.Errorf("Umask '%s': got error %v, want valid %v", test.umask, err, test.valid)
+		} else if mask != test.mask {
+			t.Errorf("Umask '%s': got %o, want %o", test.umask, mask, test.mask)
+		}
+	}
+}
+
+// TestCheckExecutable checks the permissions a user needs on the agent
+// executable and the directories above it
+func TestCheckExecutable(t *testing.T) {
+	dir := t.TempDir()
+	// The temporary directories are only searchable by their owner
+	os.Chmod(filepath.Dir(dir), 0755)
+	filename := filepath.Join(dir, "agent")
+	err := os.WriteFile(filename, nil, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := os.Getuid()
+	group := uint32(os.Getgid())
+	tests := []struct {
+		fileMode   os.FileMode
+		dirMode    os.FileMode
+		credential syscall.Credential
+		valid      bool
+	}{
+		{0700, 0755, syscall.Credential{Uid: uint32(owner)}, true},
+		{0700, 0755, syscall.Credential{Uid: 54321, Gid: 54321}, false},
+		{0750, 0755, syscall.Credential{Uid: 54321, Gid: group}, true},
+		{0750, 0755, syscall.Credential{Uid: 54321, Gid: 54321, Groups: []uint32{group}}, true},
+		{0755, 0755, syscall.Credential{Uid: 54321, Gid: 54321}, true},
+		{0755, 0700, syscall.Credential{Uid: 54321, Gid: 54321}, false},
+		{0644, 0755, syscall.Credential{Uid: 0}, false},
+		{0744, 0700, syscall.Credential{Uid: 0}, true},
+	}
+	for i, test := range tests {
+		os.Chmod(filename, test.fileMode)
+		os.Chmod(dir, test.dirMode)
+		err := checkExecutable(filename, &test.credential)
+		if (err == nil) != test.valid {
+			t.Errorf("Test %d: got error %v, want valid %v", i, err, test.valid)
+		}
+	}
+	os.Chmod(dir, 0755)
+}
+
+// TestStartWithUmask checks that the command runs with the umask, started
+// through the agent executable, here the test binary
+func TestStartWithUmask(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("No shell")
+	}
+	output := filepath.Join(t.TempDir(), "umask")
+	cmd := exec.Command(sh, "-c", "umask > "+output)
+	err = startWithUmask(cmd, "027")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+	content, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(content)) != "0027" {
+		t.Errorf("Got umask %s, want 0027", content)
+	}
+
+	err = startWithUmask(exec.Command(sh), "99")
+	if err == nil || err.Error() != "Invalid umask: 99" {
+		t.Errorf("Got error %v for an invalid umask", err)
+	}
+}
@@ -0,0 +1,271 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jetblack87/maestro/data"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// validateCredential checks that the process can be started with its user,
+// groups and umask
+func validateCredential(process data.Process) error {
+	credential, err := processCredential(process)
+	if err != nil {
+		return err
+	}
+	mask, err := parseUmask(process.Umask)
+	if err != nil || mask < 0 || credential == nil {
+		return err
+	}
+	// The umask is set by the agent executable, run as the user of the process
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	err = checkExecutable(executable, credential)
+	if err != nil {
+		return fmt.Errorf("Process '%s' has a umask, so the agent must be executable by uid %d: %s", process.Name, credential.Uid, err.Error())
+	}
+	return nil
+}
+
+// checkExecutable checks that the file can be executed with the credential:
+// the file and every directory above it must grant it the execute permission
+func checkExecutable(filename string, credential *syscall.Credential) error {
+	for name := filename; ; name = filepath.Dir(name) {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if !executableBy(info, credential) {
+			return errors.New("Permission denied on " + name)
+		}
+		if name == filepath.Dir(name) {
+			return nil
+		}
+	}
+}
+
+// executableBy tells whether the mode of the file grants the execute (or, for
+// a directory, search) permission to the credential
+func executableBy(info os.FileInfo, credential *syscall.Credential) bool {
+	mode := info.Mode().Perm()
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	if credential.Uid == 0 {
+		// Root needs one of the execute bits of a file
+		return info.IsDir() || mode&0111 != 0
+	}
+	if stat.Uid == credential.Uid {
+		return mode&0100 != 0
+	}
+	inGroup := stat.Gid == credential.Gid
+	for _, gid := range credential.Groups {
+		inGroup = inGroup || stat.Gid == gid
+	}
+	if inGroup {
+		return mode&0010 != 0
+	}
+	return mode&0001 != 0
+}
+
+// applyCredential makes the command run as the user and groups of the process
+func applyCredential(cmd *exec.Cmd, process data.Process) error {
+	credential, err := processCredential(process)
+	if err != nil || credential == nil {
+		return err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = credential
+	return nil
+}
+
+// startWithUmask starts the command with the umask of the process. The umask
+// is process wide, so the agent does not change its own: the command is
+// started through the agent executable, which sets the umask in the child and
+// then executes the command (see execWithUmask).
+func startWithUmask(cmd *exec.Cmd, umask string) error {
+	mask, err := parseUmask(umask)
+	if err != nil {
+		return err
+	}
+	if mask < 0 {
+		return cmd.Start()
+	}
+	if cmd.Err != nil {
+		// The command was not found
+		return cmd.Err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// Closed by the exec of the command, the wrapper writes why the exec
+	// failed to it otherwise
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	args := append([]string{executable, "-execUmask", umask, "--", cmd.Path}, cmd.Args...)
+	cmd.Path = executable
+	cmd.Args = args
+	cmd.ExtraFiles = append(cmd.ExtraFiles, writer)
+	err = cmd.Start()
+	writer.Close()
+	if err != nil {
+		return err
+	}
+	failure, _ := ioutil.ReadAll(reader)
+	if len(failure) > 0 {
+		cmd.Wait()
+		return errors.New(string(failure))
+	}
+	return nil
+}
+
+// execWithUmask is run by the agent executable started by startWithUmask: it
+// sets the umask and replaces itself with the command, args being the path
+// of the command followed by its arguments, starting with the name
+func execWithUmask(umask string, args []string) {
+	// The first of the extra files of the command
+	status := os.NewFile(3, "status")
+	syscall.CloseOnExec(int(status.Fd()))
+	mask, err := parseUmask(umask)
+	if err == nil && len(args) < 2 {
+		err = errors.New("No command to execute")
+	}
+	if err == nil {
+		syscall.Umask(mask)
+		err = syscall.Exec(args[0], args[1:], os.Environ())
+		err = fmt.Errorf("Failed to execute '%s': %s", args[0], err.Error())
+	}
+	status.Write([]byte(err.Error()))
+	os.Exit(127)
+}
+
+// userEnv returns the environment variables describing the user the process
+// runs as, its Env may still override them
+func userEnv(process data.Process) []string {
+	if process.User == "" {
+		return nil
+	}
+	u, err := lookupUser(process.User)
+	if err != nil {
+		return nil
+	}
+	var env []string
+	if u.HomeDir != "" {
+		env = append(env, "HOME="+u.HomeDir)
+	}
+	if u.Username != "" {
+		env = append(env, "USER="+u.Username, "LOGNAME="+u.Username)
+	}
+	return env
+}
+
+// processCredential resolves the user and groups of the process, it returns
+// nil when the process runs as the agent's user
+func processCredential(process data.Process) (*syscall.Credential, error) {
+	if process.User == "" && process.Group == "" && len(process.Groups) == 0 {
+		return nil, nil
+	}
+	uid, gid := os.Geteuid(), os.Getegid()
+	var groups []uint32
+	if process.User != "" {
+		u, err := lookupUser(process.User)
+		if err != nil {
+			return nil, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		if id, err := strconv.Atoi(u.Gid); err == nil {
+			gid = id
+		}
+		if len(process.Groups) == 0 {
+			ids, _ := u.GroupIds()
+			for _, id := range ids {
+				if number, err := strconv.Atoi(id); err == nil {
+					groups = append(groups, uint32(number))
+				}
+			}
+		}
+	}
+	if process.Group != "" {
+		id, err := lookupGroup(process.Group)
+		if err != nil {
+			return nil, err
+		}
+		gid = id
+	}
+	for _, name := range process.Groups {
+		id, err := lookupGroup(name)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, uint32(id))
+	}
+
+	if os.Geteuid() != 0 {
+		if uid == os.Geteuid() && gid == os.Getegid() && len(process.Groups) == 0 {
+			// Nothing to change
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Process '%s' runs as uid %d gid %d but the agent is not running as root", process.Name, uid, gid)
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}, nil
+}
+
+// lookupUser finds the user by name or by id
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+	if _, numberErr := strconv.Atoi(name); numberErr == nil {
+		u, idErr := user.LookupId(name)
+		if idErr == nil {
+			return u, nil
+		}
+		// A uid without an entry in the user database
+		return &user.User{Uid: name, Gid: strconv.Itoa(os.Getegid())}, nil
+	}
+	return nil, errors.New("Unknown user: " + name)
+}
+
+// lookupGroup finds the id of the group by name or by id
+func lookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, errors.New("Unknown group: " + name)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// parseUmask parses the octal umask, it returns -1 when it is not set
+func parseUmask(umask string) (int, error) {
+	if umask == "" {
+		return -1, nil
+	}
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, errors.New("Invalid umask: " + umask)
+	}
+	return int(mask), nil
+}
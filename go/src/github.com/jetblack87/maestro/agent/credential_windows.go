@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"github.com/jetblack87/maestro/data"
+	"os/exec"
+)
+
+// Processes always run as the agent's user on Windows
+
+func validateCredential(process data.Process) error {
+	if process.User != "" || process.Group != "" || len(process.Groups) > 0 || process.Umask != "" {
+		return errors.New("User, Group, Groups and Umask are not supported on Windows, process: " + process.Name)
+	}
+	return nil
+}
+
+func applyCredential(cmd *exec.Cmd, process data.Process) error {
+	return validateCredential(process)
+}
+
+func startWithUmask(cmd *exec.Cmd, umask string) error {
+	return cmd.Start()
+}
+
+func execWithUmask(umask string, args []string) {
+	panic("-execUmask is not supported on Windows")
+}
+
+func userEnv(process data.Process) []string {
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2024, 1, 31, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		name       string
+		expression string
+		from       time.Time
+		// The zero time when nothing matches
+		want time.Time
+	}{
+		{"step", "*/15 * * * *", from, time.Date(2024, 1, 31, 10, 15, 0, 0, time.UTC)},
+		{"range with step", "0-30/10 * * * *", from, time.Date(2024, 1, 31, 10, 10, 0, 0, time.UTC)},
+		{"value with step", "50/5 * * * *", from, time.Date(2024, 1, 31, 10, 50, 0, 0, time.UTC)},
+		{"list", "5,45 * * * *", from, time.Date(2024, 1, 31, 10, 45, 0, 0, time.UTC)},
+		{"range", "0 9-17 * * *", from, time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC)},
+		{"next day", "0 9 * * *", from, time.Date(2024, 2, 1, 9, 0, 0, 0, time.UTC)},
+		{"day names", "0 0 * * MON-FRI", from, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"lower case names", "0 0 * * sat,sun", from, time.Date(2024, 2, 3, 0, 0, 0, 0, time.UTC)},
+		{"month name", "0 0 1 JAN *", from, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"sunday as 7", "0 0 * * 7", from, time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"macro", "@hourly", from, time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC)},
+		// When both days are restricted either one matches: Friday the 2nd
+		// comes before the 13th
+		{"day of month or of week", "0 0 13 * FRI", from, time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC)},
+		{"day of month or of week, month", "0 0 13 * FRI", time.Date(2024, 2, 3, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 9, 0, 0, 0, 0, time.UTC)},
+		// A day field starting with "*" is not restricted, so only Mondays
+		// match and not the odd days
+		{"starred day of month", "0 0 */2 * MON", from, time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC)},
+		{"starred day of week", "0 0 1 * */2", from, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"day of week only", "0 0 * * TUE", from, time.Date(2024, 2, 6, 0, 0, 0, 0, time.UTC)},
+		// Months without the day are skipped
+		{"31st", "0 0 31 * *", from, time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{"end of year", "59 23 31 12 *", from, time.Date(2024, 12, 31, 23, 59, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 2 *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"never", "0 0 30 2 *", from, time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := parseCron(test.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.next(test.from); !got.Equal(test.want) {
+				t.Errorf("next(%s) of '%s': got %s, want %s", test.from, test.expression, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, expression := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"0 0 * * FOO",
+		"0 0 * MON *",
+		"@never",
+	} {
+		if _, err := parseCron(expression); err == nil {
+			t.Errorf("'%s' was parsed", expression)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jetblack87/maestro/data"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for the fields of data.HealthCheck that are not set
+const DEFAULT_HEALTH_INTERVAL = 10 * time.Second
+const DEFAULT_HEALTH_TIMEOUT = 5 * time.Second
+const DEFAULT_HEALTH_FAILURE_THRESHOLD = 3
+const DEFAULT_HEALTH_SUCCESS_THRESHOLD = 1
+const DEFAULT_HEALTH_STATUS = http.StatusOK
+
+// A change of the health of a child
+type healthChange struct {
+	child  *child
+	health string
+}
+
+// checkHealth runs the health check of the child until it exits, reporting
+// every change of its health on healthChan
+func checkHealth(c *child, healthChan chan<- *healthChange) {
+	check := c.process.HealthCheck
+	interval := parseDuration(check.Interval, DEFAULT_HEALTH_INTERVAL)
+	timeout := parseDuration(check.Timeout, DEFAULT_HEALTH_TIMEOUT)
+	failureThreshold := check.FailureThreshold
+	if failureThreshold <= 0 {
+		failureThreshold = DEFAULT_HEALTH_FAILURE_THRESHOLD
+	}
+	successThreshold := check.SuccessThreshold
+	if successThreshold <= 0 {
+		successThreshold = DEFAULT_HEALTH_SUCCESS_THRESHOLD
+	}
+
+	health := c.process.Health
+	successes, failures := 0, 0
+	timer := time.NewTimer(parseDuration(check.InitialDelay, 0))
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.exited:
+			return
+		case <-timer.C:
+		}
+
+		err := runHealthCheck(check, timeout, c.proc.Pid)
+		changed := false
+		if err == nil {
+			successes++
+			failures = 0
+			if health != "healthy" && successes >= successThreshold {
+				health, changed = "healthy", true
+			}
+		} else {
+			log.Printf("Health check of process '%s' failed: %s\n", c.process.Key, err.Error())
+			failures++
+			successes = 0
+			if health != "unhealthy" && failures >= failureThreshold {
+				health, changed = "unhealthy", true
+			}
+		}
+		if changed {
+			select {
+			case healthChan <- &healthChange{child: c, health: health}:
+			case <-c.exited:
+				return
+			}
+		}
+		timer.Reset(interval)
+	}
+}
+
+// runHealthCheck does one check, returning an error when it fails
+func runHealthCheck(check data.HealthCheck, timeout time.Duration, pid int) error {
+	switch check.Type {
+	case "exec":
+		fields := strings.Fields(check.Command)
+		if len(fields) == 0 {
+			return errors.New("No command to run")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, fields[0], fields[1:]...)
+		cmd.Env = append(os.Environ(), "MAESTRO_PID="+strconv.Itoa(pid))
+		return cmd.Run()
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", check.Address, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "http":
+		client := http.Client{Timeout: timeout}
+		resp, err := client.Get(check.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		status := check.Status
+		if status == 0 {
+			status = DEFAULT_HEALTH_STATUS
+		}
+		if resp.StatusCode != status {
+			return fmt.Errorf("Expected status %d but got %d", status, resp.StatusCode)
+		}
+		return nil
+	}
+	return errors.New("Unknown health check type: " + check.Type)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"github.com/jetblack87/maestro/data"
+	"log"
+	"path"
+	"strconv"
+)
+
+// The number of instances running for each process definition, by the path
+// of the definition (its ProcessClass). Only used by the main goroutine.
+var instanceCounts = make(map[string]int)
+
+// instanceName is the name of the runtime node of instance i of the process
+func instanceName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return name + "-" + strconv.Itoa(i)
+}
+
+// definitionName is the name of the process definition an instance was
+// created from, which is what DependsOn refers to
+func definitionName(process data.Process) string {
+	if process.ProcessClass != "" {
+		return path.Base(process.ProcessClass)
+	}
+	return process.Name
+}
+
+// newInstance creates the runtime process of instance i of the definition
+func newInstance(definition data.Process, i int) data.Process {
+	process := definition
+	process.Instance = i
+	process.Name = instanceName(definition.Name, i)
+	process.Key = data.PathToKey("/maestro/" + *domainName + "/runtime/agents/" + *agentName + "/processes/" + process.Name)
+	if process.AdminState == "" {
+		// Default to on
+		log.Println("Defaulting admin_state to 'on'")
+		process.AdminState = "on"
+	}
+	process.OperState = "off"
+	err := validateInstance(process)
+	if err != nil {
+		log.Printf("Rejecting process '%s', turning it off: %s\n", process.Name, err.Error())
+		process.AdminState = "off"
+	}
+	return process
+}
+
+// validateInstance checks that the agent can run the process
+func validateInstance(process data.Process) error {
+	err := validateCredential(process)
+	if err == nil {
+		err = validateJob(process)
+	}
+	if err == nil {
+		err = validateUpdatePolicy(process)
+	}
+	if err == nil {
+		err = validateResources(process)
+	}
+	if err == nil {
+		err = validateStop(process)
+	}
+	return err
+}
+
+// loadDefinition loads the process definition at the path
+func loadDefinition(class string) (data.Process, error) {
+	definition, err := store.LoadProcess(data.PathToKey(class), true)
+	if err != nil {
+		return definition, err
+	}
+	definition.ProcessClass = class
+	return definition, nil
+}
+
+// assignProcesses starts the processes newly assigned to the agent, by hand
+// or by the scheduler, and removes those that are no longer assigned
+func assignProcesses(watchChannel chan<- data.Event) {
+	agent, err := store.LoadAgent(data.PathToKey("/maestro/"+*domainName+"/config/agents/"+*agentName), false)
+	if err == data.ErrNoNode {
+		// The configuration of the agent was deleted, nothing is assigned
+		err = nil
+	}
+	if err != nil {
+		log.Println("Error loading the agent configuration:\n" + err.Error())
+		return
+	}
+	assigned := make(map[string]bool)
+	var added []data.Process
+	for _, process := range agent.Processes {
+		assigned[process.ProcessClass] = true
+		if _, ok := instanceCounts[process.ProcessClass]; ok || process.ProcessClass == "" {
+			continue
+		}
+		definition, err := loadDefinition(process.ProcessClass)
+		if err != nil {
+			log.Printf("Error loading process '%s': %s\n", process.ProcessClass, err)
+			continue
+		}
+		added = append(added, definition)
+	}
+	// The monitor learns the assigned processes before any of them is started,
+	// so that a process waits on a dependency assigned along with it
+	names := make(map[string]bool)
+	for class := range instanceCounts {
+		if assigned[class] {
+			names[path.Base(class)] = true
+		}
+	}
+	for _, definition := range added {
+		names[definitionName(definition)] = true
+	}
+	request.commands.push(&command{names: names})
+	for _, definition := range added {
+		log.Printf("Process '%s' was assigned to the agent\n", definition.ProcessClass)
+		loadedDefinitions[definition.ProcessClass] = definition
+		setInstances(definition, 0, data.InstanceCount(definition), watchChannel)
+		watchDefinition(definition, watchChannel)
+		campaign(definition)
+	}
+	for class, current := range instanceCounts {
+		if assigned[class] {
+			continue
+		}
+		log.Printf("Process '%s' is no longer assigned to the agent\n", class)
+		definition, err := loadDefinition(class)
+		if err != nil {
+			// Only the name of the definition is needed to remove its instances
+			definition = data.Process{Name: path.Base(class), ProcessClass: class}
+		}
+		setInstances(definition, current, 0, watchChannel)
+		delete(instanceCounts, class)
+		delete(loadedDefinitions, class)
+		resignWhenRemoved(class, current)
+	}
+}
+
+// setInstances starts or removes instances of the definition, going from
+// current to wanted instances
+func setInstances(definition data.Process, current, wanted int, watchChannel chan<- data.Event) {
+	class := definition.ProcessClass
+	for i := current; i < wanted; i++ {
+		process := newInstance(definition, i)
+		err := store.UpdateProcess(process.Key, process, true)
+		if err != nil {
+			log.Printf("Error adding instance '%s': %s\n", process.Name, err)
+			wanted = i
+			break
+		}
+		watchProcess(process, watchChannel)
+		request.commands.push(&command{process: process, adminState: process.AdminState})
+	}
+	for i := wanted; i < current; i++ {
+		process := newInstance(definition, i)
+		request.commands.push(&command{process: process, adminState: "off", remove: true})
+	}
+	instanceCounts[class] = wanted
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"github.com/jetblack87/maestro/data"
+	"log"
+	"time"
+)
+
+// The number of runs kept in the history of a job
+const MAX_RUN_HISTORY = 20
+
+// isJob tells whether the process runs to completion instead of being kept
+// running
+func isJob(process data.Process) bool {
+	return process.Type == "oneshot" || process.Type == "cron"
+}
+
+// validateJob checks the type of the process and the schedule of a cron job
+func validateJob(process data.Process) error {
+	switch process.Type {
+	case "", "service", "oneshot":
+		return nil
+	case "cron":
+		_, err := parseCron(process.Schedule)
+		return err
+	}
+	return errors.New("Unknown process type: " + process.Type)
+}
+
+// restartPolicy is the restart policy of the process, jobs are not restarted
+// unless they ask for it
+func restartPolicy(process data.Process) data.RestartPolicy {
+	policy := process.RestartPolicy
+	if isJob(process) && policy.Policy == "" {
+		policy.Policy = "never"
+	}
+	return policy
+}
+
+// enable starts the process that was turned on, or schedules it for a cron job
+func (m *monitor) enable(process data.Process) {
+	if process.Type != "cron" {
+		m.triggers[process.Key] = "start"
+		m.start(process)
+		return
+	}
+	m.definitions[process.Key] = process
+	if !m.schedule(process) {
+		delete(m.definitions, process.Key)
+		process.OperState = "off"
+		m.request.resultChan <- &result{process: process, err: errors.New("Invalid schedule: " + process.Schedule)}
+		return
+	}
+	if m.processMap[process.Key] == nil {
+		process.OperState = "scheduled"
+		m.request.resultChan <- &result{process: process}
+	}
+}
+
+// schedule arms the timer of the next run of the cron job, it returns false
+// when the schedule is invalid
+func (m *monitor) schedule(process data.Process) bool {
+	cron, err := parseCron(process.Schedule)
+	if err != nil {
+		log.Printf("Invalid schedule for process '%s': %s\n", process.Key, err.Error())
+		return false
+	}
+	m.unschedule(process.Key)
+	next := cron.next(time.Now())
+	if next.IsZero() {
+		log.Printf("Process '%s' is never due\n", process.Key)
+		return true
+	}
+	log.Printf("Process '%s' is due at %s\n", process.Key, next.Format(time.RFC3339))
+	key := process.Key
+	m.timers[key] = time.AfterFunc(time.Until(next), func() { m.cronChan <- key })
+	return true
+}
+
+// unschedule stops the timer of the cron job, it returns whether there was one
+func (m *monitor) unschedule(key string) bool {
+	timer, ok := m.timers[key]
+	if ok {
+		timer.Stop()
+		delete(m.timers, key)
+	}
+	return ok
+}
+
+// handleCron runs the cron job that is due and schedules its next run
+func (m *monitor) handleCron(key string) {
+	process, ok := m.definitions[key]
+	if !ok || process.Type != "cron" || m.shuttingDown {
+		return
+	}
+	m.trigger(process, "schedule")
+	m.schedule(process)
+}
+
+// trigger starts a run of the job, applying its overlap policy when it is
+// already running
+func (m *monitor) trigger(process data.Process, trigger string) {
+	key := process.Key
+	running := m.processMap[key]
+	if running == nil {
+		log.Printf("Running process '%s' (%s)\n", key, trigger)
+		if m.trackers[key] != nil {
+			m.trackers[key].reset()
+		}
+		m.triggers[key] = trigger
+		if definition, ok := m.definitions[key]; ok {
+			// Keep the definition of a cron job, which has been scheduled
+			process = definition
+		}
+		m.start(process)
+		return
+	}
+	switch process.Overlap {
+	case "queue":
+		log.Printf("Process '%s' is running, queuing its run (%s)\n", key, trigger)
+		m.queued[key] = trigger
+	case "replace":
+		log.Printf("Process '%s' is running, replacing it (%s)\n", key, trigger)
+		m.queued[key] = trigger
+		m.stop(running)
+	default:
+		log.Printf("Process '%s' is running, skipping its run (%s)\n", key, trigger)
+	}
+}
+
+// startQueued prepares the queued run of the job, if any, to be started
+func (m *monitor) startQueued(key string) bool {
+	trigger, ok := m.queued[key]
+	if !ok {
+		return false
+	}
+	log.Printf("Starting the queued run of process '%s'\n", key)
+	delete(m.queued, key)
+	m.triggers[key] = trigger
+	return true
+}
+
+// recordRun adds the run that ended with the exit to the history of the job
+func (m *monitor) recordRun(e *exit, process data.Process) []data.Run {
+	runs, ok := m.runs[process.Key]
+	if !ok {
+		// The history saved by a previous run of the agent
+		runs = process.Runs
+	}
+	number := 1
+	if len(runs) > 0 {
+		number = runs[len(runs)-1].Number + 1
+	}
+	runs = append(runs, data.Run{
+		Number:     number,
+		Trigger:    e.child.trigger,
+		Start:      e.child.started.Format(time.RFC3339),
+		End:        e.time.Format(time.RFC3339),
+		ExitCode:   e.exitCode,
+		ExitSignal: e.signal,
+		Duration:   e.runtime.Round(time.Millisecond).String()})
+	if len(runs) > MAX_RUN_HISTORY {
+		runs = append([]data.Run{}, runs[len(runs)-MAX_RUN_HISTORY:]...)
+	}
+	m.runs[process.Key] = runs
+	return runs
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// The number of lines returned by the logs handler when tail is not given
+const DEFAULT_LOG_TAIL = 100
+
+// How often the output files of a running process are checked for rotation
+const LOG_ROTATE_INTERVAL = 1 * time.Second
+
+// rotateLog rotates the file once it is larger than maxSize. The rotated
+// files are named <file>.1 (the newest) up to <file>.<maxFiles>. The file is
+// copied and then truncated, as the process writes to it directly and keeps
+// it open.
+func rotateLog(filename string, maxSize int64, maxFiles int) error {
+	info, err := os.Stat(filename)
+	if err != nil || maxSize <= 0 || info.Size() <= maxSize {
+		return err
+	}
+	if maxFiles > 0 {
+		os.Remove(filename + "." + strconv.Itoa(maxFiles))
+		for i := maxFiles - 1; i > 0; i-- {
+			os.Rename(filename+"."+strconv.Itoa(i), filename+"."+strconv.Itoa(i+1))
+		}
+		err := copyFile(filename, filename+".1")
+		if err != nil {
+			return err
+		}
+	}
+	return os.Truncate(filename, 0)
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// rotateOutput rotates the output files of the child until it exits
+func rotateOutput(c *child) {
+	ticker := time.NewTicker(LOG_ROTATE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.exited:
+			return
+		case <-ticker.C:
+		}
+		for _, stream := range []string{"stdout", "stderr"} {
+			filename := logFile(c.process.Name, stream)
+			err := rotateLog(filename, *logMaxSize, *logMaxFiles)
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to rotate '%s': %s\n", filename, err.Error())
+			}
+		}
+	}
+}
+
+// logFile returns the path of the output file of a process, stream is
+// "stdout" or "stderr"
+// The directory of the output files of this agent, named after the domain and
+// the agent so that agents running on the same host do not share it
+var processLogDir string
+
+// setupLogDir sets the absolute directory of the output files
+func setupLogDir() {
+	absolute, err := filepath.Abs(*logDir)
+	if err != nil {
+		panic(err)
+	}
+	processLogDir = filepath.Join(absolute, *domainName+"-"+*agentName)
+}
+
+func logFile(processName, stream string) string {
+	return filepath.Join(processLogDir, processName+"."+stream+".log")
+}
+
+// openProcessOutput opens the files that capture the output of the process.
+// The process writes to them directly, so that it can keep running when the
+// agent does not.
+func openProcessOutput(processName string) (stdout *os.File, stderr *os.File, err error) {
+	err = os.MkdirAll(processLogDir, 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+	stdout, err = openLog(logFile(processName, "stdout"))
+	if err != nil {
+		return nil, nil, err
+	}
+	stderr, err = openLog(logFile(processName, "stderr"))
+	if err != nil {
+		stdout.Close()
+		return nil, nil, err
+	}
+	return stdout, stderr, nil
+}
+
+func openLog(filename string) (*os.File, error) {
+	return os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// tailFile returns the last n lines of the file, reading back into the most
+// recently rotated file when the current one is too short
+func tailFile(filename string, n int) ([]byte, error) {
+	content, err := readTail(filename, n)
+	if err != nil {
+		return nil, err
+	}
+	if lines := bytes.Count(content, []byte("\n")); lines < n {
+		previous, err := readTail(filename+".1", n-lines)
+		if err == nil {
+			content = append(previous, content...)
+		}
+	}
+	return content, nil
+}
+
+// readTail reads the file backwards in blocks until it has n lines
+func readTail(filename string, n int) ([]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	const blockSize = 16 * 1024
+	offset := info.Size()
+	var content []byte
+	// Count one more newline than needed, as the file usually ends with one
+	for offset > 0 && bytes.Count(content, []byte("\n")) <= n {
+		size := int64(blockSize)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		block := make([]byte, size)
+		_, err := file.ReadAt(block, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		content = append(block, content...)
+	}
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return bytes.Join(lines, nil), nil
+}
+
+// logsHandler serves GET /logs/<process name>?tail=N&stream=stdout|stderr.
+// When token is set, requests must send it as 'Authorization: Bearer <token>'.
+type logsHandler struct {
+	token string
+}
+
+var logsPathRegexp = regexp.MustCompile("^/logs/([^/]+)$")
+
+func (lh logsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("HTTP '%s' request for url '%s'", r.Method, r.URL)
+	if lh.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+lh.token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized"))
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed: " + r.Method))
+		return
+	}
+	match := logsPathRegexp.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Process name is required"))
+		return
+	}
+	stream := r.URL.Query().Get("stream")
+	if stream == "" {
+		stream = "stdout"
+	}
+	if stream != "stdout" && stream != "stderr" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("stream must be 'stdout' or 'stderr'"))
+		return
+	}
+	tail := DEFAULT_LOG_TAIL
+	if value := r.URL.Query().Get("tail"); value != "" {
+		var err error
+		tail, err = strconv.Atoi(value)
+		if err != nil || tail < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("tail must be a positive number"))
+			return
+		}
+	}
+	content, err := tailFile(logFile(match[1], stream), tail)
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No " + stream + " output for process: " + match[1]))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		errMsg := "Error occurred reading output"
+		w.Write([]byte(errMsg))
+		log.Println(errMsg + "\n" + err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(content)
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jetblack87/maestro/data"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// monitor starts, stops and restarts the processes of the agent. All of its
+// state is owned by the goroutine running startAndMonitorProcesses.
+type monitor struct {
+	request *processStartRequest
+	// Mapping of process key (string) to the running child
+	processMap map[string]*child
+	// Mapping of process key to the process that should be running
+	definitions map[string]data.Process
+	// The keys of processes waiting on their dependencies ("waiting") or on
+	// being elected ("standby"), mapped to that state
+	waiting map[string]string
+	// The names of the singleton processes whose lock the agent holds
+	leaders map[string]bool
+	// The names of the processes of this agent, other dependencies are ignored
+	names map[string]bool
+	// Mapping of process key to its restart history
+	trackers map[string]*restartTracker
+	// Receives the keys of processes whose restart delay has passed
+	restartChan chan string
+	// Receives the children as they exit
+	exitChan chan *exit
+	// Receives the changes of health of the children
+	healthChan chan *healthChange
+	// Receives the resource usage of the children
+	usageChan chan *usageReport
+	// What triggers the next start of a job, by process key
+	triggers map[string]string
+	// The trigger of the run of a job queued behind the running one
+	queued map[string]string
+	// The run history of the jobs, by process key
+	runs map[string][]data.Run
+	// The timers of the cron jobs, which send their key on cronChan
+	timers       map[string]*time.Timer
+	cronChan     chan string
+	shuttingDown bool
+}
+
+func startAndMonitorProcesses(startRequest *processStartRequest) {
+	m := &monitor{
+		request:     startRequest,
+		processMap:  make(map[string]*child),
+		definitions: make(map[string]data.Process),
+		waiting:     make(map[string]string),
+		leaders:     make(map[string]bool),
+		names:       make(map[string]bool),
+		trackers:    make(map[string]*restartTracker),
+		restartChan: make(chan string, 1),
+		exitChan:    make(chan *exit, 1),
+		healthChan:  make(chan *healthChange, 1),
+		usageChan:   make(chan *usageReport, 1),
+		triggers:    make(map[string]string),
+		queued:      make(map[string]string),
+		runs:        make(map[string][]data.Run),
+		timers:      make(map[string]*time.Timer),
+		cronChan:    make(chan string, 1)}
+
+	// Adopt the processes that survived a previous run of the agent and
+	// start the others, they are sorted so dependencies come first
+	for _, process := range startRequest.processes {
+		m.names[definitionName(process)] = true
+	}
+	survivors := loadState()
+	for key := range startRequest.processes {
+		process := startRequest.processes[key]
+		if s, ok := survivors[process.Key]; ok {
+			delete(survivors, process.Key)
+			if m.adoptOrKill(process, s) {
+				continue
+			}
+		}
+		if process.AdminState == "on" {
+			m.enable(process)
+		}
+	}
+	for _, s := range survivors {
+		if _, ours := verifyChild(s); ours {
+			log.Printf("Killing process '%s' left by a previous run, it is no longer configured\n", s.Key)
+			killSurvivor(s)
+		}
+	}
+	m.saveState()
+
+	// Monitor the processes
+	log.Println("Monitoring command channel and processes")
+	stateTicker := time.NewTicker(STATE_REFRESH_INTERVAL)
+	for {
+		select {
+		case <-stateTicker.C:
+			m.saveState()
+		case <-startRequest.commands.ready:
+			for _, c := range startRequest.commands.pop() {
+				m.handleCommand(c)
+			}
+		case <-startRequest.shutdownChan:
+			m.handleShutdown()
+		case key := <-m.restartChan:
+			process, ok := m.definitions[key]
+			if ok && m.processMap[key] == nil {
+				log.Println("Restarting process: " + key)
+				m.triggers[key] = "retry"
+				m.start(process)
+			}
+		case key := <-m.cronChan:
+			m.handleCron(key)
+		case e := <-m.exitChan:
+			m.handleExit(e)
+		case h := <-m.healthChan:
+			m.handleHealth(h)
+		case u := <-m.usageChan:
+			m.handleUsage(u)
+		case e := <-startRequest.electionChan:
+			m.handleElection(e)
+		}
+	}
+}
+
+// start starts the process, unless it has to wait on its dependencies or,
+// for a singleton, on the agent being elected
+func (m *monitor) start(process data.Process) {
+	m.definitions[process.Key] = process
+	state := ""
+	if process.Singleton && !m.leaders[definitionName(process)] {
+		state = "standby"
+	} else if !m.dependenciesRunning(process) {
+		state = "waiting"
+	}
+	if state != "" {
+		if m.waiting[process.Key] != state {
+			log.Printf("Process '%s' is %s\n", process.Key, state)
+			m.waiting[process.Key] = state
+			process.OperState = state
+			m.request.resultChan <- &result{process: process}
+		}
+		return
+	}
+	delete(m.waiting, process.Key)
+
+	log.Println("Starting process: " + process.Key)
+	stdout, stderr, err := openProcessOutput(process.Name)
+	if err != nil {
+		log.Printf("Failed to open output files for process '%s': %s\n", process.Key, err.Error())
+	}
+	cg, err := newCgroup(process)
+	var cmd *exec.Cmd
+	if err != nil {
+		err = fmt.Errorf("Failed to apply the resource limits of process '%s': %s", process.Key, err.Error())
+	} else {
+		cmd, err = startProcess(process, stdout, stderr, cg)
+	}
+	if stdout != nil {
+		// The child has its own copies
+		stdout.Close()
+		stderr.Close()
+	}
+	if err != nil {
+		cg.remove()
+		log.Printf("Error starting process:\n%s\n", err.Error())
+		delete(m.definitions, process.Key)
+		process.OperState = "off"
+		m.request.resultChan <- &result{process: process, err: err}
+		return
+	}
+	process.OperState = "on"
+	process.Pid = cmd.Process.Pid
+	if process.HealthCheck.Type != "" {
+		process.Health = "starting"
+	}
+	c := &child{cmd: cmd, proc: cmd.Process, process: process, started: time.Now(), exited: make(chan bool),
+		cgroup: cg, trigger: m.triggers[process.Key]}
+	delete(m.triggers, process.Key)
+	c.startTime, c.cmdline, _ = processIdentity(c.proc.Pid)
+	go waitProcess(c, m.exitChan)
+	m.watch(c)
+}
+
+// adoptOrKill adopts a process left running by a previous run of the agent.
+// It returns false when there is nothing to adopt, in which case the process
+// is started as usual.
+func (m *monitor) adoptOrKill(process data.Process, s childState) bool {
+	verified, ours := verifyChild(s)
+	if !ours {
+		log.Printf("Process '%s' of a previous run is gone\n", process.Key)
+		return false
+	}
+	if process.Singleton && !m.leaders[definitionName(process)] {
+		// Another agent may have been elected in the meantime
+		log.Printf("Process '%s' of a previous run is a singleton, killing it until the agent is elected\n", process.Key)
+		killSurvivor(s)
+		return false
+	}
+	if !verified {
+		log.Printf("Process '%s' of a previous run is not running its command anymore, killing it\n", process.Key)
+		killSurvivor(s)
+		return false
+	}
+	log.Printf("Adopting process '%s' with pid %d\n", process.Key, s.Pid)
+	proc, err := os.FindProcess(s.Pid)
+	if err != nil {
+		log.Printf("Failed to adopt process '%s': %s\n", process.Key, err.Error())
+		return false
+	}
+	started, _ := time.Parse(time.RFC3339Nano, s.Started)
+	c := &child{proc: proc, started: started, exited: make(chan bool), startTime: s.StartTime,
+		cmdline: s.Cmdline, cgroup: adoptCgroup(s.Cgroup, s.OOMKills)}
+	if process.AdminState == "on" {
+		m.definitions[process.Key] = process
+	}
+	process.OperState = "on"
+	process.Pid = s.Pid
+	if process.HealthCheck.Type != "" {
+		process.Health = "starting"
+	}
+	c.process = process
+	go waitAdopted(c, m.exitChan)
+	m.watch(c)
+	if process.AdminState != "on" {
+		m.stop(c)
+	}
+	return true
+}
+
+// watch tracks a running child and reports that it is running
+func (m *monitor) watch(c *child) {
+	m.processMap[c.process.Key] = c
+	go rotateOutput(c)
+	if c.cgroup != nil {
+		go reportUsage(c, m.usageChan)
+	}
+	if c.process.HealthCheck.Type != "" {
+		go checkHealth(c, m.healthChan)
+	}
+	m.saveState()
+	// Send the result back
+	m.request.resultChan <- &result{process: c.process}
+
+	m.startWaiting()
+}
+
+// killSurvivor kills the process group of a process left by a previous run
+func killSurvivor(s childState) {
+	proc, err := os.FindProcess(s.Pgid)
+	if err == nil {
+		killGroup(proc)
+	}
+}
+
+// startWaiting starts the waiting processes that can now run
+func (m *monitor) startWaiting() {
+	for key := range m.waiting {
+		if process, ok := m.definitions[key]; ok && m.processMap[key] == nil {
+			m.start(process)
+		}
+	}
+}
+
+func (m *monitor) dependenciesRunning(process data.Process) bool {
+	for _, dependency := range process.DependsOn {
+		if !m.names[dependency] {
+			continue
+		}
+		running := false
+		for _, c := range m.processMap {
+			if definitionName(c.process) == dependency && !c.stopping {
+				running = true
+				break
+			}
+		}
+		if !running {
+			return false
+		}
+	}
+	return true
+}
+
+// dependedOn tells whether a running process other than c depends on c
+func (m *monitor) dependedOn(c *child) bool {
+	for _, other := range m.processMap {
+		if other == c {
+			continue
+		}
+		for _, dependency := range other.process.DependsOn {
+			if dependency == definitionName(c.process) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stop asks the child to stop, the exit is reported once it has been reaped
+func (m *monitor) stop(c *child) {
+	if !c.stopping {
+		c.stopping = true
+		go stopProcess(c)
+	}
+}
+
+// stopReady stops the running processes that nothing depends on anymore, so
+// that processes are stopped in the reverse order of their dependencies
+func (m *monitor) stopReady() {
+	for _, c := range m.processMap {
+		if !c.stopping && !m.dependedOn(c) {
+			m.stop(c)
+		}
+	}
+}
+
+func (m *monitor) handleCommand(c *command) {
+	if c.names != nil {
+		// Processes waiting on a dependency that is no longer assigned can
+		// start
+		m.names = c.names
+		m.startWaiting()
+		return
+	}
+	if c.update {
+		m.handleUpdate(c.process)
+		return
+	}
+	if c.run {
+		if m.shuttingDown {
+			log.Println("Shutting down, not running process: " + c.process.Key)
+		} else {
+			m.trigger(c.process, "request")
+		}
+		return
+	}
+	switch c.adminState {
+	case "off":
+		log.Println("Stopping process: " + c.process.Key)
+		// Cancels any pending restart, run or schedule
+		delete(m.definitions, c.process.Key)
+		delete(m.queued, c.process.Key)
+		wasScheduled := m.unschedule(c.process.Key)
+		wasWaiting := m.waiting[c.process.Key] != "" || wasScheduled
+		delete(m.waiting, c.process.Key)
+		if running := m.processMap[c.process.Key]; running != nil {
+			running.removing = c.remove
+			// Reported when it exits, it must not turn the process back on
+			running.process.AdminState = "off"
+			m.stop(running)
+		} else {
+			log.Println("Process is already stopped: " + c.process.Key)
+			if wasWaiting || c.remove {
+				c.process.OperState = "off"
+				m.request.resultChan <- &result{process: c.process, removed: c.remove}
+			}
+		}
+	case "on":
+		if m.shuttingDown {
+			log.Println("Shutting down, not starting process: " + c.process.Key)
+		} else if m.processMap[c.process.Key] == nil {
+			if m.trackers[c.process.Key] != nil {
+				m.trackers[c.process.Key].reset()
+			}
+			m.enable(c.process)
+		} else {
+			log.Println("Process is already running: " + c.process.Key)
+		}
+	}
+}
+
+func (m *monitor) handleShutdown() {
+	log.Println("Stopping all processes")
+	m.shuttingDown = true
+	for key := range m.definitions {
+		delete(m.definitions, key)
+	}
+	for key := range m.waiting {
+		delete(m.waiting, key)
+	}
+	for key := range m.timers {
+		m.unschedule(key)
+	}
+	for key := range m.queued {
+		delete(m.queued, key)
+	}
+	m.stopReady()
+	m.checkDone()
+}
+
+// checkDone tells main that shutdown is complete once all children are gone
+func (m *monitor) checkDone() {
+	if m.shuttingDown && len(m.processMap) == 0 {
+		m.request.doneChan <- true
+	}
+}
+
+func (m *monitor) handleExit(e *exit) {
+	key := e.child.process.Key
+	if m.processMap[key] != e.child {
+		log.Println("Ignoring exit of an old child of process: " + key)
+		return
+	}
+	delete(m.processMap, key)
+	m.saveState()
+	log.Printf("Process '%s' exited with code %d signal '%s' after running for %s\n",
+		key, e.exitCode, e.signal, e.runtime)
+	if e.oom {
+		log.Printf("Process '%s' was killed for running out of memory\n", key)
+	}
+	process := e.child.process
+	process.ExitCode = e.exitCode
+	process.ExitSignal = e.signal
+	process.LastExitTime = e.time.Format(time.RFC3339)
+	process.Strays = e.strays
+	switch {
+	case e.oom:
+		process.ExitReason = "oom"
+	case e.child.unhealthy:
+		process.ExitReason = "unhealthy"
+	case e.child.stopping:
+		process.ExitReason = "stopped"
+	default:
+		process.ExitReason = "exited"
+	}
+	process.OperState = "off"
+	if process.HealthCheck.Type != "" {
+		process.Health = "unknown"
+	}
+	if isJob(process) {
+		process.Runs = m.recordRun(e, process)
+	}
+	// A child stopped for being unhealthy goes through its restart policy,
+	// unless it has been turned off in the meantime
+	definition, wanted := m.definitions[key]
+	if e.child.stopping && (!e.child.unhealthy || !wanted) {
+		m.request.resultChan <- &result{process: process, success: e.success, removed: e.child.removing}
+		if m.shuttingDown {
+			m.stopReady()
+			m.checkDone()
+		} else if wanted {
+			// A singleton stopped when its lock was lost goes on standby,
+			// or starts again if the lock was acquired in the meantime. A
+			// job stopped to be replaced starts its queued run.
+			m.startQueued(key)
+			m.start(definition)
+		}
+		return
+	}
+	if m.trackers[key] == nil {
+		m.trackers[key] = new(restartTracker)
+	}
+	success := e.success && !e.child.unhealthy && !e.oom
+	restart, delay, failed := m.trackers[key].next(restartPolicy(process), success, e.time)
+	process.Restarts = m.trackers[key].total
+	switch {
+	case restart:
+		log.Printf("Restarting process '%s' in %s\n", key, delay)
+		time.AfterFunc(delay, func() { m.restartChan <- key })
+	case failed:
+		log.Printf("Process '%s' exceeded its restart limit\n", key)
+		process.OperState = "failed"
+		delete(m.definitions, key)
+		m.unschedule(key)
+		delete(m.queued, key)
+	case m.timers[key] != nil:
+		// A cron job that is turned on waits for its next run
+		process.OperState = "scheduled"
+	default:
+		delete(m.definitions, key)
+	}
+	m.request.resultChan <- &result{process: process, success: success}
+	if wanted && !restart && !failed && m.startQueued(key) {
+		m.start(definition)
+	}
+}
+
+// handleElection starts the singleton processes whose lock was acquired, and
+// stops those whose lock was lost
+func (m *monitor) handleElection(e *election) {
+	if e.leader {
+		log.Printf("Elected to run process '%s'\n", e.name)
+		m.leaders[e.name] = true
+		m.startWaiting()
+		return
+	}
+	delete(m.leaders, e.name)
+	for key, c := range m.processMap {
+		if c.process.Singleton && definitionName(c.process) == e.name {
+			log.Println("Lost the lock of process, stopping it: " + key)
+			m.stop(c)
+		}
+	}
+}
+
+func (m *monitor) handleHealth(h *healthChange) {
+	c := h.child
+	if m.processMap[c.process.Key] != c || c.stopping {
+		return
+	}
+	log.Printf("Process '%s' is %s\n", c.process.Key, h.health)
+	c.process.Health = h.health
+	m.request.resultChan <- &result{process: c.process, success: true}
+	if h.health == "unhealthy" && c.process.HealthCheck.Restart {
+		log.Println("Stopping unhealthy process: " + c.process.Key)
+		c.unhealthy = true
+		m.stop(c)
+	}
+}
+
+func (m *monitor) handleUsage(u *usageReport) {
+	c := u.child
+	if m.processMap[c.process.Key] != c || c.process.Usage == u.usage {
+		return
+	}
+	c.process.Usage = u.usage
+	m.request.resultChan <- &result{process: c.process, success: true}
+}
+
+// waitProcess reaps the child and reports how it exited
+func waitProcess(c *child, exitChan chan<- *exit) {
+	c.cmd.Wait()
+	exitCode, signal, success := -1, "", false
+	if state := c.cmd.ProcessState; state != nil {
+		exitCode = state.ExitCode()
+		success = state.Success()
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			signal = status.Signal().String()
+		}
+	}
+	reportExit(c, exitChan, exitCode, signal, success)
+}
+
+// reportExit cleans up after the child and sends its exit to the monitor
+func reportExit(c *child, exitChan chan<- *exit, exitCode int, signal string, success bool) {
+	strays := killStrays(c)
+	if strays > 0 {
+		log.Printf("Killed %d stray processes of process '%s'\n", strays, c.process.Key)
+	}
+	close(c.exited)
+	e := &exit{child: c, exitCode: exitCode, signal: signal, success: success, time: time.Now(),
+		oom: c.cgroup.oomKilled(), strays: strays}
+	c.cgroup.remove()
+	e.runtime = e.time.Sub(c.started)
+	exitChan <- e
+}
+
+// A started process
+type child struct {
+	// The command is nil for a child adopted from a previous run of the agent
+	cmd     *exec.Cmd
+	proc    *os.Process
+	process data.Process
+	started time.Time
+	// Set when the agent is stopping the child on purpose
+	stopping bool
+	// Set when the child is being stopped because it is unhealthy
+	unhealthy bool
+	// Set when the child is stopped to be removed
+	removing bool
+	// Closed once the child has been reaped
+	exited chan bool
+	// Identify the child in the state file, see processIdentity
+	startTime string
+	cmdline   string
+	// Limits the resources of the child, nil when cgroups are not used
+	cgroup *cgroup
+	// What started the run of a job, see data.Run
+	trigger string
+}
+
+// How a child exited
+type exit struct {
+	child    *child
+	exitCode int
+	signal   string
+	time     time.Time
+	runtime  time.Duration
+	success  bool
+	// Set when the kernel killed the child for running out of memory
+	oom bool
+	// The number of descendants killed after the child exited
+	strays int
+}
+
+// The resource usage of a child
+type usageReport struct {
+	child *child
+	usage data.ResourceUsage
+}
+
+// reportUsage sends the resource usage of the child every usageInterval
+// until it exits
+func reportUsage(c *child, usageChan chan<- *usageReport) {
+	ticker := time.NewTicker(*usageInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.exited:
+			return
+		case <-ticker.C:
+		}
+		select {
+		case usageChan <- &usageReport{child: c, usage: c.cgroup.usage()}:
+		case <-c.exited:
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/jetblack87/maestro/data"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startMonitor runs a monitor without processes, which is shut down at the end
+// of the test
+func startMonitor(t *testing.T) *processStartRequest {
+	processLogDir = t.TempDir()
+	request := &processStartRequest{
+		commands:     newCommandQueue(),
+		resultChan:   make(chan *result),
+		shutdownChan: make(chan bool),
+		doneChan:     make(chan bool),
+		electionChan: make(chan *election)}
+	go startAndMonitorProcesses(request)
+	t.Cleanup(func() {
+		go func() { request.shutdownChan <- true }()
+		for {
+			select {
+			case <-request.resultChan:
+			case <-request.doneChan:
+				return
+			}
+		}
+	})
+	return request
+}
+
+// sleeper is a process that runs until it is stopped
+func sleeper(name string, dependsOn ...string) data.Process {
+	return data.Process{Name: name, Key: name, ProcessClass: "/maestro/d01/config/processes/" + name,
+		Command: "sleep", Args: []string{"60"}, AdminState: "on", DependsOn: dependsOn}
+}
+
+// expectResult checks the next result sent by the monitor
+func expectResult(t *testing.T, request *processStartRequest, key, operState string) {
+	t.Helper()
+	select {
+	case r := <-request.resultChan:
+		if r.process.Key != key || r.process.OperState != operState {
+			t.Fatalf("Got process '%s' %s, want '%s' %s", r.process.Key, r.process.OperState, key, operState)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No result for process '%s'", key)
+	}
+}
+
+// TestMonitorAssignedDependency checks that a process assigned after the agent
+// started waits on a dependency assigned along with it
+func TestMonitorAssignedDependency(t *testing.T) {
+	request := startMonitor(t)
+	request.commands.push(&command{names: map[string]bool{"web": true, "db": true}})
+	request.commands.push(&command{process: sleeper("web", "db"), adminState: "on"})
+	expectResult(t, request, "web", "waiting")
+	request.commands.push(&command{process: sleeper("db"), adminState: "on"})
+	expectResult(t, request, "db", "on")
+	expectResult(t, request, "web", "on")
+}
+
+// TestMonitorUnassignedDependency checks that a process stops waiting on a
+// dependency that is no longer assigned to the agent
+func TestMonitorUnassignedDependency(t *testing.T) {
+	request := startMonitor(t)
+	request.commands.push(&command{names: map[string]bool{"web": true, "db": true}})
+	request.commands.push(&command{process: sleeper("web", "db"), adminState: "on"})
+	expectResult(t, request, "web", "waiting")
+	request.commands.push(&command{names: map[string]bool{"web": true}})
+	expectResult(t, request, "web", "on")
+}
+
+// TestMonitorBusy checks that commands can be sent while the monitor is
+// blocked sending a result, and that it handles them in the order they were
+// sent
+func TestMonitorBusy(t *testing.T) {
+	request := startMonitor(t)
+	sent := make(chan bool)
+	go func() {
+		// Each removal is answered with a result, the first of which blocks
+		// the monitor until it is received
+		for i := 0; i < 100; i++ {
+			name := strconv.Itoa(i)
+			request.commands.push(&command{process: data.Process{Name: name, Key: name}, adminState: "off", remove: true})
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sending commands blocked while the monitor is busy")
+	}
+	for i := 0; i < 100; i++ {
+		expectResult(t, request, strconv.Itoa(i), "off")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// killWithAgent makes the kernel kill the process when the agent dies, so
+// that a singleton does not keep running while another agent takes it over
+func killWithAgent(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+}
+
+// processIdentity reads the start time (in clock ticks since boot) and the
+// command line of a process from /proc, together they tell a process apart
+// from a later one that reuses its pid
+func processIdentity(pid int) (startTime string, cmdline string, err error) {
+	dir := "/proc/" + strconv.Itoa(pid)
+	stat, err := os.ReadFile(dir + "/stat")
+	if err != nil {
+		return "", "", err
+	}
+	// The fields after the command name, which is in parentheses
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return "", "", errors.New("Malformed " + dir + "/stat")
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return "", "", errors.New("Malformed " + dir + "/stat")
+	}
+	if fields[0] == "Z" {
+		return "", "", errors.New("Process has exited: " + strconv.Itoa(pid))
+	}
+	content, err := os.ReadFile(dir + "/cmdline")
+	if err != nil {
+		return "", "", err
+	}
+	cmdline = strings.TrimRight(strings.Replace(string(content), "\x00", " ", -1), " ")
+	return fields[19], cmdline, nil
+}
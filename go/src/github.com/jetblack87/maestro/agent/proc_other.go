@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// Singletons keep running when the agent dies on other systems
+func killWithAgent(cmd *exec.Cmd) {
+}
+
+// Processes can only be identified through /proc, so the agent cannot adopt
+// the processes of a previous run on other systems
+
+func processIdentity(pid int) (startTime string, cmdline string, err error) {
+	return "", "", errors.New("Process identity is only available on Linux")
+}
@@ -0,0 +1,77 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setProcessGroup starts the command in a process group of its own, so that
+// the whole tree of the process can be signaled
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalGroup sends the signal to the process group led by the process
+func signalGroup(process *os.Process, signal syscall.Signal) error {
+	return syscall.Kill(-process.Pid, signal)
+}
+
+// killGroup kills the process group led by the process
+func killGroup(process *os.Process) error {
+	return syscall.Kill(-process.Pid, syscall.SIGKILL)
+}
+
+// killStrays kills what is left of the process group, and of the cgroup, of
+// a child that has exited. It returns the number of processes killed, which
+// is only known on systems with /proc.
+func killStrays(c *child) int {
+	pgid := c.proc.Pid
+	strays := make(map[int]bool)
+	for _, pid := range groupMembers(pgid) {
+		strays[pid] = true
+	}
+	for _, pid := range c.cgroup.procs() {
+		strays[pid] = true
+	}
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	for pid := range strays {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+	return len(strays)
+}
+
+// groupMembers lists the processes in the process group from /proc
+func groupMembers(pgid int) []int {
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	var members []int
+	for _, stat := range stats {
+		content, err := os.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		// The fields after the command name, which is in parentheses
+		end := strings.LastIndexByte(string(content), ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(string(content[end+1:]))
+		// Zombies are already dead, they only wait on their parent
+		if len(fields) < 3 || fields[2] != strconv.Itoa(pgid) || fields[0] == "Z" {
+			continue
+		}
+		if pid, err := strconv.Atoi(filepath.Base(filepath.Dir(stat))); err == nil {
+			members = append(members, pid)
+		}
+	}
+	return members
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command in a process group of its own
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// Windows cannot signal a process group, only the process itself
+
+func signalGroup(process *os.Process, signal syscall.Signal) error {
+	return process.Signal(signal)
+}
+
+func killGroup(process *os.Process) error {
+	return process.Kill()
+}
+
+func killStrays(c *child) int {
+	return 0
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/jetblack87/maestro/data"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Defaults for the fields of data.RestartPolicy that are not set
+const DEFAULT_RESTART_POLICY = "always"
+const DEFAULT_RESTART_WINDOW = 5 * time.Minute
+const DEFAULT_RESTART_BACKOFF = 1 * time.Second
+const DEFAULT_RESTART_MAX_BACKOFF = 1 * time.Minute
+
+// restartTracker keeps the recent restarts of one process so that its
+// restart policy can be applied
+type restartTracker struct {
+	restarts []time.Time
+	// All restarts since the agent started
+	total int
+}
+
+// next decides what to do with a process that exited on its own. It returns
+// whether the process should be restarted, and if so after what delay. failed
+// is true when the process has used up its restart budget.
+func (t *restartTracker) next(policy data.RestartPolicy, success bool, now time.Time) (restart bool, delay time.Duration, failed bool) {
+	switch restartPolicyName(policy) {
+	case "never":
+		return false, 0, false
+	case "on-failure":
+		if success {
+			return false, 0, false
+		}
+	}
+
+	// Forget restarts that are outside of the window
+	window := parseDuration(policy.Window, DEFAULT_RESTART_WINDOW)
+	recent := t.restarts[:0]
+	for _, restart := range t.restarts {
+		if now.Sub(restart) < window {
+			recent = append(recent, restart)
+		}
+	}
+	t.restarts = recent
+
+	if policy.MaxRestarts > 0 && len(t.restarts) >= policy.MaxRestarts {
+		return false, 0, true
+	}
+
+	// Exponential backoff with jitter, between half and all of the delay
+	delay = parseDuration(policy.Backoff, DEFAULT_RESTART_BACKOFF)
+	maxBackoff := parseDuration(policy.MaxBackoff, DEFAULT_RESTART_MAX_BACKOFF)
+	for i := 0; i < len(t.restarts) && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	if delay > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+
+	t.restarts = append(t.restarts, now)
+	t.total++
+	return true, delay, false
+}
+
+// reset clears the recent restarts, for when a process is started on request
+func (t *restartTracker) reset() {
+	t.restarts = nil
+}
+
+func restartPolicyName(policy data.RestartPolicy) string {
+	switch policy.Policy {
+	case "always", "on-failure", "never":
+		return policy.Policy
+	case "":
+		return DEFAULT_RESTART_POLICY
+	}
+	log.Printf("Unknown restart policy '%s', using '%s'\n", policy.Policy, DEFAULT_RESTART_POLICY)
+	return DEFAULT_RESTART_POLICY
+}
+
+// parseDuration parses value, falling back to def when it is empty or invalid
+func parseDuration(value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration '%s', using '%s'\n", value, def)
+		return def
+	}
+	return duration
+}
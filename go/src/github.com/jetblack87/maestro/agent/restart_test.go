@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/jetblack87/maestro/data"
+	"testing"
+	"time"
+)
+
+// expectDelay checks that the delay is the backoff with its jitter, between
+// half and all of it
+func expectDelay(t *testing.T, restart int, delay time.Duration, backoff time.Duration) {
+	t.Helper()
+	if delay < backoff/2 || delay > backoff {
+		t.Errorf("Restart %d: got a delay of %s, want between %s and %s", restart, delay, backoff/2, backoff)
+	}
+}
+
+// TestRestartBackoff checks that the delay doubles with every restart within
+// the window, up to the maximum
+func TestRestartBackoff(t *testing.T) {
+	policy := data.RestartPolicy{Backoff: "1s", MaxBackoff: "10s", Window: "1m"}
+	want := []time.Duration{1, 2, 4, 8, 10, 10}
+	var tracker restartTracker
+	now := time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC)
+	for i, backoff := range want {
+		restart, delay, failed := tracker.next(policy, false, now)
+		if !restart || failed {
+			t.Fatalf("Restart %d: got restart %v and failed %v", i, restart, failed)
+		}
+		expectDelay(t, i, delay, backoff*time.Second)
+		now = now.Add(time.Second)
+	}
+	if tracker.total != len(want) {
+		t.Errorf("Total restarts: got %d, want %d", tracker.total, len(want))
+	}
+}
+
+// TestRestartWindow checks that the backoff starts again once the process has
+// run for longer than the window, and after a reset
+func TestRestartWindow(t *testing.T) {
+	policy := data.RestartPolicy{Backoff: "1s", MaxBackoff: "1m", Window: "30s"}
+	var tracker restartTracker
+	now := time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		tracker.next(policy, false, now)
+		now = now.Add(time.Second)
+	}
+	// Stable for longer than the window
+	now = now.Add(time.Minute)
+	_, delay, _ := tracker.next(policy, false, now)
+	expectDelay(t, 3, delay, time.Second)
+	_, delay, _ = tracker.next(policy, false, now)
+	expectDelay(t, 4, delay, 2*time.Second)
+
+	tracker.reset()
+	_, delay, _ = tracker.next(policy, false, now)
+	expectDelay(t, 5, delay, time.Second)
+	if tracker.total != 6 {
+		t.Errorf("Total restarts: got %d, want 6", tracker.total)
+	}
+}
+
+// TestRestartLimit checks that a process fails once it has used up its
+// restarts within the window, and can be restarted once they are outside it
+func TestRestartLimit(t *testing.T) {
+	policy := data.RestartPolicy{MaxRestarts: 2, Window: "1m"}
+	var tracker restartTracker
+	now := time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		if restart, _, _ := tracker.next(policy, false, now); !restart {
+			t.Fatalf("Restart %d: not restarted", i)
+		}
+	}
+	if restart, _, failed := tracker.next(policy, false, now); restart || !failed {
+		t.Errorf("Restart over the limit: got restart %v and failed %v", restart, failed)
+	}
+	if restart, _, _ := tracker.next(policy, false, now.Add(2*time.Minute)); !restart {
+		t.Error("Not restarted after the window")
+	}
+}
+
+// TestRestartPolicy checks which exits each policy restarts
+func TestRestartPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		success bool
+		restart bool
+	}{
+		{"", true, true},
+		{"always", false, true},
+		{"on-failure", true, false},
+		{"on-failure", false, true},
+		{"never", false, false},
+		{"unknown", true, true},
+	}
+	for _, test := range tests {
+		var tracker restartTracker
+		restart, _, _ := tracker.next(data.RestartPolicy{Policy: test.policy}, test.success, time.Now())
+		if restart != test.restart {
+			t.Errorf("Policy '%s' on success %v: got restart %v, want %v", test.policy, test.success, restart, test.restart)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "syscall"
+
+// The signals a process may be stopped with, by name. Windows has no user
+// defined signals.
+var signalNames = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGTERM": syscall.SIGTERM,
+}
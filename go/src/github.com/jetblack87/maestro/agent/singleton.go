@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/jetblack87/maestro/data"
+	"log"
+)
+
+// The elections of the singleton processes, by the path of their definition.
+// Only used by the main goroutine.
+var elections = make(map[string]*data.Election)
+
+// The number of instances still to be removed before resigning an election,
+// by the path of the definition
+var resigning = make(map[string]int)
+
+// campaign starts the election of the agent to run the definition, if it is a
+// singleton. The lock is shared by the agents of the domain.
+func campaign(definition data.Process) {
+	class := definition.ProcessClass
+	if !definition.Singleton || elections[class] != nil {
+		// The definition may have been assigned again before its instances
+		// were removed, the agent keeps campaigning
+		delete(resigning, class)
+		return
+	}
+	name := definitionName(definition)
+	leaderChan := make(chan bool, 1)
+	elections[class] = data.Elect(store, "/maestro/"+*domainName+"/runtime/locks/"+name, *agentName, leaderChan)
+	go func() {
+		for leader := range leaderChan {
+			request.electionChan <- &election{name: name, leader: leader}
+		}
+	}()
+}
+
+// resignWhenRemoved resigns the election of the definition once its instances
+// are removed, so that another agent does not start it while they stop
+func resignWhenRemoved(class string, instances int) {
+	if elections[class] == nil {
+		return
+	}
+	resigning[class] = instances
+}
+
+// instanceRemoved resigns the election of the definition of the removed
+// process once it was its last instance
+func instanceRemoved(process data.Process) {
+	class := process.ProcessClass
+	if _, ok := resigning[class]; !ok {
+		return
+	}
+	resigning[class]--
+	if resigning[class] > 0 {
+		return
+	}
+	log.Printf("Resigning the election of process '%s'\n", class)
+	elections[class].Resign()
+	delete(elections, class)
+	delete(resigning, class)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/jetblack87/maestro/data"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How often the state file is refreshed, as the command line of a child
+// changes when it executes another program
+const STATE_REFRESH_INTERVAL = 10 * time.Second
+
+// How often an adopted child is checked, as it cannot be waited on
+const ADOPTED_POLL_INTERVAL = 1 * time.Second
+
+// agentState is saved to the state file, so that the agent can adopt the
+// children that are still running when it is restarted after a crash
+type agentState struct {
+	Children []childState
+}
+
+type childState struct {
+	Key  string
+	Name string
+	Pid  int
+	// The process group of the child, its pid as the child leads it
+	Pgid int
+	// StartTime and Cmdline identify the child, see processIdentity
+	StartTime string
+	Cmdline   string
+	Started   string
+	Cgroup    string
+	OOMKills  int
+}
+
+// saveState writes the running children to the state file
+func (m *monitor) saveState() {
+	if *stateFile == "" {
+		return
+	}
+	var state agentState
+	for _, c := range m.processMap {
+		if _, cmdline, err := processIdentity(c.proc.Pid); err == nil {
+			c.cmdline = cmdline
+		}
+		s := childState{Key: c.process.Key, Name: c.process.Name, Pid: c.proc.Pid, Pgid: c.proc.Pid,
+			StartTime: c.startTime, Cmdline: c.cmdline, Started: c.started.Format(time.RFC3339Nano)}
+		s.Cgroup, s.OOMKills = c.cgroup.identity()
+		state.Children = append(state.Children, s)
+	}
+	sort.Slice(state.Children, func(i, j int) bool {
+		return state.Children[i].Key < state.Children[j].Key
+	})
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		// Replace the file atomically, the agent may die at any time
+		err = os.WriteFile(*stateFile+".tmp", content, 0600)
+	}
+	if err == nil {
+		err = os.Rename(*stateFile+".tmp", *stateFile)
+	}
+	if err != nil {
+		log.Printf("Failed to save the state file '%s': %s\n", *stateFile, err.Error())
+	}
+}
+
+// setupStateFile makes the path of the state file absolute, naming it after
+// the domain and the agent when it is not given, so that agents running on
+// the same host do not share it
+func setupStateFile() {
+	if *stateFile == "" && *stateDir != "" {
+		err := os.MkdirAll(*stateDir, 0700)
+		if err != nil {
+			log.Printf("Failed to create the state directory '%s', processes cannot be adopted after a crash: %s\n", *stateDir, err.Error())
+			return
+		}
+		*stateFile = filepath.Join(*stateDir, *domainName+"-"+*agentName+".state")
+	}
+	if *stateFile == "" {
+		return
+	}
+	absolute, err := filepath.Abs(*stateFile)
+	if err != nil {
+		panic(err)
+	}
+	*stateFile = absolute
+	log.Println("Keeping the running processes in: " + *stateFile)
+}
+
+// loadState reads the children saved by a previous run of the agent, by key.
+// Only the processes of this agent are returned, a state file written by
+// another agent must not make this one kill its processes.
+func loadState() map[string]childState {
+	children := make(map[string]childState)
+	if *stateFile == "" {
+		return children
+	}
+	content, err := os.ReadFile(*stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read the state file '%s': %s\n", *stateFile, err.Error())
+		}
+		return children
+	}
+	var state agentState
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		log.Printf("Failed to parse the state file '%s': %s\n", *stateFile, err.Error())
+		return children
+	}
+	prefix := "/maestro/" + *domainName + "/runtime/agents/" + *agentName + "/"
+	for _, s := range state.Children {
+		if !strings.HasPrefix(data.KeyToPath(s.Key), prefix) {
+			log.Printf("Ignoring process '%s' of the state file, it does not belong to this agent\n", data.KeyToPath(s.Key))
+			continue
+		}
+		children[s.Key] = s
+	}
+	return children
+}
+
+// verifyChild checks whether a saved child is still running. ours is true
+// when its pid has not been reused by another process, and verified when its
+// command line has not changed either.
+func verifyChild(s childState) (verified bool, ours bool) {
+	startTime, cmdline, err := processIdentity(s.Pid)
+	if err != nil || startTime != s.StartTime {
+		return false, false
+	}
+	return cmdline == s.Cmdline, true
+}
+
+// waitAdopted polls an adopted child until it exits, its exit status cannot
+// be known as it is not a child of this run of the agent
+func waitAdopted(c *child, exitChan chan<- *exit) {
+	ticker := time.NewTicker(ADOPTED_POLL_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		startTime, _, err := processIdentity(c.proc.Pid)
+		if err != nil || startTime != c.startTime {
+			break
+		}
+	}
+	reportExit(c, exitChan, -1, "", false)
+}
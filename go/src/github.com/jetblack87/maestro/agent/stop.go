@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"github.com/jetblack87/maestro/data"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Defaults for the stop settings of data.Process that are not set
+const DEFAULT_STOP_SIGNAL = syscall.SIGTERM
+const DEFAULT_STOP_TIMEOUT = 10 * time.Second
+
+// stopProcess asks the child to stop, either with its stop command or its
+// stop signal, and kills it if it is still running once the stop timeout
+// has passed. The exit itself is reported by waitProcess.
+func stopProcess(c *child) {
+	process := c.process
+	timeout := parseDuration(process.StopTimeout, DEFAULT_STOP_TIMEOUT)
+	if process.StopCommand != "" {
+		err := runStopCommand(process, c.proc.Pid)
+		if err != nil {
+			log.Printf("Failed to run stop command for process '%s': %s\n", process.Key, err.Error())
+			signalProcess(c, DEFAULT_STOP_SIGNAL)
+		}
+	} else {
+		signal, err := parseSignal(process.StopSignal)
+		if err != nil {
+			// Only when the process was started before it was validated
+			log.Printf("%s, using %s\n", err.Error(), DEFAULT_STOP_SIGNAL)
+			signal = DEFAULT_STOP_SIGNAL
+		}
+		signalProcess(c, signal)
+	}
+
+	select {
+	case <-c.exited:
+	case <-time.After(timeout):
+		log.Printf("Process '%s' did not stop within %s, killing it\n", process.Key, timeout)
+		killGroup(c.proc)
+	}
+}
+
+// signalProcess sends the signal to the process group of the child, falling back to killing it when
+// the signal cannot be delivered (e.g. on Windows)
+func signalProcess(c *child, signal syscall.Signal) {
+	log.Printf("Sending %s to process '%s'\n", signal, c.process.Key)
+	err := signalGroup(c.proc, signal)
+	if err != nil {
+		log.Printf("Failed to signal process '%s', killing it: %s\n", c.process.Key, err.Error())
+		killGroup(c.proc)
+	}
+}
+
+// runStopCommand starts the stop command, passing the pid of the process to
+// stop in MAESTRO_PID
+func runStopCommand(process data.Process, pid int) error {
+	cmd := buildStopCommand(process, pid)
+	log.Println("Running stop command: " + strings.Join(cmd.Args, " "))
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// buildStopCommand creates the stop command of the process, its arguments are
+// handled like those of the process itself
+func buildStopCommand(process data.Process, pid int) *exec.Cmd {
+	command := process.StopCommand
+	args := process.StopArgs
+	if len(args) == 0 {
+		// Legacy form of the command and its arguments
+		fields := strings.Fields(command)
+		command, args = fields[0], fields[1:]
+	}
+	cmd := exec.Command(command, args...)
+	cmd.Env = append(os.Environ(), "MAESTRO_PID="+strconv.Itoa(pid))
+	return cmd
+}
+
+// validateStop checks the stop settings of the process
+func validateStop(process data.Process) error {
+	if process.StopCommand == "" && len(process.StopArgs) > 0 {
+		return errors.New("StopArgs requires a StopCommand")
+	}
+	if process.StopCommand != "" && strings.TrimSpace(process.StopCommand) == "" {
+		return errors.New("Empty stop command")
+	}
+	_, err := parseSignal(process.StopSignal)
+	return err
+}
+
+// parseSignal accepts a signal name ("SIGTERM" or "TERM") or number
+func parseSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		return DEFAULT_STOP_SIGNAL, nil
+	}
+	signalName := strings.ToUpper(name)
+	if !strings.HasPrefix(signalName, "SIG") {
+		signalName = "SIG" + signalName
+	}
+	if signal, ok := signalNames[signalName]; ok {
+		return signal, nil
+	}
+	if number, err := strconv.Atoi(strings.TrimPrefix(signalName, "SIG")); err == nil && number > 0 {
+		return syscall.Signal(number), nil
+	}
+	return 0, errors.New("Unknown stop signal: " + name)
+}
@@ -0,0 +1,86 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/jetblack87/maestro/data"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// TestParseSignal checks the accepted signal names and numbers
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		name   string
+		signal syscall.Signal
+		valid  bool
+	}{
+		{"", syscall.SIGTERM, true},
+		{"SIGTERM", syscall.SIGTERM, true},
+		{"hup", syscall.SIGHUP, true},
+		{"USR1", syscall.SIGUSR1, true},
+		{"SIGUSR2", syscall.SIGUSR2, true},
+		{"9", syscall.SIGKILL, true},
+		{"SIG15", syscall.SIGTERM, true},
+		{"SIGFOO", 0, false},
+		{"0", 0, false},
+		{"-1", 0, false},
+	}
+	for _, test := range tests {
+		signal, err := parseSignal(test.name)
+		if (err == nil) != test.valid {
+			t.Errorf("Signal '%s': got error %v, want valid %v", test.name, err, test.valid)
+		} else if signal != test.signal {
+			t.Errorf("Signal '%s': got %d, want %d", test.name, signal, test.signal)
+		}
+	}
+}
+
+// TestValidateStop checks that unknown stop signals are rejected before the
+// process is started
+func TestValidateStop(t *testing.T) {
+	tests := []struct {
+		process data.Process
+		valid   bool
+	}{
+		{data.Process{}, true},
+		{data.Process{StopSignal: "USR1"}, true},
+		{data.Process{StopSignal: "STOPPLEASE"}, false},
+		{data.Process{StopCommand: "/bin/stop", StopArgs: []string{"a b"}}, true},
+		{data.Process{StopArgs: []string{"a"}}, false},
+		{data.Process{StopCommand: "  "}, false},
+	}
+	for i, test := range tests {
+		err := validateStop(test.process)
+		if (err == nil) != test.valid {
+			t.Errorf("Process %d: got error %v, want valid %v", i, err, test.valid)
+		}
+	}
+}
+
+// TestBuildStopCommand checks that the stop arguments are passed as given,
+// and that the legacy form is split on white space
+func TestBuildStopCommand(t *testing.T) {
+	tests := []struct {
+		process data.Process
+		args    []string
+	}{
+		{data.Process{StopCommand: "/bin/stop", StopArgs: []string{"--reason", "admin state off"}},
+			[]string{"/bin/stop", "--reason", "admin state off"}},
+		{data.Process{StopCommand: "/opt/my app/stop", StopArgs: []string{"now"}},
+			[]string{"/opt/my app/stop", "now"}},
+		{data.Process{StopCommand: "/bin/stop --now  quietly"},
+			[]string{"/bin/stop", "--now", "quietly"}},
+	}
+	for i, test := range tests {
+		cmd := buildStopCommand(test.process, 42)
+		if !reflect.DeepEqual(cmd.Args, test.args) {
+			t.Errorf("Process %d: got arguments %q, want %q", i, cmd.Args, test.args)
+		}
+		if cmd.Env[len(cmd.Env)-1] != "MAESTRO_PID=42" {
+			t.Errorf("Process %d: got environment %q", i, cmd.Env[len(cmd.Env)-1])
+		}
+	}
+}
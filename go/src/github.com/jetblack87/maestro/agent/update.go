@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"github.com/jetblack87/maestro/data"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// How long to wait for more changes to a configuration node before applying
+// them, a definition is usually written one node at a time
+const SETTLE_DELAY = time.Second
+
+// The definitions of the processes assigned to the agent as they were last
+// applied, by their path. Only used by the main goroutine, like the maps below.
+var loadedDefinitions = make(map[string]data.Process)
+
+// The paths of the definitions the agent follows, mapped to whether they are
+// watched. A watch lasts until its definition is deleted.
+var watchedDefinitions = make(map[string]bool)
+
+// The paths of the configuration nodes that changed and are waiting to settle
+var pendingChanges = make(map[string]bool)
+
+// Receives the paths of the configuration nodes that have settled
+var settledChan = make(chan string)
+
+// updatePolicy is the update policy of the process, "restart" by default
+func updatePolicy(process data.Process) string {
+	if process.UpdatePolicy == "" {
+		return "restart"
+	}
+	return process.UpdatePolicy
+}
+
+// validateUpdatePolicy checks the update policy of the process
+func validateUpdatePolicy(process data.Process) error {
+	switch process.UpdatePolicy {
+	case "", "restart", "ignore", "on-next-start":
+		return nil
+	}
+	return errors.New("Unknown update policy: " + process.UpdatePolicy)
+}
+
+// watchDefinition watches the whole definition, including the number of
+// instances
+func watchDefinition(definition data.Process, watchChannel chan<- data.Event) {
+	class := definition.ProcessClass
+	if watchedDefinitions[class] {
+		return
+	}
+	err := store.WatchTree(class, watchChannel)
+	if err != nil {
+		log.Println("Failed to add watch to process definition:\n" + err.Error())
+		return
+	}
+	watchedDefinitions[class] = true
+}
+
+// definitionClass is the path of the watched definition the node belongs
+// to, or "" when it does not belong to one
+func definitionClass(nodepath string) string {
+	for class := range watchedDefinitions {
+		if nodepath == class || strings.HasPrefix(nodepath, class+"/") {
+			return class
+		}
+	}
+	return ""
+}
+
+// settle sends the path of the configuration node on settledChan once it has
+// not changed for SETTLE_DELAY
+func settle(nodepath string) {
+	if pendingChanges[nodepath] {
+		return
+	}
+	pendingChanges[nodepath] = true
+	time.AfterFunc(SETTLE_DELAY, func() { settledChan <- nodepath })
+}
+
+// applyDefinition brings the instances of the definition in line with it:
+// the number of instances is changed and the instances that are kept are
+// updated according to the update policy
+func applyDefinition(class string, watchChannel chan<- data.Event) {
+	current, ok := instanceCounts[class]
+	if !ok {
+		return
+	}
+	definition, err := loadDefinition(class)
+	if err == data.ErrNoNode {
+		log.Printf("Process definition '%s' is gone, its instances keep running until it is no longer assigned\n", class)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading process '%s': %s\n", class, err)
+		return
+	}
+	// The watch ends when the definition is deleted, even if it is
+	// written again right away
+	watchDefinition(definition, watchChannel)
+	previous := loadedDefinitions[class]
+	loadedDefinitions[class] = definition
+	wanted := data.InstanceCount(definition)
+	if definitionDiffers(previous, definition) {
+		log.Printf("Process definition '%s' changed\n", class)
+		updateInstances(definition, minInt(current, wanted))
+	}
+	if wanted != current {
+		log.Printf("Scaling process '%s' from %d to %d instances\n", class, current, wanted)
+		setInstances(definition, current, wanted, watchChannel)
+	}
+	campaign(definition)
+}
+
+// definitionDiffers tells whether the definitions differ in more than their
+// number of instances and admin state, which are applied on their own
+func definitionDiffers(previous, definition data.Process) bool {
+	previous.Instances, definition.Instances = 0, 0
+	previous.AdminState, definition.AdminState = "", ""
+	return !reflect.DeepEqual(previous, definition)
+}
+
+// updateInstances writes the changed definition to the runtime nodes of its
+// first count instances and tells the monitor, unless the update policy is
+// "ignore"
+func updateInstances(definition data.Process, count int) {
+	if updatePolicy(definition) == "ignore" {
+		log.Printf("Ignoring the change of process '%s' until the agent restarts\n", definition.ProcessClass)
+		return
+	}
+	for i := 0; i < count; i++ {
+		process := newInstance(definition, i)
+		adminState, err := store.GetValue(data.KeyToPath(process.Key) + "/admin_state")
+		if err == nil && validateInstance(process) == nil {
+			// The instance stays in the state it was turned to
+			process.AdminState = string(adminState)
+		}
+		// The monitor reports the state of the instance
+		process.OperState = ""
+		process.Pid = -1
+		err = store.UpdateProcess(process.Key, process, true)
+		if err != nil {
+			log.Printf("Error updating instance '%s': %s\n", process.Name, err)
+			continue
+		}
+		request.commands.push(&command{process: process, update: true})
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// handleUpdate makes the process start with its new definition from now on.
+// With the "restart" update policy a running service is restarted right
+// away, a job that is running finishes its run first.
+func (m *monitor) handleUpdate(process data.Process) {
+	key := process.Key
+	running := m.processMap[key]
+	if running != nil {
+		running.process = withRuntimeState(process, running.process)
+	}
+	if _, wanted := m.definitions[key]; !wanted {
+		// It starts from its runtime node, which has been updated
+		return
+	}
+	m.definitions[key] = process
+	if process.Type == "cron" && m.timers[key] != nil {
+		m.schedule(process)
+	}
+	if m.waiting[key] != "" {
+		// It may not have to wait anymore
+		m.start(process)
+		return
+	}
+	if running == nil || running.stopping || isJob(process) || updatePolicy(process) != "restart" {
+		return
+	}
+	log.Println("Restarting process to apply its new definition: " + key)
+	m.stop(running)
+}
+
+// withRuntimeState is the process with the fields that the agent maintains
+// taken from running, so that reporting on the running child keeps the new
+// definition in the runtime node
+func withRuntimeState(process, running data.Process) data.Process {
+	process.AdminState = running.AdminState
+	process.OperState = running.OperState
+	process.Pid = running.Pid
+	process.Restarts = running.Restarts
+	process.ExitCode = running.ExitCode
+	process.ExitSignal = running.ExitSignal
+	process.ExitReason = running.ExitReason
+	process.LastExitTime = running.LastExitTime
+	process.Strays = running.Strays
+	process.Health = running.Health
+	process.Usage = running.Usage
+	process.Runs = running.Runs
+	process.RunRequested = running.RunRequested
+	return process
+}
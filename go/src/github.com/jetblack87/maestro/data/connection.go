@@ -0,0 +1,70 @@
+package data
+
+import (
+	"sync"
+)
+
+// connState tracks the state of the connection of a store and tells the
+// watchers of the state about every change, without waiting for them
+type connState struct {
+	mutex sync.Mutex
+	state ConnectionState
+	// Closed and replaced on every change of the state
+	changed  chan bool
+	watchers []chan<- ConnectionState
+}
+
+func newConnState(state ConnectionState) *connState {
+	return &connState{state: state, changed: make(chan bool)}
+}
+
+func (c *connState) get() ConnectionState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state
+}
+
+func (c *connState) set(state ConnectionState) {
+	c.mutex.Lock()
+	if c.state == state || c.state == StateClosed {
+		c.mutex.Unlock()
+		return
+	}
+	c.state = state
+	close(c.changed)
+	c.changed = make(chan bool)
+	watchers := c.watchers
+	if state == StateClosed {
+		c.watchers = nil
+	}
+	c.mutex.Unlock()
+	for _, watcher := range watchers {
+		select {
+		case watcher <- state:
+		default:
+		}
+	}
+}
+
+func (c *connState) watch(watcher chan<- ConnectionState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.watchers = append(c.watchers, watcher)
+}
+
+// waitConnected blocks until the store is connected, it returns false if the
+// store is closed instead
+func (c *connState) waitConnected() bool {
+	for {
+		c.mutex.Lock()
+		state, changed := c.state, c.changed
+		c.mutex.Unlock()
+		switch state {
+		case StateConnected:
+			return true
+		case StateClosed:
+			return false
+		}
+		<-changed
+	}
+}
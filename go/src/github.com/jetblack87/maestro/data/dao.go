@@ -0,0 +1,1266 @@
+package data
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// nodeStore is the hierarchical node API that each backend provides. All of
+// the domain/agent/process mapping lives in nodeDAO so that the backends only
+// have to deal with raw nodes.
+type nodeStore interface {
+	exists(nodepath string) (bool, error)
+	get(nodepath string) ([]byte, error)
+	children(nodepath string) ([]string, error)
+	create(nodepath string, data []byte, ephemeral bool) (string, error)
+	// createSequential creates an ephemeral node named prefix followed by
+	// the next sequence number of its parent, which must exist
+	createSequential(prefix string, data []byte) (string, error)
+	// created orders the node among all of the nodes of the store by when
+	// they were created, nodes created later have greater numbers
+	created(nodepath string) (int64, error)
+	set(nodepath string, data []byte) error
+	remove(nodepath string) error
+	// existsW returns a channel that receives a single event the next time
+	// the node is created, deleted or changed
+	existsW(nodepath string) (bool, <-chan Event, error)
+	// childrenW returns a channel that receives a single event the next
+	// time a child of the node is created or deleted, or the node is deleted
+	childrenW(nodepath string) ([]string, <-chan Event, error)
+	close()
+}
+
+// nodeDAO implements Store on top of a nodeStore
+type nodeDAO struct {
+	nodes nodeStore
+	conn  *connState
+}
+
+// How long to wait before setting a watch again after it failed
+const WATCH_RETRY_INTERVAL = 5 * time.Second
+
+// #### PUBLIC METHODS ####
+
+func (dao *nodeDAO) LoadDomains(key string, recursive bool) ([]Domain, error) {
+	nodepath := KeyToPath(key)
+	var domains []Domain
+	domainNodes, _ := dao.nodes.children(nodepath)
+	for _, domainNode := range domainNodes {
+		domain, err := dao.LoadDomain(PathToKey(nodepath+"/"+domainNode), recursive)
+		if err == ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return domains, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+func (dao *nodeDAO) LoadDomain(key string, recursive bool) (Domain, error) {
+	nodepath := KeyToPath(key)
+	var domain Domain
+	domain.Key = key
+	domain.Name = path.Base(nodepath)
+	exists, _ := dao.nodes.exists(nodepath)
+	if exists {
+		config, err := dao.LoadStaticConfig(PathToKey(nodepath+"/config"), recursive)
+		if err != nil {
+			return domain, err
+		}
+		domain.Config = config
+		runtime, err := dao.LoadRuntimeConfig(PathToKey(nodepath+"/runtime"), recursive)
+		if err != nil {
+			return domain, err
+		}
+		domain.Runtime = runtime
+	} else {
+		return domain, ErrNoNode
+	}
+	return domain, nil
+}
+
+func (dao *nodeDAO) LoadStaticConfig(key string, recursive bool) (StaticConfig, error) {
+	nodepath := KeyToPath(key)
+	var config StaticConfig
+	exists, _ := dao.nodes.exists(nodepath)
+	if exists {
+		agentsNode, _ := dao.nodes.children(nodepath + "/agents")
+		for _, agentNode := range agentsNode {
+			agent, err := dao.LoadAgent(PathToKey(nodepath+"/agents/"+agentNode), recursive)
+			if err == ErrNoNode {
+				continue
+			}
+			if err != nil {
+				return config, err
+			}
+			config.Agents = append(config.Agents, agent)
+		}
+
+		processesNode, _ := dao.nodes.children(nodepath + "/processes")
+		for _, processNode := range processesNode {
+			process, err := dao.LoadProcess(PathToKey(nodepath+"/processes/"+processNode), recursive)
+			if err == ErrNoNode {
+				continue
+			}
+			if err != nil {
+				return config, err
+			}
+			config.Processes = append(config.Processes, process)
+		}
+	} else {
+		log.Println("Static config node does not exist: " + nodepath)
+	}
+	return config, nil
+}
+
+func (dao *nodeDAO) LoadRuntimeConfig(key string, recursive bool) (RuntimeConfig, error) {
+	nodepath := KeyToPath(key)
+	var runtime RuntimeConfig
+	exists, _ := dao.nodes.exists(nodepath)
+	if exists {
+		agentsNode, _ := dao.nodes.children(nodepath + "/agents")
+		for _, agentNode := range agentsNode {
+			agent, err := dao.LoadAgent(PathToKey(nodepath+"/agents/"+agentNode), recursive)
+			if err == ErrNoNode {
+				continue
+			}
+			if err != nil {
+				return runtime, err
+			}
+			runtime.Agents = append(runtime.Agents, agent)
+		}
+
+		// The holder of a lock is the contender created first
+		locksNode, _ := dao.nodes.children(nodepath + "/locks")
+		for _, lockNode := range locksNode {
+			nodes, _ := contenders(dao, nodepath+"/locks/"+lockNode)
+			if len(nodes) == 0 {
+				continue
+			}
+			holder, ok := dao.getString(nodes[0])
+			if ok {
+				runtime.Locks = append(runtime.Locks, Lock{Name: lockNode, Holder: holder})
+			}
+		}
+	} else {
+		log.Println("Runtime config node does not exist: " + nodepath)
+	}
+	return runtime, nil
+}
+
+func (dao *nodeDAO) LoadAgent(key string, recursive bool) (Agent, error) {
+	nodepath := KeyToPath(key)
+	var agent Agent
+	agent.Key = key
+	agent.Name = path.Base(nodepath)
+	exists, _ := dao.nodes.exists(nodepath)
+	if exists {
+		processesNode, _ := dao.nodes.children(nodepath + "/processes")
+		for _, processNode := range processesNode {
+			process, err := dao.LoadProcess(PathToKey(nodepath+"/processes/"+processNode), recursive)
+			if err == ErrNoNode {
+				continue
+			}
+			if err != nil {
+				return agent, err
+			}
+			agent.Processes = append(agent.Processes, process)
+		}
+
+		if data, ok := dao.getString(nodepath + "/eph"); ok {
+			agent.Eph = data
+		}
+		agent.Address, _ = dao.getString(nodepath + "/address")
+		agent.AgentClass, _ = dao.getString(nodepath + "/agent_class")
+		agent.OS, _ = dao.getString(nodepath + "/os")
+	} else {
+		return agent, ErrNoNode
+	}
+	return agent, nil
+}
+
+func (dao *nodeDAO) LoadProcess(key string, recursive bool) (Process, error) {
+	nodepath := KeyToPath(key)
+	process := Process{Pid: -1}
+	process.Key = key
+	process.Name = path.Base(nodepath)
+	exists, _ := dao.nodes.exists(nodepath)
+	if exists {
+		if data, ok := dao.getString(nodepath + "/command"); ok {
+			process.Command = data
+		}
+		if data, ok := dao.getString(nodepath + "/arguments"); ok {
+			process.Arguments = data
+		}
+		process.Args = dao.loadArgs(nodepath + "/args")
+		process.Env = dao.loadEnv(nodepath + "/env")
+		if data, ok := dao.getString(nodepath + "/clear_env"); ok {
+			process.ClearEnv = data == "true"
+		}
+		process.WorkingDir, _ = dao.getString(nodepath + "/working_dir")
+		process.Type, _ = dao.getString(nodepath + "/type")
+		process.Schedule, _ = dao.getString(nodepath + "/schedule")
+		process.Overlap, _ = dao.getString(nodepath + "/overlap")
+		process.User, _ = dao.getString(nodepath + "/user")
+		process.Group, _ = dao.getString(nodepath + "/group")
+		process.Groups, _ = dao.nodes.children(nodepath + "/groups")
+		process.Umask, _ = dao.getString(nodepath + "/umask")
+		process.DependsOn, _ = dao.nodes.children(nodepath + "/depends_on")
+		if data, ok := dao.getString(nodepath + "/process_class"); ok {
+			process.ProcessClass = data
+		}
+		if data, ok := dao.getString(nodepath + "/singleton"); ok {
+			process.Singleton = data == "true"
+		}
+		process.Placement = dao.loadPlacement(nodepath + "/placement")
+		process.Instances, _ = dao.getInt(nodepath + "/instances")
+		process.Instance, _ = dao.getInt(nodepath + "/instance")
+		if data, ok := dao.getString(nodepath + "/admin_state"); ok {
+			process.AdminState = data
+		}
+		if data, ok := dao.getString(nodepath + "/oper_state"); ok {
+			process.OperState = data
+		}
+		if data, ok := dao.getString(nodepath + "/pid"); ok {
+			tempPid, err := strconv.ParseInt(data, 10, 32)
+			if err != nil {
+				log.Printf("Failed to parse pid '%s':\n%s", nodepath+"/pid", err)
+			} else {
+				process.Pid = int(tempPid)
+			}
+		}
+		if restarts, ok := dao.getInt(nodepath + "/restarts"); ok {
+			process.Restarts = restarts
+		}
+		process.RestartPolicy = dao.loadRestartPolicy(nodepath + "/restart_policy")
+		process.UpdatePolicy, _ = dao.getString(nodepath + "/update_policy")
+		if data, ok := dao.getString(nodepath + "/last_exit_time"); ok {
+			process.LastExitTime = data
+			process.ExitCode, _ = dao.getInt(nodepath + "/exit_code")
+			process.ExitSignal, _ = dao.getString(nodepath + "/exit_signal")
+			process.ExitReason, _ = dao.getString(nodepath + "/exit_reason")
+			process.Strays, _ = dao.getInt(nodepath + "/strays")
+		}
+		process.StopSignal, _ = dao.getString(nodepath + "/stop_signal")
+		process.StopTimeout, _ = dao.getString(nodepath + "/stop_timeout")
+		process.StopCommand, _ = dao.getString(nodepath + "/stop_command")
+		process.StopArgs = dao.loadArgs(nodepath + "/stop_args")
+		process.HealthCheck = dao.loadHealthCheck(nodepath + "/health_check")
+		process.Health, _ = dao.getString(nodepath + "/health")
+		process.Resources = dao.loadResources(nodepath + "/resources")
+		process.Usage = dao.loadResourceUsage(nodepath + "/usage")
+		process.Runs = dao.loadRuns(nodepath + "/runs")
+		process.RunRequested, _ = dao.getString(nodepath + "/run_requested")
+	} else {
+		return process, ErrNoNode
+	}
+	return process, nil
+}
+
+func (dao *nodeDAO) UpdateDomain(key string, domain Domain, recursive bool) error {
+	nodepath := KeyToPath(key)
+	err := dao.ensureExists(nodepath)
+	if err != nil {
+		return err
+	}
+	if recursive {
+		err := dao.UpdateStaticConfig(PathToKey(nodepath+"/config"), domain.Config, recursive)
+		if err != nil {
+			return err
+		}
+		err = dao.UpdateRuntimeConfig(PathToKey(nodepath+"/runtime"), domain.Runtime, recursive)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dao *nodeDAO) UpdateStaticConfig(key string, config StaticConfig, recursive bool) error {
+	nodepath := KeyToPath(key)
+	err := dao.ensureExists(nodepath + "/agents")
+	if err != nil {
+		return err
+	}
+	err = dao.ensureExists(nodepath + "/processes")
+	if err != nil {
+		return err
+	}
+	if recursive {
+		for _, value := range config.Agents {
+			err := dao.UpdateAgent(PathToKey(nodepath+"/agents/"+value.Name), value, recursive)
+			if err != nil {
+				return err
+			}
+		}
+		for _, value := range config.Processes {
+			err := dao.UpdateProcess(PathToKey(nodepath+"/processes/"+value.Name), value, recursive)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (dao *nodeDAO) UpdateRuntimeConfig(key string, runtime RuntimeConfig, recursive bool) error {
+	nodepath := KeyToPath(key)
+	err := dao.ensureExists(nodepath + "/agents")
+	if err != nil {
+		return err
+	}
+	// Locks are ephemeral nodes, which need their parent to exist
+	return dao.ensureExists(nodepath + "/locks")
+}
+
+func (dao *nodeDAO) UpdateAgent(key string, agent Agent, recursive bool) error {
+	nodepath := KeyToPath(key)
+	log.Println("Updating agent: " + nodepath)
+	err := dao.ensureExists(nodepath)
+	if err != nil {
+		return err
+	}
+	// The node is watched for the processes assigned to the agent
+	err = dao.ensureExists(nodepath + "/processes")
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/address", agent.Address)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/agent_class", agent.AgentClass)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/os", agent.OS)
+	if err != nil {
+		return err
+	}
+	if recursive {
+		for _, value := range agent.Processes {
+			err := dao.UpdateProcess(PathToKey(nodepath+"/processes/"+value.Name), value, recursive)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (dao *nodeDAO) UpdateProcess(key string, process Process, recursive bool) error {
+	nodepath := KeyToPath(key)
+	log.Println("Updating process: " + nodepath)
+	err := dao.ensureExists(nodepath)
+	if err != nil {
+		return err
+	}
+	if process.Command != "" {
+		err := dao.createOrSet(nodepath+"/command", []byte(process.Command))
+		if err != nil {
+			return err
+		}
+	}
+	if process.Arguments != "" {
+		err := dao.createOrSet(nodepath+"/arguments", []byte(process.Arguments))
+		if err != nil {
+			return err
+		}
+	}
+	if process.Args != nil {
+		err := dao.updateArgs(nodepath+"/args", process.Args)
+		if err != nil {
+			return err
+		}
+	}
+	if process.Env != nil {
+		err := dao.updateEnv(nodepath+"/env", process.Env)
+		if err != nil {
+			return err
+		}
+	}
+	if process.ClearEnv {
+		err := dao.updateString(nodepath+"/clear_env", "true")
+		if err != nil {
+			return err
+		}
+	}
+	err = dao.updateString(nodepath+"/working_dir", process.WorkingDir)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/type", process.Type)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/schedule", process.Schedule)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/overlap", process.Overlap)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/user", process.User)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/group", process.Group)
+	if err != nil {
+		return err
+	}
+	if process.Groups != nil {
+		err := dao.updateNames(nodepath+"/groups", process.Groups)
+		if err != nil {
+			return err
+		}
+	}
+	err = dao.updateString(nodepath+"/umask", process.Umask)
+	if err != nil {
+		return err
+	}
+	if process.DependsOn != nil {
+		err := dao.updateNames(nodepath+"/depends_on", process.DependsOn)
+		if err != nil {
+			return err
+		}
+	}
+	if process.ProcessClass != "" {
+		err := dao.createOrSet(nodepath+"/process_class", []byte(process.ProcessClass))
+		if err != nil {
+			return err
+		}
+	}
+	if process.Singleton {
+		err := dao.updateString(nodepath+"/singleton", "true")
+		if err != nil {
+			return err
+		}
+	}
+	err = dao.updatePlacement(nodepath+"/placement", process.Placement)
+	if err != nil {
+		return err
+	}
+	err = dao.updateInt(nodepath+"/instances", process.Instances)
+	if err != nil {
+		return err
+	}
+	err = dao.updateInt(nodepath+"/instance", process.Instance)
+	if err != nil {
+		return err
+	}
+	if process.AdminState != "" {
+		err := dao.createOrSet(nodepath+"/admin_state", []byte(process.AdminState))
+		if err != nil {
+			return err
+		}
+	}
+	if process.OperState != "" {
+		err := dao.createOrSet(nodepath+"/oper_state", []byte(process.OperState))
+		if err != nil {
+			return err
+		}
+	}
+	if process.Pid != -1 {
+		err := dao.createOrSet(nodepath+"/pid", []byte(strconv.FormatInt(int64(process.Pid), 10)))
+		if err != nil {
+			return err
+		}
+	}
+	if process.Restarts > 0 {
+		err := dao.createOrSet(nodepath+"/restarts", []byte(strconv.Itoa(process.Restarts)))
+		if err != nil {
+			return err
+		}
+	}
+	err = dao.updateRestartPolicy(nodepath+"/restart_policy", process.RestartPolicy)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/update_policy", process.UpdatePolicy)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/stop_signal", process.StopSignal)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/stop_timeout", process.StopTimeout)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/stop_command", process.StopCommand)
+	if err != nil {
+		return err
+	}
+	if process.StopArgs != nil {
+		err := dao.updateArgs(nodepath+"/stop_args", process.StopArgs)
+		if err != nil {
+			return err
+		}
+	}
+	err = dao.updateHealthCheck(nodepath+"/health_check", process.HealthCheck)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/health", process.Health)
+	if err != nil {
+		return err
+	}
+	err = dao.updateResources(nodepath+"/resources", process.Resources)
+	if err != nil {
+		return err
+	}
+	err = dao.updateResourceUsage(nodepath+"/usage", process.Usage)
+	if err != nil {
+		return err
+	}
+	if process.Runs != nil {
+		err := dao.updateRuns(nodepath+"/runs", process.Runs)
+		if err != nil {
+			return err
+		}
+	}
+	if process.Type == "oneshot" || process.Type == "cron" {
+		// The node is watched by the agent, so it must exist
+		err := dao.ensureExists(nodepath + "/run_requested")
+		if err != nil {
+			return err
+		}
+	}
+	err = dao.updateString(nodepath+"/run_requested", process.RunRequested)
+	if err != nil {
+		return err
+	}
+	if process.LastExitTime != "" {
+		err := dao.createOrSet(nodepath+"/exit_code", []byte(strconv.Itoa(process.ExitCode)))
+		if err != nil {
+			return err
+		}
+		err = dao.createOrSet(nodepath+"/exit_signal", []byte(process.ExitSignal))
+		if err != nil {
+			return err
+		}
+		err = dao.createOrSet(nodepath+"/exit_reason", []byte(process.ExitReason))
+		if err != nil {
+			return err
+		}
+		err = dao.createOrSet(nodepath+"/strays", []byte(strconv.Itoa(process.Strays)))
+		if err != nil {
+			return err
+		}
+		err = dao.createOrSet(nodepath+"/last_exit_time", []byte(process.LastExitTime))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dao *nodeDAO) Watch(path string, watchChannel chan<- Event) error {
+	log.Println("Adding watch: " + path)
+	eventChan, err := dao.watchNode(path)
+	if err == ErrNoNode {
+		return errors.New("The path '" + path + "' does not exist")
+	}
+	if err != nil {
+		return err
+	}
+	go dao.forward(path, watchChannel, eventChan, dao.watchNode)
+	return nil
+}
+
+func (dao *nodeDAO) WatchChildren(path string, watchChannel chan<- Event) error {
+	log.Println("Adding children watch: " + path)
+	eventChan, err := dao.watchChildren(path)
+	if err != nil {
+		return err
+	}
+	go dao.forward(path, watchChannel, eventChan, dao.watchChildren)
+	return nil
+}
+
+func (dao *nodeDAO) WatchTree(path string, watchChannel chan<- Event) error {
+	log.Println("Adding tree watch: " + path)
+	events := make(chan Event, 1)
+	watched := make(map[string]bool)
+	active, err := dao.watchTreeNode(path, events, watched)
+	if err != nil {
+		return err
+	}
+	if active == 0 {
+		return errors.New("The path '" + path + "' does not exist")
+	}
+	go func() {
+		// Every node has a data and a children watch, each of which sends
+		// EventNodeDeleted once when it ends
+		for active > 0 {
+			e := <-events
+			switch e.Type {
+			case EventNodeChildrenChanged:
+				children, err := dao.nodes.children(e.Path)
+				if err != nil {
+					break
+				}
+				for _, child := range children {
+					childpath := e.Path + "/" + child
+					if watched[childpath] {
+						continue
+					}
+					started, err := dao.watchTreeNode(childpath, events, watched)
+					if err != nil {
+						log.Printf("Failed to add tree watch to '%s': %s\n", childpath, err.Error())
+					}
+					active += started
+				}
+			case EventNodeDeleted:
+				active--
+				if !watched[e.Path] {
+					// Already sent for the other watch of the node
+					continue
+				}
+				delete(watched, e.Path)
+			}
+			watchChannel <- e
+		}
+	}()
+	return nil
+}
+
+func (dao *nodeDAO) State() ConnectionState {
+	return dao.conn.get()
+}
+
+func (dao *nodeDAO) WatchState(stateChannel chan<- ConnectionState) {
+	dao.conn.watch(stateChannel)
+}
+
+func (dao *nodeDAO) GetValue(path string) ([]byte, error) {
+	return dao.nodes.get(path)
+}
+
+func (dao *nodeDAO) SetValue(path string, data []byte) error {
+	exists, err := dao.nodes.exists(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return dao.nodes.set(path, data)
+	}
+	return nil
+}
+
+func (dao *nodeDAO) RemoveRecursive(path string) error {
+	exists, err := dao.nodes.exists(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		children, _ := dao.nodes.children(path)
+		for _, child := range children {
+			err := dao.RemoveRecursive(path + "/" + child)
+			if err != nil {
+				return err
+			}
+		}
+		return dao.nodes.remove(path)
+	}
+	return nil
+}
+
+// Creates an ephemeral node for the given path
+func (dao *nodeDAO) CreateEphemeral(path string, data []byte) (string, error) {
+	return dao.nodes.create(path, data, true)
+}
+
+func (dao *nodeDAO) CreateEphemeralSequential(prefix string, data []byte) (string, error) {
+	err := dao.ensureExists(path.Dir(prefix))
+	if err != nil {
+		return "", err
+	}
+	return dao.nodes.createSequential(prefix, data)
+}
+
+func (dao *nodeDAO) CreationOrder(path string) (int64, error) {
+	return dao.nodes.created(path)
+}
+
+func (dao *nodeDAO) Children(path string) ([]string, error) {
+	children, err := dao.nodes.children(path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+func (dao *nodeDAO) Close() {
+	// Closed first so that the watches that end are not set again
+	dao.conn.set(StateClosed)
+	dao.nodes.close()
+}
+
+// Converts a key to a ZK path
+func KeyToPath(key string) string {
+	path, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return ""
+	} else {
+		return string(path)
+	}
+}
+
+// Converts a ZK path to a key
+func PathToKey(path string) string {
+	return base64.StdEncoding.EncodeToString([]byte(path))
+}
+
+// #### PRIVATE METHODS ####
+
+// watchNode sets a one-shot watch on the node, which must exist
+func (dao *nodeDAO) watchNode(nodepath string) (<-chan Event, error) {
+	exists, eventChan, err := dao.nodes.existsW(nodepath)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNoNode
+	}
+	return eventChan, nil
+}
+
+// watchChildren sets a one-shot watch on the children of the node
+func (dao *nodeDAO) watchChildren(nodepath string) (<-chan Event, error) {
+	_, eventChan, err := dao.nodes.childrenW(nodepath)
+	return eventChan, err
+}
+
+// watchTreeNode sets the data and children watches of the node and of every
+// node below it, all sending to events. It returns the number of watches set,
+// nodes deleted in the meantime are skipped.
+func (dao *nodeDAO) watchTreeNode(nodepath string, events chan Event, watched map[string]bool) (int, error) {
+	dataChan, err := dao.watchNode(nodepath)
+	if err == ErrNoNode {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	children, childrenChan, err := dao.nodes.childrenW(nodepath)
+	if err != nil {
+		// The data watch ends on its own once the node is deleted
+		watched[nodepath] = true
+		go dao.forward(nodepath, events, dataChan, dao.watchNode)
+		if err == ErrNoNode {
+			return 1, nil
+		}
+		return 1, err
+	}
+	watched[nodepath] = true
+	go dao.forward(nodepath, events, dataChan, dao.watchNode)
+	go dao.forward(nodepath, events, childrenChan, dao.watchChildren)
+	active := 2
+	for _, child := range children {
+		started, err := dao.watchTreeNode(nodepath+"/"+child, events, watched)
+		active += started
+		if err != nil {
+			return active, err
+		}
+	}
+	return active, nil
+}
+
+// forward sends the events of the one-shot watches set by watch to
+// watchChannel, setting the watch again after every event until the node is
+// deleted or the store is closed. A watch that ended because the session
+// expired is set again once the store is connected, and EventNodeDeleted is
+// sent if the node was deleted in the meantime.
+func (dao *nodeDAO) forward(nodepath string, to chan<- Event, from <-chan Event, watch func(string) (<-chan Event, error)) {
+	for {
+		e := <-from
+		to <- e
+		if e.Type == EventNodeDeleted {
+			return
+		}
+		var err error
+		for {
+			if e.Type == EventNotWatching && !dao.conn.waitConnected() {
+				return
+			}
+			from, err = watch(nodepath)
+			if err == nil || err == ErrNoNode {
+				break
+			}
+			log.Printf("Failed to set the watch on '%s' again: %s\n", nodepath, err.Error())
+			// Wait for the store to be connected before trying again
+			e.Type = EventNotWatching
+			time.Sleep(WATCH_RETRY_INTERVAL)
+		}
+		if err == ErrNoNode {
+			to <- Event{Type: EventNodeDeleted, Path: nodepath}
+			return
+		}
+	}
+}
+
+// getString returns the data of the node and whether it could be read
+func (dao *nodeDAO) getString(nodepath string) (string, bool) {
+	data, err := dao.nodes.get(nodepath)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// getInt returns the data of the node parsed as an int and whether it could
+// be read
+func (dao *nodeDAO) getInt(nodepath string) (int, bool) {
+	data, ok := dao.getString(nodepath)
+	if !ok {
+		return 0, false
+	}
+	value, err := strconv.Atoi(data)
+	if err != nil {
+		log.Printf("Failed to parse int '%s':\n%s", nodepath, err)
+		return 0, false
+	}
+	return value, true
+}
+
+// updateString creates or sets the node, unless value is empty
+func (dao *nodeDAO) updateString(nodepath string, value string) error {
+	if value == "" {
+		return nil
+	}
+	err := dao.ensureExists(path.Dir(nodepath))
+	if err != nil {
+		return err
+	}
+	return dao.createOrSet(nodepath, []byte(value))
+}
+
+// updateInt creates or sets the node, unless value is 0
+func (dao *nodeDAO) updateInt(nodepath string, value int) error {
+	if value == 0 {
+		return nil
+	}
+	return dao.updateString(nodepath, strconv.Itoa(value))
+}
+
+// loadArgs reads the argument nodes, which are named by their index
+func (dao *nodeDAO) loadArgs(nodepath string) []string {
+	children, err := dao.nodes.children(nodepath)
+	if err != nil {
+		return nil
+	}
+	sort.Slice(children, func(i, j int) bool {
+		a, _ := strconv.Atoi(children[i])
+		b, _ := strconv.Atoi(children[j])
+		return a < b
+	})
+	var args []string
+	for _, child := range children {
+		arg, _ := dao.getString(nodepath + "/" + child)
+		args = append(args, arg)
+	}
+	return args
+}
+
+// updateArgs makes the argument nodes match args
+func (dao *nodeDAO) updateArgs(nodepath string, args []string) error {
+	err := dao.ensureExists(nodepath)
+	if err != nil {
+		return err
+	}
+	for i, arg := range args {
+		err := dao.createOrSet(nodepath+"/"+fmt.Sprintf("%04d", i), []byte(arg))
+		if err != nil {
+			return err
+		}
+	}
+	children, _ := dao.nodes.children(nodepath)
+	for _, child := range children {
+		index, err := strconv.Atoi(child)
+		if err != nil || index >= len(args) {
+			err := dao.RemoveRecursive(nodepath + "/" + child)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadEnv reads the environment variables, one node per variable
+func (dao *nodeDAO) loadEnv(nodepath string) map[string]string {
+	children, err := dao.nodes.children(nodepath)
+	if err != nil || len(children) == 0 {
+		return nil
+	}
+	env := make(map[string]string)
+	for _, child := range children {
+		env[child], _ = dao.getString(nodepath + "/" + child)
+	}
+	return env
+}
+
+// updateEnv makes the environment variable nodes match env
+func (dao *nodeDAO) updateEnv(nodepath string, env map[string]string) error {
+	err := dao.ensureExists(nodepath)
+	if err != nil {
+		return err
+	}
+	for name, value := range env {
+		err := dao.createOrSet(nodepath+"/"+name, []byte(value))
+		if err != nil {
+			return err
+		}
+	}
+	children, _ := dao.nodes.children(nodepath)
+	for _, child := range children {
+		if _, ok := env[child]; !ok {
+			err := dao.RemoveRecursive(nodepath + "/" + child)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateNames makes the children of the node match names
+func (dao *nodeDAO) updateNames(nodepath string, names []string) error {
+	err := dao.ensureExists(nodepath)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+		err := dao.createOrSet(nodepath+"/"+name, []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	children, _ := dao.nodes.children(nodepath)
+	for _, child := range children {
+		if !wanted[child] {
+			err := dao.RemoveRecursive(nodepath + "/" + child)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (dao *nodeDAO) loadPlacement(nodepath string) Placement {
+	var placement Placement
+	if data, ok := dao.getString(nodepath + "/scheduled"); ok {
+		placement.Scheduled = data == "true"
+	}
+	placement.AgentClass, _ = dao.getString(nodepath + "/agent_class")
+	placement.OS, _ = dao.getString(nodepath + "/os")
+	placement.Agents, _ = dao.nodes.children(nodepath + "/agents")
+	return placement
+}
+
+func (dao *nodeDAO) updatePlacement(nodepath string, placement Placement) error {
+	if placement.Scheduled {
+		err := dao.updateString(nodepath+"/scheduled", "true")
+		if err != nil {
+			return err
+		}
+	}
+	err := dao.updateString(nodepath+"/agent_class", placement.AgentClass)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/os", placement.OS)
+	if err != nil {
+		return err
+	}
+	if placement.Agents != nil {
+		err := dao.updateNames(nodepath+"/agents", placement.Agents)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRuns reads the runs of a job, which are named by their number
+func (dao *nodeDAO) loadRuns(nodepath string) []Run {
+	children, err := dao.nodes.children(nodepath)
+	if err != nil || len(children) == 0 {
+		return nil
+	}
+	sort.Strings(children)
+	var runs []Run
+	for _, child := range children {
+		runpath := nodepath + "/" + child
+		var run Run
+		run.Number, _ = strconv.Atoi(child)
+		run.Trigger, _ = dao.getString(runpath + "/trigger")
+		run.Start, _ = dao.getString(runpath + "/start")
+		run.End, _ = dao.getString(runpath + "/end")
+		run.ExitCode, _ = dao.getInt(runpath + "/exit_code")
+		run.ExitSignal, _ = dao.getString(runpath + "/exit_signal")
+		run.Duration, _ = dao.getString(runpath + "/duration")
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// updateRuns makes the run nodes match runs
+func (dao *nodeDAO) updateRuns(nodepath string, runs []Run) error {
+	err := dao.ensureExists(nodepath)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]bool)
+	for _, run := range runs {
+		name := fmt.Sprintf("%010d", run.Number)
+		wanted[name] = true
+		runpath := nodepath + "/" + name
+		err := dao.ensureExists(runpath)
+		if err != nil {
+			return err
+		}
+		err = dao.updateString(runpath+"/trigger", run.Trigger)
+		if err != nil {
+			return err
+		}
+		err = dao.updateString(runpath+"/start", run.Start)
+		if err != nil {
+			return err
+		}
+		err = dao.updateString(runpath+"/end", run.End)
+		if err != nil {
+			return err
+		}
+		err = dao.createOrSet(runpath+"/exit_code", []byte(strconv.Itoa(run.ExitCode)))
+		if err != nil {
+			return err
+		}
+		err = dao.updateString(runpath+"/exit_signal", run.ExitSignal)
+		if err != nil {
+			return err
+		}
+		err = dao.updateString(runpath+"/duration", run.Duration)
+		if err != nil {
+			return err
+		}
+	}
+	children, _ := dao.nodes.children(nodepath)
+	for _, child := range children {
+		if !wanted[child] {
+			err := dao.RemoveRecursive(nodepath + "/" + child)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (dao *nodeDAO) loadRestartPolicy(nodepath string) RestartPolicy {
+	var policy RestartPolicy
+	policy.Policy, _ = dao.getString(nodepath + "/policy")
+	policy.MaxRestarts, _ = dao.getInt(nodepath + "/max_restarts")
+	policy.Window, _ = dao.getString(nodepath + "/window")
+	policy.Backoff, _ = dao.getString(nodepath + "/backoff")
+	policy.MaxBackoff, _ = dao.getString(nodepath + "/max_backoff")
+	return policy
+}
+
+func (dao *nodeDAO) updateRestartPolicy(nodepath string, policy RestartPolicy) error {
+	err := dao.updateString(nodepath+"/policy", policy.Policy)
+	if err != nil {
+		return err
+	}
+	err = dao.updateInt(nodepath+"/max_restarts", policy.MaxRestarts)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/window", policy.Window)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/backoff", policy.Backoff)
+	if err != nil {
+		return err
+	}
+	return dao.updateString(nodepath+"/max_backoff", policy.MaxBackoff)
+}
+
+func (dao *nodeDAO) loadHealthCheck(nodepath string) HealthCheck {
+	var check HealthCheck
+	check.Type, _ = dao.getString(nodepath + "/type")
+	check.Command, _ = dao.getString(nodepath + "/command")
+	check.Address, _ = dao.getString(nodepath + "/address")
+	check.URL, _ = dao.getString(nodepath + "/url")
+	check.Status, _ = dao.getInt(nodepath + "/status")
+	check.Interval, _ = dao.getString(nodepath + "/interval")
+	check.Timeout, _ = dao.getString(nodepath + "/timeout")
+	check.InitialDelay, _ = dao.getString(nodepath + "/initial_delay")
+	check.FailureThreshold, _ = dao.getInt(nodepath + "/failure_threshold")
+	check.SuccessThreshold, _ = dao.getInt(nodepath + "/success_threshold")
+	if data, ok := dao.getString(nodepath + "/restart"); ok {
+		check.Restart = data == "true"
+	}
+	return check
+}
+
+func (dao *nodeDAO) updateHealthCheck(nodepath string, check HealthCheck) error {
+	err := dao.updateString(nodepath+"/type", check.Type)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/command", check.Command)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/address", check.Address)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/url", check.URL)
+	if err != nil {
+		return err
+	}
+	err = dao.updateInt(nodepath+"/status", check.Status)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/interval", check.Interval)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/timeout", check.Timeout)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/initial_delay", check.InitialDelay)
+	if err != nil {
+		return err
+	}
+	err = dao.updateInt(nodepath+"/failure_threshold", check.FailureThreshold)
+	if err != nil {
+		return err
+	}
+	err = dao.updateInt(nodepath+"/success_threshold", check.SuccessThreshold)
+	if err != nil {
+		return err
+	}
+	if check.Restart {
+		return dao.updateString(nodepath+"/restart", "true")
+	}
+	return nil
+}
+
+func (dao *nodeDAO) loadResources(nodepath string) Resources {
+	var resources Resources
+	resources.CPUQuota, _ = dao.getString(nodepath + "/cpu_quota")
+	resources.MemoryMax, _ = dao.getString(nodepath + "/memory_max")
+	resources.PidsMax, _ = dao.getInt(nodepath + "/pids_max")
+	resources.IOWeight, _ = dao.getInt(nodepath + "/io_weight")
+	return resources
+}
+
+func (dao *nodeDAO) updateResources(nodepath string, resources Resources) error {
+	err := dao.updateString(nodepath+"/cpu_quota", resources.CPUQuota)
+	if err != nil {
+		return err
+	}
+	err = dao.updateString(nodepath+"/memory_max", resources.MemoryMax)
+	if err != nil {
+		return err
+	}
+	err = dao.updateInt(nodepath+"/pids_max", resources.PidsMax)
+	if err != nil {
+		return err
+	}
+	return dao.updateInt(nodepath+"/io_weight", resources.IOWeight)
+}
+
+func (dao *nodeDAO) loadResourceUsage(nodepath string) ResourceUsage {
+	var usage ResourceUsage
+	usage.MemoryCurrent, _ = dao.getInt(nodepath + "/memory_current")
+	usage.CPUUsage, _ = dao.getInt(nodepath + "/cpu_usage_usec")
+	usage.PidsCurrent, _ = dao.getInt(nodepath + "/pids_current")
+	return usage
+}
+
+func (dao *nodeDAO) updateResourceUsage(nodepath string, usage ResourceUsage) error {
+	err := dao.updateInt(nodepath+"/memory_current", usage.MemoryCurrent)
+	if err != nil {
+		return err
+	}
+	err = dao.updateInt(nodepath+"/cpu_usage_usec", usage.CPUUsage)
+	if err != nil {
+		return err
+	}
+	return dao.updateInt(nodepath+"/pids_current", usage.PidsCurrent)
+}
+
+func (dao *nodeDAO) ensureExists(nodepath string) error {
+	exists, err := dao.nodes.exists(nodepath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err := dao.createWithParents(nodepath, []byte{})
+		if err == ErrNodeExists {
+			// Created by another client in the meantime
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (dao *nodeDAO) createOrSet(nodepath string, data []byte) error {
+	exists, err := dao.nodes.exists(nodepath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		oldData, _ := dao.nodes.get(nodepath)
+		if bytes.Compare(oldData, data) != 0 {
+			return dao.nodes.set(nodepath, data)
+		}
+	} else {
+		_, err := dao.nodes.create(nodepath, data, false)
+		return err
+	}
+	return nil
+}
+
+func (dao *nodeDAO) createWithParents(nodepath string, data []byte) (string, error) {
+	parent := path.Dir(nodepath)
+	if parent == "." || parent == "/" {
+		return dao.nodes.create(nodepath, data, false)
+	}
+	exists, err := dao.nodes.exists(parent)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		// The parent may have been created by another client in the meantime
+		s, err := dao.createWithParents(parent, data)
+		if err != nil && err != ErrNodeExists {
+			return s, err
+		}
+	}
+	return dao.nodes.create(nodepath, data, false)
+}
@@ -0,0 +1,31 @@
+package data
+
+import (
+	"errors"
+	"testing"
+)
+
+// failingNodes is a memory node store whose exists fails
+type failingNodes struct {
+	*memNodes
+	err error
+}
+
+func (f *failingNodes) exists(nodepath string) (bool, error) {
+	return false, f.err
+}
+
+// TestUpdateExistsError checks that an error finding whether a node exists is
+// returned rather than taken for a missing node
+func TestUpdateExistsError(t *testing.T) {
+	lost := errors.New("connection lost")
+	store := &MemoryStore{}
+	store.nodes = &failingNodes{memNodes: newMemNodes(), err: lost}
+	store.conn = newConnState(StateConnected)
+	if err := store.UpdateDomain(PathToKey("/maestro/d01"), Domain{Name: "d01"}, true); err != lost {
+		t.Errorf("UpdateDomain: got %v, want %v", err, lost)
+	}
+	if err := store.UpdateProcess(PathToKey("/maestro/d01/config/processes/p1"), Process{Command: "true", Pid: -1}, false); err != lost {
+		t.Errorf("UpdateProcess: got %v, want %v", err, lost)
+	}
+}
@@ -0,0 +1,54 @@
+package data
+
+import (
+	"errors"
+	"strings"
+)
+
+// SortByDependencies orders the processes so that each one comes after the
+// processes named in its DependsOn, keeping the original order otherwise.
+// Dependencies on processes that are not in the list are ignored. An error is
+// returned when the dependencies form a cycle.
+func SortByDependencies(processes []Process) ([]Process, error) {
+	byName := make(map[string]int)
+	for i, process := range processes {
+		byName[process.Name] = i
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(processes))
+	sorted := make([]Process, 0, len(processes))
+	var visit func(i int, chain []string) error
+	visit = func(i int, chain []string) error {
+		chain = append(chain, processes[i].Name)
+		switch state[i] {
+		case visiting:
+			return errors.New("Dependency cycle between processes: " + strings.Join(chain, " -> "))
+		case visited:
+			return nil
+		}
+		state[i] = visiting
+		for _, dependency := range processes[i].DependsOn {
+			if j, ok := byName[dependency]; ok {
+				err := visit(j, chain)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		state[i] = visited
+		sorted = append(sorted, processes[i])
+		return nil
+	}
+	for i := range processes {
+		err := visit(i, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
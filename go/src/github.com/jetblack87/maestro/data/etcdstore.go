@@ -0,0 +1,745 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The TTL of the lease that backs ephemeral nodes
+const ETCD_LEASE_TTL = 10
+
+// The sequence counters of the sequential nodes are kept outside of the tree
+// (which starts with "/"), under this prefix followed by the path of the parent
+const ETCD_SEQUENCE_PREFIX = "maestro.sequence:"
+
+// How long to wait before opening the watch stream again once it failed on
+// every endpoint
+const ETCD_WATCH_RETRY_INTERVAL = time.Second
+
+// EtcdStore is the etcd v3 implementation of Store. Every node of the maestro
+// tree is stored as an etcd key equal to its path, ephemeral nodes are
+// attached to a lease that is kept alive for as long as the store is open
+// and watches are done with the etcd watch API.
+//
+// The store talks to the JSON gateway of etcd (the /v3 HTTP endpoints) so
+// that no gRPC client is needed.
+type EtcdStore struct {
+	nodeDAO
+}
+
+// #### CONSTRUCTOR ####
+
+func NewEtcdStore(endpoints []string) (*EtcdStore, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("At least one etcd endpoint is required")
+	}
+	store := new(EtcdStore)
+	store.conn = newConnState(StateConnected)
+	nodes := &etcdNodes{
+		endpoints:   endpoints,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		watchClient: &http.Client{},
+		conn:        store.conn,
+		ephemerals:  make(map[string][]byte),
+		done:        make(chan bool)}
+	nodes.watcher = &etcdWatcher{nodes: nodes, watches: make(map[*etcdWatch]bool)}
+	store.nodes = nodes
+	// Make sure the cluster can be reached
+	_, err := nodes.exists("/")
+	return store, err
+}
+
+// #### NODE STORE ####
+
+type etcdNodes struct {
+	endpoints   []string
+	client      *http.Client
+	watchClient *http.Client
+	conn        *connState
+	watcher     *etcdWatcher
+	// The lease and the ephemeral nodes attached to it and their data, to
+	// create them again when the lease expires
+	mutex      sync.Mutex
+	lease      int64
+	ephemerals map[string][]byte
+	closed     bool
+	done       chan bool
+}
+
+// etcdInt reads the int64 fields of the gateway responses, which are
+// encoded as JSON strings
+type etcdInt int64
+
+func (i *etcdInt) UnmarshalJSON(b []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(b), "\""), 10, 64)
+	*i = etcdInt(value)
+	return err
+}
+
+type etcdKeyValue struct {
+	Key            []byte  `json:"key"`
+	Value          []byte  `json:"value"`
+	CreateRevision etcdInt `json:"create_revision"`
+	ModRevision    etcdInt `json:"mod_revision"`
+}
+
+type etcdHeader struct {
+	Revision etcdInt `json:"revision"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader     `json:"header"`
+	Kvs    []etcdKeyValue `json:"kvs"`
+	Count  etcdInt        `json:"count"`
+}
+
+func (e *etcdNodes) exists(nodepath string) (bool, error) {
+	response, err := e.rangeRequest(nodepath, "", true)
+	if err != nil {
+		return false, err
+	}
+	return response.Count > 0, nil
+}
+
+func (e *etcdNodes) get(nodepath string) ([]byte, error) {
+	response, err := e.rangeRequest(nodepath, "", false)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Kvs) == 0 {
+		return nil, ErrNoNode
+	}
+	return response.Kvs[0].Value, nil
+}
+
+func (e *etcdNodes) created(nodepath string) (int64, error) {
+	response, err := e.rangeRequest(nodepath, "", false)
+	if err != nil {
+		return 0, err
+	}
+	if len(response.Kvs) == 0 {
+		return 0, ErrNoNode
+	}
+	return int64(response.Kvs[0].CreateRevision), nil
+}
+
+func (e *etcdNodes) children(nodepath string) ([]string, error) {
+	children, _, err := e.childrenAt(nodepath)
+	return children, err
+}
+
+func (e *etcdNodes) create(nodepath string, data []byte, ephemeral bool) (string, error) {
+	if !ephemeral {
+		return nodepath, e.put(nodepath, data, 0)
+	}
+	lease, err := e.grantLease()
+	if err != nil {
+		return "", err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	// The lease may have been replaced in the meantime
+	if lease != e.lease {
+		return "", errors.New("etcd lease expired while creating: " + nodepath)
+	}
+	err = e.put(nodepath, data, lease)
+	if err != nil {
+		return "", err
+	}
+	e.ephemerals[nodepath] = data
+	return nodepath, nil
+}
+
+// createSequential increments the counter of the parent and creates the node
+// in one transaction, which is tried again when another node was created
+// under the parent in the meantime
+func (e *etcdNodes) createSequential(prefix string, data []byte) (string, error) {
+	exists, err := e.exists(path.Dir(prefix))
+	if err == nil && !exists {
+		err = ErrNoNode
+	}
+	if err != nil {
+		return "", err
+	}
+	lease, err := e.grantLease()
+	if err != nil {
+		return "", err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if lease != e.lease {
+		return "", errors.New("etcd lease expired while creating: " + prefix)
+	}
+	counter := ETCD_SEQUENCE_PREFIX + path.Dir(prefix)
+	for {
+		response, err := e.rangeRequest(counter, "", false)
+		if err != nil {
+			return "", err
+		}
+		var sequence, revision int64
+		if len(response.Kvs) > 0 {
+			sequence, _ = strconv.ParseInt(string(response.Kvs[0].Value), 10, 64)
+			revision = int64(response.Kvs[0].ModRevision)
+		}
+		sequence++
+		nodepath := sequentialName(prefix, sequence)
+		txn := map[string]interface{}{
+			"compare": []map[string]interface{}{{
+				"key":          []byte(counter),
+				"result":       "EQUAL",
+				"target":       "MOD",
+				"mod_revision": strconv.FormatInt(revision, 10)}},
+			"success": []map[string]interface{}{
+				{"request_put": map[string]interface{}{"key": []byte(counter), "value": []byte(strconv.FormatInt(sequence, 10))}},
+				{"request_put": map[string]interface{}{"key": []byte(nodepath), "value": data, "lease": strconv.FormatInt(lease, 10)}}}}
+		var result struct {
+			Succeeded bool `json:"succeeded"`
+		}
+		err = e.post("/v3/kv/txn", txn, &result)
+		if err != nil {
+			return "", err
+		}
+		if result.Succeeded {
+			return nodepath, nil
+		}
+	}
+}
+
+func (e *etcdNodes) set(nodepath string, data []byte) error {
+	// Keep the lease (if any) that the key was created with
+	put := map[string]interface{}{"key": []byte(nodepath), "value": data, "ignore_lease": true}
+	err := e.post("/v3/kv/put", put, nil)
+	if err == nil {
+		e.mutex.Lock()
+		if _, ok := e.ephemerals[nodepath]; ok {
+			e.ephemerals[nodepath] = data
+		}
+		e.mutex.Unlock()
+	}
+	return err
+}
+
+func (e *etcdNodes) remove(nodepath string) error {
+	err := e.post("/v3/kv/deleterange", map[string]interface{}{"key": []byte(nodepath)}, nil)
+	if err == nil {
+		e.mutex.Lock()
+		delete(e.ephemerals, nodepath)
+		e.mutex.Unlock()
+	}
+	return err
+}
+
+func (e *etcdNodes) existsW(nodepath string) (bool, <-chan Event, error) {
+	// The watch is added before the node is read so that the stream cannot
+	// miss a change made after the read
+	watch, err := e.watcher.add(nodepath, false)
+	if err != nil {
+		return false, nil, err
+	}
+	response, err := e.rangeRequest(nodepath, "", true)
+	if err != nil {
+		e.watcher.remove(watch)
+		return false, nil, err
+	}
+	e.watcher.arm(watch, int64(response.Header.Revision))
+	return response.Count > 0, watch.events, nil
+}
+
+func (e *etcdNodes) childrenW(nodepath string) ([]string, <-chan Event, error) {
+	exists, err := e.exists(nodepath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, ErrNoNode
+	}
+	watch, err := e.watcher.add(nodepath, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	children, revision, err := e.childrenAt(nodepath)
+	if err != nil {
+		e.watcher.remove(watch)
+		return nil, nil, err
+	}
+	e.watcher.arm(watch, revision)
+	return children, watch.events, nil
+}
+
+// close stops the watch stream and revokes the lease, which removes all of
+// the ephemeral nodes
+func (e *etcdNodes) close() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return
+	}
+	e.closed = true
+	close(e.done)
+	e.watcher.stop()
+	if e.lease != 0 {
+		err := e.post("/v3/lease/revoke", map[string]interface{}{"ID": strconv.FormatInt(e.lease, 10)}, nil)
+		if err != nil {
+			log.Printf("Failed to revoke etcd lease: %s\n", err.Error())
+		}
+		e.lease = 0
+	}
+}
+
+// #### WATCHES ####
+
+// etcdWatcher multiplexes the one-shot watches of the store over a single
+// watch stream on the whole key space, so that watching a large tree takes
+// one connection. The stream is opened by the first watch and resumed, on
+// the next endpoint if need be, after the last revision it received.
+type etcdWatcher struct {
+	nodes   *etcdNodes
+	mutex   sync.Mutex
+	watches map[*etcdWatch]bool
+	// The stream has been opened and is received up to this revision
+	running  bool
+	revision int64
+	cancel   context.CancelFunc
+}
+
+// etcdWatch is a one-shot watch on a node or on its children
+type etcdWatch struct {
+	nodepath string
+	children bool
+	// The revision the node was read at, changes up to it are ignored. -1
+	// until the node has been read, the changes received in the meantime
+	// are kept in pending.
+	after   int64
+	pending []etcdWatchEvent
+	events  chan Event
+}
+
+// etcdWatchEvent is an event of the watch stream
+type etcdWatchEvent struct {
+	Type string       `json:"type"`
+	Kv   etcdKeyValue `json:"kv"`
+}
+
+// add adds a watch, opening the stream if it is not open yet
+func (w *etcdWatcher) add(nodepath string, children bool) (*etcdWatch, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	select {
+	case <-w.nodes.done:
+		return nil, errors.New("etcd store is closed")
+	default:
+	}
+	if !w.running {
+		// The stream starts after the current revision, before which the
+		// watched node is read
+		response, err := w.nodes.rangeRequest("/", "", true)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		w.running = true
+		w.revision = int64(response.Header.Revision)
+		w.cancel = cancel
+		go w.run(ctx)
+	}
+	watch := &etcdWatch{nodepath: nodepath, children: children, after: -1, events: make(chan Event, 1)}
+	w.watches[watch] = true
+	return watch, nil
+}
+
+// arm sets the revision the watched node was read at, and fires the watch
+// if the node changed after it
+func (w *etcdWatcher) arm(watch *etcdWatch, revision int64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.watches[watch] {
+		// Ended already
+		return
+	}
+	watch.after = revision
+	pending := watch.pending
+	watch.pending = nil
+	for _, event := range pending {
+		w.dispatchLocked(watch, event)
+	}
+}
+
+func (w *etcdWatcher) remove(watch *etcdWatch) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.watches, watch)
+}
+
+// stop closes the stream and ends every watch
+func (w *etcdWatcher) stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.endLocked(nil)
+}
+
+// run receives the stream until the store is closed, opening it again on
+// the next endpoint every time it fails
+func (w *etcdWatcher) run(ctx context.Context) {
+	for attempt := 0; ; attempt++ {
+		endpoint := w.nodes.endpoints[attempt%len(w.nodes.endpoints)]
+		err := w.receive(ctx, endpoint)
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		log.Printf("etcd watch stream on '%s' failed: %s\n", endpoint, err.Error())
+		if attempt%len(w.nodes.endpoints) == len(w.nodes.endpoints)-1 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(ETCD_WATCH_RETRY_INTERVAL):
+			}
+		}
+	}
+}
+
+// receive opens the stream on the endpoint after the last revision received
+// and dispatches its events until it fails
+func (w *etcdWatcher) receive(ctx context.Context, endpoint string) error {
+	w.mutex.Lock()
+	start := w.revision + 1
+	w.mutex.Unlock()
+	watch := map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte("/"),
+			"range_end":      []byte(prefixEnd("/")),
+			"start_revision": strconv.FormatInt(start, 10)}}
+	body, err := json.Marshal(watch)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", endpointURL(endpoint)+"/v3/watch", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := w.nodes.watchClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New("etcd watch failed: " + response.Status)
+	}
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var message struct {
+			Result struct {
+				Header          etcdHeader       `json:"header"`
+				Canceled        bool             `json:"canceled"`
+				CompactRevision etcdInt          `json:"compact_revision"`
+				Events          []etcdWatchEvent `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		err := decoder.Decode(&message)
+		if err != nil {
+			return err
+		}
+		if message.Error != nil {
+			return errors.New(message.Error.Message)
+		}
+		if message.Result.CompactRevision > 0 {
+			// The changes since the last revision received are gone, so
+			// every watch has to be set again from the current revision
+			w.mutex.Lock()
+			w.revision = int64(message.Result.Header.Revision)
+			w.endLocked(errors.New("etcd revision has been compacted"))
+			w.mutex.Unlock()
+			return errors.New("etcd watch revision has been compacted")
+		}
+		if message.Result.Canceled {
+			return errors.New("etcd watch canceled")
+		}
+		w.mutex.Lock()
+		for _, event := range message.Result.Events {
+			for watch := range w.watches {
+				w.dispatchLocked(watch, event)
+			}
+			if int64(event.Kv.ModRevision) > w.revision {
+				w.revision = int64(event.Kv.ModRevision)
+			}
+		}
+		w.mutex.Unlock()
+	}
+}
+
+// dispatchLocked fires the watch if the event is about what it watches
+func (w *etcdWatcher) dispatchLocked(watch *etcdWatch, event etcdWatchEvent) {
+	key := string(event.Kv.Key)
+	var e Event
+	switch {
+	case !watch.children && key == watch.nodepath:
+		switch {
+		case event.Type == "DELETE":
+			e = Event{Type: EventNodeDeleted, Path: watch.nodepath}
+		case event.Kv.CreateRevision == event.Kv.ModRevision:
+			e = Event{Type: EventNodeCreated, Path: watch.nodepath}
+		default:
+			e = Event{Type: EventNodeDataChanged, Path: watch.nodepath}
+		}
+	case watch.children && key == watch.nodepath && event.Type == "DELETE":
+		e = Event{Type: EventNodeDeleted, Path: watch.nodepath}
+	case watch.children && key != "/" && path.Dir(key) == watch.nodepath:
+		if event.Type != "DELETE" && event.Kv.CreateRevision != event.Kv.ModRevision {
+			return
+		}
+		e = Event{Type: EventNodeChildrenChanged, Path: watch.nodepath}
+	default:
+		return
+	}
+	if watch.after < 0 {
+		watch.pending = append(watch.pending, event)
+		return
+	}
+	if int64(event.Kv.ModRevision) <= watch.after {
+		return
+	}
+	watch.events <- e
+	delete(w.watches, watch)
+}
+
+// endLocked ends every watch with EventNotWatching
+func (w *etcdWatcher) endLocked(err error) {
+	for watch := range w.watches {
+		watch.events <- Event{Type: EventNotWatching, Path: watch.nodepath, Err: err}
+		delete(w.watches, watch)
+	}
+}
+
+// #### PRIVATE METHODS ####
+
+// childrenAt returns the children of the node and the revision they were
+// read at
+func (e *etcdNodes) childrenAt(nodepath string) ([]string, int64, error) {
+	prefix := strings.TrimSuffix(nodepath, "/") + "/"
+	response, err := e.rangeRequest(prefix, prefixEnd(prefix), false)
+	if err != nil {
+		return nil, 0, err
+	}
+	seen := make(map[string]bool)
+	var children []string
+	for _, kv := range response.Kvs {
+		child := strings.SplitN(strings.TrimPrefix(string(kv.Key), prefix), "/", 2)[0]
+		if child != "" && !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+	}
+	sort.Strings(children)
+	return children, int64(response.Header.Revision), nil
+}
+
+// put creates the key, attached to the lease unless it is 0. It returns
+// ErrNodeExists if the key exists.
+func (e *etcdNodes) put(nodepath string, data []byte, lease int64) error {
+	put := map[string]interface{}{"key": []byte(nodepath), "value": data}
+	if lease != 0 {
+		put["lease"] = strconv.FormatInt(lease, 10)
+	}
+	// Only create the key if it does not exist (create_revision = 0)
+	txn := map[string]interface{}{
+		"compare": []map[string]interface{}{{
+			"key":             []byte(nodepath),
+			"result":          "EQUAL",
+			"target":          "CREATE",
+			"create_revision": "0"}},
+		"success": []map[string]interface{}{{"request_put": put}}}
+	var response struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	err := e.post("/v3/kv/txn", txn, &response)
+	if err != nil {
+		return err
+	}
+	if !response.Succeeded {
+		return ErrNodeExists
+	}
+	return nil
+}
+
+func (e *etcdNodes) rangeRequest(key, rangeEnd string, countOnly bool) (etcdRangeResponse, error) {
+	request := map[string]interface{}{"key": []byte(key)}
+	if rangeEnd != "" {
+		// Ranges are only read for the names of the keys
+		request["range_end"] = []byte(rangeEnd)
+		request["keys_only"] = true
+	}
+	if countOnly {
+		request["count_only"] = true
+	}
+	var response etcdRangeResponse
+	err := e.post("/v3/kv/range", request, &response)
+	return response, err
+}
+
+// grantLease returns the lease for ephemeral nodes, granting it (and starting
+// the keep alive) the first time it is needed
+func (e *etcdNodes) grantLease() (int64, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return 0, errors.New("etcd store is closed")
+	}
+	if e.lease != 0 {
+		return e.lease, nil
+	}
+	lease, err := e.grantLeaseLocked()
+	if err != nil {
+		return 0, err
+	}
+	go e.keepAlive()
+	return lease, nil
+}
+
+func (e *etcdNodes) grantLeaseLocked() (int64, error) {
+	var response struct {
+		ID etcdInt `json:"ID"`
+	}
+	err := e.post("/v3/lease/grant", map[string]interface{}{"TTL": strconv.Itoa(ETCD_LEASE_TTL)}, &response)
+	if err != nil {
+		return 0, err
+	}
+	e.lease = int64(response.ID)
+	return e.lease, nil
+}
+
+// keepAlive renews the lease until the store is closed. When the lease has
+// expired its nodes are gone, so the store is expired until a new lease is
+// granted and the nodes are created again.
+func (e *etcdNodes) keepAlive() {
+	ticker := time.NewTicker(ETCD_LEASE_TTL * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+		e.mutex.Lock()
+		lease := e.lease
+		e.mutex.Unlock()
+		var response struct {
+			Result struct {
+				TTL etcdInt `json:"TTL"`
+			} `json:"result"`
+		}
+		err := e.post("/v3/lease/keepalive", map[string]interface{}{"ID": strconv.FormatInt(lease, 10)}, &response)
+		switch {
+		case err != nil:
+			log.Printf("Failed to keep etcd lease alive: %s\n", err.Error())
+			// Expired is kept until there is a new lease
+			if e.conn.get() != StateExpired {
+				e.conn.set(StateDisconnected)
+			}
+		case response.Result.TTL <= 0:
+			log.Println("etcd lease has expired, ephemeral nodes have been lost")
+			e.conn.set(StateExpired)
+			err = e.renewLease()
+			if err != nil {
+				log.Printf("Failed to grant a new etcd lease: %s\n", err.Error())
+				continue
+			}
+			e.conn.set(StateConnected)
+		default:
+			e.conn.set(StateConnected)
+		}
+	}
+}
+
+// renewLease grants a new lease and creates the ephemeral nodes again with
+// it. A node that now exists belongs to someone else (a lock taken by
+// another agent) and a node whose parent is gone is no longer wanted, so
+// both are forgotten.
+func (e *etcdNodes) renewLease() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return nil
+	}
+	lease, err := e.grantLeaseLocked()
+	if err != nil {
+		return err
+	}
+	for nodepath, data := range e.ephemerals {
+		exists, err := e.exists(path.Dir(nodepath))
+		if err == nil && !exists {
+			err = ErrNoNode
+		}
+		if err == nil {
+			err = e.put(nodepath, data, lease)
+		}
+		if err == nil {
+			log.Println("Restored ephemeral node: " + nodepath)
+			continue
+		}
+		log.Printf("Failed to restore ephemeral node '%s': %s\n", nodepath, err.Error())
+		if err == ErrNodeExists || err == ErrNoNode {
+			delete(e.ephemerals, nodepath)
+		}
+	}
+	return nil
+}
+
+// post sends the request to the first endpoint that answers
+func (e *etcdNodes) post(api string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range e.endpoints {
+		var httpResponse *http.Response
+		httpResponse, err = e.client.Post(endpointURL(endpoint)+api, "application/json", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		defer httpResponse.Body.Close()
+		if httpResponse.StatusCode != http.StatusOK {
+			var message struct {
+				Message string `json:"message"`
+			}
+			json.NewDecoder(httpResponse.Body).Decode(&message)
+			return errors.New("etcd request '" + api + "' failed: " + httpResponse.Status + " " + message.Message)
+		}
+		if response == nil {
+			return nil
+		}
+		return json.NewDecoder(httpResponse.Body).Decode(response)
+	}
+	return err
+}
+
+func endpointURL(endpoint string) string {
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	return "http://" + endpoint
+}
+
+// prefixEnd returns the range end that covers every key with the prefix
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	end[len(end)-1]++
+	return string(end)
+}
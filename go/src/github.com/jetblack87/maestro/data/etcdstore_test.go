@@ -0,0 +1,58 @@
+//go:build etcd
+
+package data
+
+// Built with the etcd tag, the tests run the etcd store against an etcd
+// server embedded in the test binary, which needs the etcd server packages:
+//
+//	go get go.etcd.io/etcd/server/v3/embed
+//	go test -tags etcd github.com/jetblack87/maestro/data
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func init() {
+	embeddedEtcd = startEmbeddedEtcd
+}
+
+// startEmbeddedEtcd starts a single member cluster that lasts as long as the
+// test and returns its client endpoint
+func startEmbeddedEtcd(t *testing.T) string {
+	clientURL := url.URL{Scheme: "http", Host: freeAddress(t)}
+	peerURL := url.URL{Scheme: "http", Host: freeAddress(t)}
+	config := embed.NewConfig()
+	config.Dir = t.TempDir()
+	config.LogLevel = "error"
+	config.ListenClientUrls = []url.URL{clientURL}
+	config.AdvertiseClientUrls = []url.URL{clientURL}
+	config.ListenPeerUrls = []url.URL{peerURL}
+	config.AdvertisePeerUrls = []url.URL{peerURL}
+	config.InitialCluster = config.Name + "=" + peerURL.String()
+	server, err := embed.StartEtcd(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatal("The embedded etcd server did not start")
+	}
+	return clientURL.Host
+}
+
+// freeAddress is a local address with a port nothing listens on
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
@@ -0,0 +1,606 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long an ephemeral node survives once its owner stops heart beating
+const FILE_LEASE_TTL = 10 * time.Second
+
+// How often watches check the file for changes
+const FILE_POLL_INTERVAL = 500 * time.Millisecond
+
+// FileStore is an implementation of Store that keeps the whole tree in a
+// single JSON file, so that agent, server and zkload can run on one host
+// without any outside services. Several processes may share the file: writes
+// are serialized with a lock file next to it and the watches of a process
+// are checked by a single poller.
+//
+// Ephemeral nodes belong to a lease that is renewed by a heart beat for as
+// long as the store is open. When the heart beat stops the lease expires and
+// its nodes disappear. If the heart beat finds the lease expired, for
+// example after the process was paused, the store is expired until its
+// ephemeral nodes are created again.
+type FileStore struct {
+	nodeDAO
+}
+
+// #### CONSTRUCTOR ####
+
+func NewFileStore(filename string) (*FileStore, error) {
+	if filename == "" {
+		return nil, errors.New("A file name is required for the file store")
+	}
+	hostname, _ := os.Hostname()
+	store := new(FileStore)
+	store.conn = newConnState(StateConnected)
+	nodes := &fileNodes{
+		filename:   filename,
+		hostname:   hostname,
+		lease:      hostname + "-" + strconv.Itoa(os.Getpid()) + "-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+		conn:       store.conn,
+		ephemerals: make(map[string][]byte),
+		watches:    make(map[*fileWatch]bool),
+		done:       make(chan bool)}
+	store.nodes = nodes
+	// Make sure the file can be read and written
+	err := nodes.update(func(tree *fileTree) error { return nil })
+	return store, err
+}
+
+// #### NODE STORE ####
+
+type fileNode struct {
+	Data  []byte
+	Lease string `json:",omitempty"`
+	// The value of fileTree.Revision when the node was created
+	Created int64 `json:",omitempty"`
+}
+
+// fileTree is the content of the file
+type fileTree struct {
+	Nodes map[string]*fileNode
+	// Lease expiry times, in unix nanoseconds
+	Leases map[string]int64
+	// The last sequence number of the sequential children of a node
+	Sequences map[string]int64 `json:",omitempty"`
+	// The number of nodes created so far
+	Revision int64 `json:",omitempty"`
+}
+
+type fileNodes struct {
+	filename string
+	hostname string
+	conn     *connState
+	// Held while the file is updated
+	mutex sync.Mutex
+	lease string
+	// The ephemeral nodes created through this store and their data, to
+	// create them again when the lease expires
+	ephemerals map[string][]byte
+	heartbeat  bool
+	closed     bool
+	done       chan bool
+	// The watches checked by the poller
+	watchMutex sync.Mutex
+	watches    map[*fileWatch]bool
+	polling    bool
+}
+
+// fileWatch is a one-shot watch on a node or on its children
+type fileWatch struct {
+	nodepath string
+	children bool
+	// The node, nil if it did not exist, or the names of its children when
+	// the watch was set
+	seen     *fileNode
+	seenList string
+	events   chan Event
+}
+
+func (f *fileNodes) exists(nodepath string) (bool, error) {
+	tree, err := f.read()
+	if err != nil {
+		return false, err
+	}
+	_, exists := tree.Nodes[nodepath]
+	return exists, nil
+}
+
+func (f *fileNodes) get(nodepath string) ([]byte, error) {
+	tree, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	node, exists := tree.Nodes[nodepath]
+	if !exists {
+		return nil, ErrNoNode
+	}
+	return node.Data, nil
+}
+
+func (f *fileNodes) created(nodepath string) (int64, error) {
+	tree, err := f.read()
+	if err != nil {
+		return 0, err
+	}
+	node, exists := tree.Nodes[nodepath]
+	if !exists {
+		return 0, ErrNoNode
+	}
+	return node.Created, nil
+}
+
+func (f *fileNodes) children(nodepath string) ([]string, error) {
+	tree, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	return tree.children(nodepath)
+}
+
+func (f *fileNodes) create(nodepath string, data []byte, ephemeral bool) (string, error) {
+	if ephemeral {
+		f.startHeartbeat()
+	}
+	err := f.update(func(tree *fileTree) error {
+		if _, exists := tree.Nodes[nodepath]; exists {
+			return ErrNodeExists
+		}
+		if _, exists := tree.Nodes[path.Dir(nodepath)]; !exists {
+			return ErrNoNode
+		}
+		tree.Revision++
+		node := &fileNode{Data: data, Created: tree.Revision}
+		if ephemeral {
+			tree.Leases[f.lease] = time.Now().Add(FILE_LEASE_TTL).UnixNano()
+			node.Lease = f.lease
+		}
+		tree.Nodes[nodepath] = node
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if ephemeral {
+		f.mutex.Lock()
+		f.ephemerals[nodepath] = data
+		f.mutex.Unlock()
+	}
+	return nodepath, nil
+}
+
+func (f *fileNodes) createSequential(prefix string, data []byte) (string, error) {
+	f.startHeartbeat()
+	var nodepath string
+	err := f.update(func(tree *fileTree) error {
+		parent := path.Dir(prefix)
+		if _, exists := tree.Nodes[parent]; !exists {
+			return ErrNoNode
+		}
+		if tree.Sequences == nil {
+			tree.Sequences = make(map[string]int64)
+		}
+		tree.Sequences[parent]++
+		nodepath = sequentialName(prefix, tree.Sequences[parent])
+		tree.Leases[f.lease] = time.Now().Add(FILE_LEASE_TTL).UnixNano()
+		tree.Revision++
+		tree.Nodes[nodepath] = &fileNode{Data: data, Lease: f.lease, Created: tree.Revision}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return nodepath, nil
+}
+
+func (f *fileNodes) set(nodepath string, data []byte) error {
+	return f.update(func(tree *fileTree) error {
+		node, exists := tree.Nodes[nodepath]
+		if !exists {
+			return ErrNoNode
+		}
+		node.Data = data
+		if _, ok := f.ephemerals[nodepath]; ok {
+			f.ephemerals[nodepath] = data
+		}
+		return nil
+	})
+}
+
+func (f *fileNodes) remove(nodepath string) error {
+	return f.update(func(tree *fileTree) error {
+		if _, exists := tree.Nodes[nodepath]; !exists {
+			return ErrNoNode
+		}
+		for childpath := range tree.Nodes {
+			if childpath != "/" && path.Dir(childpath) == nodepath {
+				return errors.New("node has children: " + nodepath)
+			}
+		}
+		delete(tree.Nodes, nodepath)
+		delete(f.ephemerals, nodepath)
+		return nil
+	})
+}
+
+func (f *fileNodes) existsW(nodepath string) (bool, <-chan Event, error) {
+	tree, err := f.read()
+	if err != nil {
+		return false, nil, err
+	}
+	node, exists := tree.Nodes[nodepath]
+	watch := &fileWatch{nodepath: nodepath, seen: node, events: make(chan Event, 1)}
+	f.addWatch(watch)
+	return exists, watch.events, nil
+}
+
+func (f *fileNodes) childrenW(nodepath string) ([]string, <-chan Event, error) {
+	children, err := f.children(nodepath)
+	if err != nil {
+		return nil, nil, err
+	}
+	watch := &fileWatch{nodepath: nodepath, children: true, seenList: strings.Join(children, "/"), events: make(chan Event, 1)}
+	f.addWatch(watch)
+	return children, watch.events, nil
+}
+
+// close stops the heart beat and the watches, and drops the lease along with
+// its nodes
+func (f *fileNodes) close() {
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return
+	}
+	f.closed = true
+	heartbeat := f.heartbeat
+	f.mutex.Unlock()
+	close(f.done)
+	if heartbeat {
+		err := f.update(func(tree *fileTree) error {
+			delete(tree.Leases, f.lease)
+			for nodepath, node := range tree.Nodes {
+				if node.Lease == f.lease {
+					delete(tree.Nodes, nodepath)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to release lease '%s': %s\n", f.lease, err.Error())
+		}
+	}
+}
+
+// #### PRIVATE METHODS ####
+
+// addWatch adds the watch to the poller, starting it if need be
+func (f *fileNodes) addWatch(watch *fileWatch) {
+	f.watchMutex.Lock()
+	defer f.watchMutex.Unlock()
+	select {
+	case <-f.done:
+		watch.events <- Event{Type: EventNotWatching, Path: watch.nodepath}
+		return
+	default:
+	}
+	f.watches[watch] = true
+	if !f.polling {
+		f.polling = true
+		go f.poll()
+	}
+}
+
+// poll reads the file for all of the watches of the store, and fires the
+// watches whose node or children differ from what they saw when they were
+// set, until the store is closed
+func (f *fileNodes) poll() {
+	ticker := time.NewTicker(FILE_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			f.watchMutex.Lock()
+			f.endWatchesLocked(nil)
+			f.watchMutex.Unlock()
+			return
+		case <-ticker.C:
+		}
+		f.watchMutex.Lock()
+		if len(f.watches) == 0 {
+			f.watchMutex.Unlock()
+			continue
+		}
+		tree, err := f.read()
+		if err != nil {
+			f.endWatchesLocked(err)
+			f.watchMutex.Unlock()
+			continue
+		}
+		for watch := range f.watches {
+			if e, fired := watch.check(tree); fired {
+				watch.events <- e
+				delete(f.watches, watch)
+			}
+		}
+		f.watchMutex.Unlock()
+	}
+}
+
+// check returns the event of the watch if the tree differs from what the
+// watch saw
+func (w *fileWatch) check(tree *fileTree) (Event, bool) {
+	if w.children {
+		children, err := tree.children(w.nodepath)
+		switch {
+		case err == ErrNoNode:
+			return Event{Type: EventNodeDeleted, Path: w.nodepath}, true
+		case strings.Join(children, "/") != w.seenList:
+			return Event{Type: EventNodeChildrenChanged, Path: w.nodepath}, true
+		}
+		return Event{}, false
+	}
+	node, exists := tree.Nodes[w.nodepath]
+	switch {
+	case w.seen == nil && exists:
+		return Event{Type: EventNodeCreated, Path: w.nodepath}, true
+	case w.seen != nil && !exists:
+		return Event{Type: EventNodeDeleted, Path: w.nodepath}, true
+	case w.seen != nil && !bytes.Equal(w.seen.Data, node.Data):
+		return Event{Type: EventNodeDataChanged, Path: w.nodepath}, true
+	}
+	return Event{}, false
+}
+
+// endWatchesLocked ends every watch with EventNotWatching
+func (f *fileNodes) endWatchesLocked(err error) {
+	for watch := range f.watches {
+		watch.events <- Event{Type: EventNotWatching, Path: watch.nodepath, Err: err}
+		delete(f.watches, watch)
+	}
+}
+
+func (f *fileNodes) startHeartbeat() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.heartbeat {
+		return
+	}
+	f.heartbeat = true
+	go func() {
+		ticker := time.NewTicker(FILE_LEASE_TTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-f.done:
+				return
+			case <-ticker.C:
+				f.renewLease()
+			}
+		}
+	}()
+}
+
+// renewLease extends the lease. When it has expired its nodes are gone, so
+// the store is expired until they are created again.
+func (f *fileNodes) renewLease() {
+	err := f.update(func(tree *fileTree) error {
+		if _, exists := tree.Leases[f.lease]; !exists {
+			log.Println("File store lease has expired, ephemeral nodes have been lost")
+			f.conn.set(StateExpired)
+			f.restoreEphemerals(tree)
+		}
+		tree.Leases[f.lease] = time.Now().Add(FILE_LEASE_TTL).UnixNano()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to renew lease '%s': %s\n", f.lease, err.Error())
+		// Expired is kept until the nodes are created again
+		if f.conn.get() != StateExpired {
+			f.conn.set(StateDisconnected)
+		}
+		return
+	}
+	f.conn.set(StateConnected)
+}
+
+// restoreEphemerals adds the ephemeral nodes that were lost with the lease
+// to the tree. A node that now exists belongs to someone else (a lock taken
+// by another agent) and a node whose parent is gone is no longer wanted, so
+// both are forgotten.
+func (f *fileNodes) restoreEphemerals(tree *fileTree) {
+	for nodepath, data := range f.ephemerals {
+		_, exists := tree.Nodes[nodepath]
+		_, parentExists := tree.Nodes[path.Dir(nodepath)]
+		if exists || !parentExists {
+			log.Println("Not restoring ephemeral node: " + nodepath)
+			delete(f.ephemerals, nodepath)
+			continue
+		}
+		tree.Revision++
+		tree.Nodes[nodepath] = &fileNode{Data: data, Lease: f.lease, Created: tree.Revision}
+		log.Println("Restored ephemeral node: " + nodepath)
+	}
+}
+
+// read loads the tree, leaving out any nodes whose lease has expired
+func (f *fileNodes) read() (*fileTree, error) {
+	tree := &fileTree{Nodes: make(map[string]*fileNode), Leases: make(map[string]int64)}
+	jsonData, err := ioutil.ReadFile(f.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(jsonData) > 0 {
+		err = json.Unmarshal(jsonData, tree)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tree.Nodes == nil {
+		tree.Nodes = make(map[string]*fileNode)
+	}
+	if tree.Leases == nil {
+		tree.Leases = make(map[string]int64)
+	}
+	tree.Nodes["/"] = &fileNode{}
+	now := time.Now().UnixNano()
+	for lease, expires := range tree.Leases {
+		if expires < now {
+			delete(tree.Leases, lease)
+		}
+	}
+	for nodepath, node := range tree.Nodes {
+		if _, alive := tree.Leases[node.Lease]; node.Lease != "" && !alive {
+			delete(tree.Nodes, nodepath)
+		}
+	}
+	return tree, nil
+}
+
+// children returns the names of the children of the node
+func (tree *fileTree) children(nodepath string) ([]string, error) {
+	if _, exists := tree.Nodes[nodepath]; !exists {
+		return nil, ErrNoNode
+	}
+	var children []string
+	for childpath := range tree.Nodes {
+		if childpath != "/" && path.Dir(childpath) == nodepath {
+			children = append(children, path.Base(childpath))
+		}
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+// update runs change against the tree while holding the file lock and
+// writes the result back unless change returns an error
+func (f *fileNodes) update(change func(tree *fileTree) error) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.filename + ".lock")
+
+	tree, err := f.read()
+	if err != nil {
+		return err
+	}
+	err = change(tree)
+	if err != nil {
+		return err
+	}
+	jsonData, err := json.MarshalIndent(tree, "", " ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it so readers never see a partial file
+	tempname := f.filename + ".tmp" + strconv.Itoa(os.Getpid())
+	err = ioutil.WriteFile(tempname, jsonData, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempname, f.filename)
+}
+
+// lock creates the lock file, waiting for its holder to release it. The
+// lock file holds the host and pid of its holder: the lock file of a process
+// of this host that is no longer running is left over from a crash and is
+// removed, the holders on other hosts cannot be checked so their lock files
+// are waited for.
+func (f *fileNodes) lock() error {
+	lockname := f.filename + ".lock"
+	holder := lockHolder{Host: f.hostname, Pid: os.Getpid(), Nonce: time.Now().UnixNano()}
+	content, err := json.Marshal(holder)
+	if err != nil {
+		return err
+	}
+	warned := false
+	for {
+		lockfile, err := os.OpenFile(lockname, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = lockfile.Write(content)
+			if closeErr := lockfile.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockname)
+			}
+			return err
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		current, err := readLockHolder(lockname)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			// Its holder writes it right after creating it, so it died in
+			// between if it is still empty after a while
+			info, statErr := os.Stat(lockname)
+			if statErr == nil && time.Since(info.ModTime()) > FILE_LEASE_TTL {
+				f.removeDeadLock(lockname, lockHolder{})
+			}
+		case current.Host != f.hostname:
+			if !warned {
+				log.Printf("Waiting for lock file '%s' held by process %d of host '%s'\n", lockname, current.Pid, current.Host)
+				warned = true
+			}
+		case !processAlive(current.Pid):
+			f.removeDeadLock(lockname, current)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// lockHolder is the content of the lock file
+type lockHolder struct {
+	Host string
+	Pid  int
+	// Tells apart the lock files of a process
+	Nonce int64
+}
+
+func readLockHolder(lockname string) (lockHolder, error) {
+	var holder lockHolder
+	content, err := ioutil.ReadFile(lockname)
+	if err != nil {
+		return holder, err
+	}
+	err = json.Unmarshal(content, &holder)
+	return holder, err
+}
+
+// removeDeadLock removes the lock file of a holder that is gone, or that is
+// empty when dead is empty. The file is moved aside first so that the lock
+// file of a live holder, created since it was read, is never removed: it is
+// moved back instead.
+func (f *fileNodes) removeDeadLock(lockname string, dead lockHolder) {
+	stalename := lockname + ".stale" + strconv.Itoa(os.Getpid())
+	if os.Rename(lockname, stalename) != nil {
+		return
+	}
+	moved, _ := readLockHolder(stalename)
+	if moved != dead {
+		if os.Link(stalename, lockname) != nil {
+			log.Println("Failed to restore lock file: " + lockname)
+		}
+		os.Remove(stalename)
+		return
+	}
+	log.Println("Removed lock file left over by a process that is gone: " + lockname)
+	os.Remove(stalename)
+}
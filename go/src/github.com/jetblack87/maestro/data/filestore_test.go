@@ -0,0 +1,74 @@
+package data
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestFileLock checks that the lock file of a process that is gone is
+// removed, and that the lock files of live or remote holders are waited for
+func TestFileLock(t *testing.T) {
+	hostname, _ := os.Hostname()
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skip("Cannot run a process to find the pid of a dead one: ", err)
+	}
+	tests := []struct {
+		name   string
+		holder lockHolder
+		// Whether the lock is taken while the file of the holder is there
+		taken bool
+	}{
+		{"dead", lockHolder{Host: hostname, Pid: exited.Process.Pid, Nonce: 1}, true},
+		{"alive", lockHolder{Host: hostname, Pid: os.Getpid(), Nonce: 1}, false},
+		{"remote", lockHolder{Host: hostname + ".other", Pid: exited.Process.Pid, Nonce: 1}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "maestro.db")
+			store, err := NewFileStore(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			content, _ := json.Marshal(test.holder)
+			if err := ioutil.WriteFile(filename+".lock", content, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- store.SetValue("/", []byte("x"))
+			}()
+			select {
+			case err := <-done:
+				if !test.taken {
+					t.Fatalf("Took the lock of a %s holder", test.name)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			case <-time.After(2 * FILE_POLL_INTERVAL):
+				if test.taken {
+					t.Fatalf("Did not take the lock of a %s holder", test.name)
+				}
+			}
+			// Taken once the holder releases it
+			os.Remove(filename + ".lock")
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(TEST_WATCH_TIMEOUT):
+				t.Fatal("Did not take the released lock")
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+package data
+
+// InstanceCount is the number of instances each agent the process is assigned
+// to runs, as given by Instances
+func InstanceCount(process Process) int {
+	if process.Instances < 1 {
+		return 1
+	}
+	return process.Instances
+}
@@ -0,0 +1,260 @@
+package data
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How long a member waits before trying again when its node cannot be
+// created or watched
+const ELECTION_RETRY_INTERVAL = 5 * time.Second
+
+// The name of the node of a member, followed by its sequence number
+const LOCK_NODE_PREFIX = "lock-"
+
+// Election campaigns for a lock with the ZooKeeper lock recipe. Every member
+// creates an ephemeral sequential node under its own node below path, named
+// after the member, and the member whose node was created first holds the
+// lock. Every other member watches the node created just before its own, so
+// that only one member wakes up when a node is deleted, which happens when its
+// member resigns or its session ends. As the nodes of a member are under its
+// own node, the store may let each member remove only its own nodes.
+type Election struct {
+	store  Store
+	path   string
+	owner  string
+	resign chan bool
+	// The node of the member, empty until it is created
+	node string
+}
+
+// Elect starts campaigning for the lock at path on behalf of owner, which
+// names the node of the member and is written to its contenders to show who
+// holds the lock. true is sent on leaderChan
+// every time the lock is acquired and false every time it is lost, leaderChan
+// is closed once the election has been resigned.
+func Elect(store Store, path string, owner string, leaderChan chan<- bool) *Election {
+	e := &Election{store: store, path: path, owner: owner, resign: make(chan bool)}
+	go e.campaign(leaderChan)
+	return e
+}
+
+// Resign stops campaigning and releases the lock if it is held
+func (e *Election) Resign() {
+	close(e.resign)
+}
+
+func (e *Election) campaign(leaderChan chan<- bool) {
+	defer close(leaderChan)
+	leader := false
+	for {
+		if e.node == "" {
+			node, err := e.store.CreateEphemeralSequential(e.path+"/"+e.owner+"/"+LOCK_NODE_PREFIX, []byte(e.owner))
+			if err != nil {
+				log.Printf("Failed to campaign for lock '%s': %s\n", e.path, err.Error())
+				if !e.sleep(ELECTION_RETRY_INTERVAL) {
+					return
+				}
+				continue
+			}
+			e.node = node
+		}
+
+		watched, err := e.predecessor()
+		if err == ErrNoNode {
+			// Lost with the session, the member is last in line again
+			e.node = ""
+			if leader {
+				log.Printf("Lost lock '%s'\n", e.path)
+				leader = false
+				if !e.send(leaderChan, false) {
+					return
+				}
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to read the members of lock '%s': %s\n", e.path, err.Error())
+			if !e.sleep(ELECTION_RETRY_INTERVAL) {
+				e.release()
+				return
+			}
+			continue
+		}
+		if watched == "" {
+			// The lock is held until the node of the member is deleted
+			watched = e.node
+			if !leader {
+				log.Printf("Acquired lock '%s' as '%s'\n", e.path, e.owner)
+				leader = true
+				if !e.send(leaderChan, true) {
+					e.release()
+					return
+				}
+			}
+		} else {
+			log.Printf("Waiting for lock '%s' after '%s'\n", e.path, watched)
+		}
+
+		events := make(chan Event, 1)
+		err = e.store.Watch(watched, events)
+		if err != nil {
+			if _, err2 := e.store.GetValue(watched); err2 == ErrNoNode {
+				// Deleted before it could be watched
+				continue
+			}
+			log.Printf("Failed to watch lock '%s': %s\n", watched, err.Error())
+			if !e.sleep(ELECTION_RETRY_INTERVAL) {
+				e.release()
+				return
+			}
+			continue
+		}
+		if !e.waitDeleted(events, &leader, leaderChan) {
+			return
+		}
+	}
+}
+
+// waitDeleted waits for the watched node to be deleted, or for the store to
+// be connected again after the session expired. It returns false once the
+// election has been resigned.
+func (e *Election) waitDeleted(events chan Event, leader *bool, leaderChan chan<- bool) bool {
+	expired := false
+	for {
+		select {
+		case event := <-events:
+			if event.Type == EventNodeDeleted {
+				return true
+			}
+			if event.Type == EventNotWatching {
+				expired = true
+				if *leader {
+					// Another member may take the lock while the node is gone
+					log.Printf("Lost lock '%s'\n", e.path)
+					*leader = false
+					if !e.send(leaderChan, false) {
+						abandon(events)
+						e.release()
+						return false
+					}
+				}
+			}
+		case <-time.After(ELECTION_RETRY_INTERVAL):
+		case <-e.resign:
+			abandon(events)
+			e.release()
+			return false
+		}
+		if expired && e.store.State() == StateConnected {
+			abandon(events)
+			return true
+		}
+	}
+}
+
+// predecessor returns the node of the member just before this one, which is
+// empty when this member holds the lock. It returns ErrNoNode when the node
+// of this member is gone.
+func (e *Election) predecessor() (string, error) {
+	nodes, err := contenders(e.store, e.path)
+	if err != nil {
+		return "", err
+	}
+	previous := ""
+	for _, node := range nodes {
+		if node == e.node {
+			return previous, nil
+		}
+		previous = node
+	}
+	return "", ErrNoNode
+}
+
+// send sends the change of leadership, unless the election is resigned
+func (e *Election) send(leaderChan chan<- bool, leader bool) bool {
+	select {
+	case leaderChan <- leader:
+		return true
+	case <-e.resign:
+		return false
+	}
+}
+
+// sleep waits for the duration, it returns false if the election is resigned
+// in the meantime
+func (e *Election) sleep(duration time.Duration) bool {
+	select {
+	case <-time.After(duration):
+		return true
+	case <-e.resign:
+		return false
+	}
+}
+
+// release deletes the node of the member, sequence numbers are not reused so
+// the node cannot belong to another member
+func (e *Election) release() {
+	if e.node == "" {
+		return
+	}
+	err := e.store.RemoveRecursive(e.node)
+	if err != nil {
+		log.Printf("Failed to release lock '%s': %s\n", e.path, err.Error())
+	}
+	e.node = ""
+}
+
+// abandon reads the events of a watch that is no longer waited on until it
+// ends, so that the store is never blocked sending them
+func abandon(events chan Event) {
+	go func() {
+		for event := range events {
+			if event.Type == EventNodeDeleted {
+				return
+			}
+		}
+	}()
+}
+
+// contenders returns the nodes of the members of the election at path, in the
+// order they were created, the other nodes are left out
+func contenders(store Store, path string) ([]string, error) {
+	members, err := store.Children(path)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []string
+	created := make(map[string]int64)
+	for _, member := range members {
+		children, err := store.Children(path + "/" + member)
+		if err == ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			if _, ok := sequenceOf(child); !ok || !strings.Contains(child, LOCK_NODE_PREFIX) {
+				continue
+			}
+			node := path + "/" + member + "/" + child
+			order, err := store.CreationOrder(node)
+			if err == ErrNoNode {
+				// Deleted in the meantime
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			created[node] = order
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return created[nodes[i]] < created[nodes[j]]
+	})
+	return nodes, nil
+}
@@ -0,0 +1,215 @@
+package data
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"sync"
+)
+
+var ErrNoNode = errors.New("node does not exist")
+var ErrNodeExists = errors.New("node already exists")
+
+// MemoryStore is an in-process implementation of Store. Nothing is persisted,
+// so it is mainly useful for exercising agent and server logic without a
+// running ZooKeeper.
+type MemoryStore struct {
+	nodeDAO
+}
+
+// #### CONSTRUCTOR ####
+
+func NewMemoryStore() *MemoryStore {
+	store := new(MemoryStore)
+	store.nodes = newMemNodes()
+	store.conn = newConnState(StateConnected)
+	return store
+}
+
+// #### NODE STORE ####
+
+type memNode struct {
+	data      []byte
+	ephemeral bool
+	// The number of nodes created before this one
+	created int64
+}
+
+// memNodes keeps every node in a map keyed by its full path
+type memNodes struct {
+	mutex   sync.Mutex
+	nodes   map[string]*memNode
+	watches map[string][]chan Event
+	// The watches on the children of a node
+	childWatches map[string][]chan Event
+	// The last sequence number of the sequential children of a node
+	sequences map[string]int64
+	// The number of nodes created so far
+	revision int64
+}
+
+func newMemNodes() *memNodes {
+	return &memNodes{
+		nodes:        map[string]*memNode{"/": &memNode{}},
+		watches:      make(map[string][]chan Event),
+		childWatches: make(map[string][]chan Event),
+		sequences:    make(map[string]int64)}
+}
+
+func (m *memNodes) exists(nodepath string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, exists := m.nodes[nodepath]
+	return exists, nil
+}
+
+func (m *memNodes) get(nodepath string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[nodepath]
+	if !exists {
+		return nil, ErrNoNode
+	}
+	return append([]byte{}, node.data...), nil
+}
+
+func (m *memNodes) children(nodepath string) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.nodes[nodepath]; !exists {
+		return nil, ErrNoNode
+	}
+	return m.childrenLocked(nodepath), nil
+}
+
+func (m *memNodes) create(nodepath string, data []byte, ephemeral bool) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.nodes[nodepath]; exists {
+		return "", ErrNodeExists
+	}
+	if _, exists := m.nodes[path.Dir(nodepath)]; !exists {
+		return "", ErrNoNode
+	}
+	m.revision++
+	m.nodes[nodepath] = &memNode{data: append([]byte{}, data...), ephemeral: ephemeral, created: m.revision}
+	m.fireLocked(nodepath, EventNodeCreated)
+	m.fireChildrenLocked(path.Dir(nodepath), EventNodeChildrenChanged)
+	return nodepath, nil
+}
+
+func (m *memNodes) createSequential(prefix string, data []byte) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	parent := path.Dir(prefix)
+	if _, exists := m.nodes[parent]; !exists {
+		return "", ErrNoNode
+	}
+	m.sequences[parent]++
+	nodepath := sequentialName(prefix, m.sequences[parent])
+	m.revision++
+	m.nodes[nodepath] = &memNode{data: append([]byte{}, data...), ephemeral: true, created: m.revision}
+	m.fireLocked(nodepath, EventNodeCreated)
+	m.fireChildrenLocked(parent, EventNodeChildrenChanged)
+	return nodepath, nil
+}
+
+func (m *memNodes) created(nodepath string) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[nodepath]
+	if !exists {
+		return 0, ErrNoNode
+	}
+	return node.created, nil
+}
+
+func (m *memNodes) set(nodepath string, data []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[nodepath]
+	if !exists {
+		return ErrNoNode
+	}
+	node.data = append([]byte{}, data...)
+	m.fireLocked(nodepath, EventNodeDataChanged)
+	return nil
+}
+
+func (m *memNodes) remove(nodepath string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.nodes[nodepath]; !exists {
+		return ErrNoNode
+	}
+	if len(m.childrenLocked(nodepath)) > 0 {
+		return errors.New("node has children: " + nodepath)
+	}
+	m.removeLocked(nodepath)
+	return nil
+}
+
+func (m *memNodes) existsW(nodepath string) (bool, <-chan Event, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, exists := m.nodes[nodepath]
+	events := make(chan Event, 1)
+	m.watches[nodepath] = append(m.watches[nodepath], events)
+	return exists, events, nil
+}
+
+func (m *memNodes) childrenW(nodepath string) ([]string, <-chan Event, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.nodes[nodepath]; !exists {
+		return nil, nil, ErrNoNode
+	}
+	events := make(chan Event, 1)
+	m.childWatches[nodepath] = append(m.childWatches[nodepath], events)
+	return m.childrenLocked(nodepath), events, nil
+}
+
+// close drops all ephemeral nodes, the same as a ZooKeeper session ending
+func (m *memNodes) close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for nodepath, node := range m.nodes {
+		if node.ephemeral {
+			m.removeLocked(nodepath)
+		}
+	}
+}
+
+func (m *memNodes) childrenLocked(nodepath string) []string {
+	var children []string
+	for childpath := range m.nodes {
+		if childpath != "/" && path.Dir(childpath) == nodepath {
+			children = append(children, path.Base(childpath))
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+func (m *memNodes) removeLocked(nodepath string) {
+	delete(m.nodes, nodepath)
+	m.fireLocked(nodepath, EventNodeDeleted)
+	m.fireChildrenLocked(nodepath, EventNodeDeleted)
+	m.fireChildrenLocked(path.Dir(nodepath), EventNodeChildrenChanged)
+}
+
+// fireChildrenLocked triggers the one-shot watches on the children of nodepath
+func (m *memNodes) fireChildrenLocked(nodepath string, eventType EventType) {
+	for _, events := range m.childWatches[nodepath] {
+		events <- Event{Type: eventType, Path: nodepath}
+	}
+	delete(m.childWatches, nodepath)
+}
+
+// fireLocked triggers the one-shot watches on nodepath
+func (m *memNodes) fireLocked(nodepath string, eventType EventType) {
+	for _, events := range m.watches[nodepath] {
+		events <- Event{Type: eventType, Path: nodepath}
+	}
+	delete(m.watches, nodepath)
+}
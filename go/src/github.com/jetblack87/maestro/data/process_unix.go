@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package data
+
+import (
+	"syscall"
+)
+
+// processAlive tells whether the process of this host is running
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
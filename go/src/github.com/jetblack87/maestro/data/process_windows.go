@@ -0,0 +1,15 @@
+package data
+
+import (
+	"os"
+)
+
+// processAlive tells whether the process of this host is running
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
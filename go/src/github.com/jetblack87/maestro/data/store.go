@@ -0,0 +1,187 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Store is the interface to the maestro configuration tree. ZkDAO is the
+// ZooKeeper implementation and MemoryStore is an in-process implementation
+// that can be used when no ZooKeeper is available (for example in tests).
+type Store interface {
+	// LoadDomain, LoadAgent and LoadProcess return ErrNoNode when the node
+	// does not exist. Nodes deleted while their parent is loaded are left out.
+	LoadDomains(key string, recursive bool) ([]Domain, error)
+	LoadDomain(key string, recursive bool) (Domain, error)
+	LoadStaticConfig(key string, recursive bool) (StaticConfig, error)
+	LoadRuntimeConfig(key string, recursive bool) (RuntimeConfig, error)
+	LoadAgent(key string, recursive bool) (Agent, error)
+	LoadProcess(key string, recursive bool) (Process, error)
+
+	UpdateDomain(key string, domain Domain, recursive bool) error
+	UpdateStaticConfig(key string, config StaticConfig, recursive bool) error
+	UpdateRuntimeConfig(key string, runtime RuntimeConfig, recursive bool) error
+	UpdateAgent(key string, agent Agent, recursive bool) error
+	UpdateProcess(key string, process Process, recursive bool) error
+
+	// Watch sends an event to watchChannel every time the node at path is
+	// created, deleted or has its data changed. When the session expires
+	// EventNotWatching is sent and the watch is set again once the store is
+	// connected, changes made in the meantime are not sent.
+	Watch(path string, watchChannel chan<- Event) error
+	// WatchChildren sends an event to watchChannel every time a child of the
+	// node at path is created or deleted, until the node itself is deleted.
+	// It survives the expiry of the session like Watch.
+	WatchChildren(path string, watchChannel chan<- Event) error
+	// WatchTree sends an event to watchChannel every time a node of the
+	// subtree at path is created, deleted or has its data changed, until the
+	// node itself is deleted. It survives the expiry of the session like Watch.
+	WatchTree(path string, watchChannel chan<- Event) error
+	// State returns the state of the connection to the backend
+	State() ConnectionState
+	// WatchState sends every change of the state of the connection to
+	// stateChannel, until the store is closed. Changes are dropped while
+	// stateChannel is full.
+	WatchState(stateChannel chan<- ConnectionState)
+	GetValue(path string) ([]byte, error)
+	SetValue(path string, data []byte) error
+	RemoveRecursive(path string) error
+	// CreateEphemeral creates a node that is removed when the store is closed
+	// or the connection behind it is lost.
+	CreateEphemeral(path string, data []byte) (string, error)
+	// CreateEphemeralSequential creates an ephemeral node named prefix
+	// followed by a ten digit sequence number, higher than that of every node
+	// created before under the same parent, creating the missing parents. It
+	// returns the path of the node. Unlike the nodes of CreateEphemeral, the
+	// node is not created again when the session expires.
+	CreateEphemeralSequential(prefix string, data []byte) (string, error)
+	// Children returns the names of the children of the node at path, sorted
+	Children(path string) ([]string, error)
+	// CreationOrder orders the node at path among all of the nodes of the
+	// store by when they were created, a node created after another has a
+	// greater number
+	CreationOrder(path string) (int64, error)
+	Close()
+}
+
+// OpenStore connects to the store described by storeURL, which is one of
+//
+//	zk://[user[:password]@]host:port[,host:port...][?admins=id,...&agents=id,...]
+//	etcd://host:port[,host:port...]
+//	file:///path/to/maestro.db
+func OpenStore(storeURL string) (Store, error) {
+	parts := strings.SplitN(storeURL, "://", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("Malformed store URL: " + storeURL)
+	}
+	switch parts[0] {
+	case "zk":
+		servers, auth, err := parseZkAddress(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		store, err := NewZkDAOWithAuth(servers, auth)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "etcd":
+		store, err := NewEtcdStore(strings.Split(parts[1], ","))
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "file":
+		store, err := NewFileStore(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, errors.New("Unsupported store: " + storeURL)
+}
+
+// The number of digits of the sequence number of a sequential node
+const SEQUENCE_DIGITS = 10
+
+// sequentialName is the path of the sequential node with the prefix and the
+// sequence number
+func sequentialName(prefix string, sequence int64) string {
+	return fmt.Sprintf("%s%0*d", prefix, SEQUENCE_DIGITS, sequence)
+}
+
+// sequenceOf returns the sequence number that ends the name of a sequential
+// node, and false when the name does not end with one
+func sequenceOf(name string) (string, bool) {
+	if len(name) < SEQUENCE_DIGITS {
+		return "", false
+	}
+	sequence := name[len(name)-SEQUENCE_DIGITS:]
+	for _, c := range sequence {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return sequence, true
+}
+
+type EventType int
+
+const (
+	EventNodeCreated EventType = iota + 1
+	EventNodeDeleted
+	EventNodeDataChanged
+	EventNodeChildrenChanged
+	EventNotWatching
+)
+
+var eventNames = map[EventType]string{
+	EventNodeCreated:         "EventNodeCreated",
+	EventNodeDeleted:         "EventNodeDeleted",
+	EventNodeDataChanged:     "EventNodeDataChanged",
+	EventNodeChildrenChanged: "EventNodeChildrenChanged",
+	EventNotWatching:         "EventNotWatching",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventNames[t]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// Event is a change to a watched node
+type Event struct {
+	Type EventType
+	Path string
+	Err  error
+}
+
+// ConnectionState is the state of the connection of a store to its backend
+type ConnectionState int
+
+const (
+	// The store is trying to connect, its watches and ephemeral nodes are
+	// kept if it connects within the session timeout
+	StateDisconnected ConnectionState = iota + 1
+	StateConnected
+	// The session ended, its ephemeral nodes were deleted and its watches
+	// ended. The store creates them again once connected.
+	StateExpired
+	StateClosed
+)
+
+var stateNames = map[ConnectionState]string{
+	StateDisconnected: "StateDisconnected",
+	StateConnected:    "StateConnected",
+	StateExpired:      "StateExpired",
+	StateClosed:       "StateClosed",
+}
+
+func (s ConnectionState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return "Unknown"
+}
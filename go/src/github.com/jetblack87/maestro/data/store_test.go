@@ -0,0 +1,631 @@
+package data
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// How long to wait for a watch to fire, the file store polls its file
+const TEST_WATCH_TIMEOUT = 5 * time.Second
+
+// The backends the contract is checked against. etcd and ZooKeeper are only
+// tested when a server is available: set MAESTRO_TEST_ETCD or MAESTRO_TEST_ZK
+// to its comma separated endpoints.
+var backends = []struct {
+	name string
+	// open returns a function that opens a new session on the backend, all
+	// of its sessions share one tree
+	open func(t *testing.T) func() Store
+	// expire ends the session of the store as if it had timed out, nil
+	// when the backend cannot do it
+	expire func(t *testing.T, store Store)
+}{
+	{"memory", openMemoryBackend, nil},
+	{"file", openFileBackend, expireFile},
+	{"etcd", openEtcdBackend, expireEtcd},
+	{"zk", openZkBackend, nil},
+}
+
+// Starts an etcd server for the test and returns its endpoint, set by the
+// tests built with the etcd tag
+var embeddedEtcd func(t *testing.T) string
+
+func openMemoryBackend(t *testing.T) func() Store {
+	nodes := newMemNodes()
+	return func() Store {
+		store := new(MemoryStore)
+		store.nodes = nodes
+		store.conn = newConnState(StateConnected)
+		return store
+	}
+}
+
+func openFileBackend(t *testing.T) func() Store {
+	filename := filepath.Join(t.TempDir(), "maestro.db")
+	return func() Store {
+		store, err := NewFileStore(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+}
+
+func openEtcdBackend(t *testing.T) func() Store {
+	endpoints := os.Getenv("MAESTRO_TEST_ETCD")
+	if endpoints == "" && embeddedEtcd != nil {
+		endpoints = embeddedEtcd(t)
+	}
+	if endpoints == "" {
+		t.Skip("MAESTRO_TEST_ETCD is not set")
+	}
+	return func() Store {
+		store, err := NewEtcdStore(strings.Split(endpoints, ","))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+}
+
+// expireFile drops the lease of the store from its file, as if it had not
+// been renewed in time
+func expireFile(t *testing.T, store Store) {
+	nodes := store.(*FileStore).nodes.(*fileNodes)
+	err := nodes.update(func(tree *fileTree) error {
+		delete(tree.Leases, nodes.lease)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expireEtcd revokes the lease of the store
+func expireEtcd(t *testing.T, store Store) {
+	nodes := store.(*EtcdStore).nodes.(*etcdNodes)
+	nodes.mutex.Lock()
+	lease := nodes.lease
+	nodes.mutex.Unlock()
+	err := nodes.post("/v3/lease/revoke", map[string]interface{}{"ID": strconv.FormatInt(lease, 10)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openZkBackend(t *testing.T) func() Store {
+	servers := os.Getenv("MAESTRO_TEST_ZK")
+	if servers == "" {
+		t.Skip("MAESTRO_TEST_ZK is not set")
+	}
+	return func() Store {
+		store, err := NewZkDAO(strings.Split(servers, ","))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The client connects in the background
+		waitState(t, store, StateConnected)
+		return store
+	}
+}
+
+// The contract every Store implementation must meet. Each test gets the
+// path of a domain of its own, which does not exist yet.
+var contractTests = []struct {
+	name string
+	test func(t *testing.T, open func() Store, root string)
+}{
+	{"UpdateAndLoad", testUpdateAndLoad},
+	{"LoadMissing", testLoadMissing},
+	{"Watch", testWatch},
+	{"WatchChildren", testWatchChildren},
+	{"WatchTree", testWatchTree},
+	{"CreateEphemeral", testCreateEphemeral},
+	{"CreateEphemeralSequential", testCreateEphemeralSequential},
+	{"Election", testElection},
+	{"RemoveRecursive", testRemoveRecursive},
+}
+
+func TestStoreContract(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			open := backend.open(t)
+			for _, contract := range contractTests {
+				t.Run(contract.name, func(t *testing.T) {
+					root := "/maestro/" + strings.ToLower(contract.name) + strconv.FormatInt(time.Now().UnixNano(), 36)
+					contract.test(t, open, root)
+					cleanup := open()
+					defer cleanup.Close()
+					if err := cleanup.RemoveRecursive(root); err != nil {
+						t.Errorf("RemoveRecursive(%s): %s", root, err)
+					}
+				})
+			}
+		})
+	}
+}
+
+// TestStoreExpiry checks that the ephemeral nodes lost with the session are
+// created again once the store is connected again
+func TestStoreExpiry(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			if backend.expire == nil {
+				t.Skip("The session of the backend cannot be expired")
+			}
+			open := backend.open(t)
+			store := open()
+			defer store.Close()
+			root := "/maestro/expiry" + strconv.FormatInt(time.Now().UnixNano(), 36)
+			defer store.RemoveRecursive(root)
+			if err := store.UpdateDomain(PathToKey(root), Domain{Name: path.Base(root)}, true); err != nil {
+				t.Fatal(err)
+			}
+			nodepath := root + "/runtime/agents/eph"
+			if _, err := store.CreateEphemeral(nodepath, []byte("a1")); err != nil {
+				t.Fatal(err)
+			}
+			states := make(chan ConnectionState, 10)
+			store.WatchState(states)
+			events := make(chan Event, 10)
+			if err := store.Watch(nodepath, events); err != nil {
+				t.Fatal(err)
+			}
+
+			backend.expire(t, store)
+			expectEvent(t, events, EventNodeDeleted, nodepath)
+			for _, state := range []ConnectionState{StateExpired, StateConnected} {
+				select {
+				case s := <-states:
+					if s != state {
+						t.Fatalf("Expected %s, got %s", state, s)
+					}
+				case <-time.After(2 * ETCD_LEASE_TTL * time.Second):
+					t.Fatalf("Expected %s, got nothing", state)
+				}
+			}
+			if value, err := store.GetValue(nodepath); err != nil || string(value) != "a1" {
+				t.Errorf("GetValue after the expiry: got %q, %v", value, err)
+			}
+		})
+	}
+}
+
+// testDomain is a domain with a process definition and an agent it is
+// assigned to
+func testDomain(root string) Domain {
+	return Domain{
+		Name: path.Base(root),
+		Config: StaticConfig{
+			Processes: []Process{{
+				Name:          "web",
+				Pid:           -1,
+				Command:       "/bin/sleep",
+				Args:          []string{"10", "20"},
+				Env:           map[string]string{"A": "1", "B": "2"},
+				Singleton:     true,
+				Instances:     2,
+				DependsOn:     []string{"db"},
+				RestartPolicy: RestartPolicy{Policy: "on-failure", MaxRestarts: 3, Window: "1m"},
+				Placement:     Placement{Scheduled: true, Agents: []string{"a1"}},
+			}},
+			Agents: []Agent{{
+				Name:       "a1",
+				AgentClass: "batch",
+				Processes: []Process{{
+					Name:         "web",
+					Pid:          -1,
+					ProcessClass: root + "/config/processes/web",
+					AdminState:   "on",
+				}},
+			}},
+		},
+	}
+}
+
+func testUpdateAndLoad(t *testing.T, open func() Store, root string) {
+	store := open()
+	defer store.Close()
+	if err := store.UpdateDomain(PathToKey(root), testDomain(root), true); err != nil {
+		t.Fatal(err)
+	}
+
+	domain, err := store.LoadDomain(PathToKey(root), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain.Name != path.Base(root) || len(domain.Config.Processes) != 1 || len(domain.Config.Agents) != 1 {
+		t.Fatalf("LoadDomain: got %+v", domain)
+	}
+	process := domain.Config.Processes[0]
+	want := testDomain(root).Config.Processes[0]
+	if process.Command != want.Command || !reflect.DeepEqual(process.Args, want.Args) || !reflect.DeepEqual(process.Env, want.Env) {
+		t.Errorf("command: got %q %q %v", process.Command, process.Args, process.Env)
+	}
+	if !process.Singleton || process.Instances != 2 || !reflect.DeepEqual(process.DependsOn, want.DependsOn) {
+		t.Errorf("singleton, instances, depends on: got %v %d %v", process.Singleton, process.Instances, process.DependsOn)
+	}
+	if !reflect.DeepEqual(process.RestartPolicy, want.RestartPolicy) || !reflect.DeepEqual(process.Placement, want.Placement) {
+		t.Errorf("policies: got %+v %+v", process.RestartPolicy, process.Placement)
+	}
+	agent := domain.Config.Agents[0]
+	if agent.AgentClass != "batch" || len(agent.Processes) != 1 || agent.Processes[0].AdminState != "on" {
+		t.Errorf("agent: got %+v", agent)
+	}
+
+	// A change to one process leaves the rest of the domain alone
+	assigned := agent.Processes[0]
+	assigned.AdminState = "off"
+	if err := store.UpdateProcess(assigned.Key, assigned, false); err != nil {
+		t.Fatal(err)
+	}
+	assigned, err = store.LoadProcess(assigned.Key, true)
+	if err != nil || assigned.AdminState != "off" || assigned.ProcessClass != root+"/config/processes/web" {
+		t.Errorf("LoadProcess after UpdateProcess: got %+v, %v", assigned, err)
+	}
+	agent, err = store.LoadAgent(agent.Key, true)
+	if err != nil || agent.AgentClass != "batch" || len(agent.Processes) != 1 {
+		t.Errorf("LoadAgent after UpdateProcess: got %+v, %v", agent, err)
+	}
+}
+
+func testLoadMissing(t *testing.T, open func() Store, root string) {
+	store := open()
+	defer store.Close()
+	if _, err := store.LoadDomain(PathToKey(root), true); err != ErrNoNode {
+		t.Errorf("LoadDomain: got %v, want ErrNoNode", err)
+	}
+	if err := store.UpdateDomain(PathToKey(root), Domain{Name: path.Base(root)}, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.LoadAgent(PathToKey(root+"/config/agents/none"), true); err != ErrNoNode {
+		t.Errorf("LoadAgent: got %v, want ErrNoNode", err)
+	}
+	if _, err := store.LoadProcess(PathToKey(root+"/config/processes/none"), true); err != ErrNoNode {
+		t.Errorf("LoadProcess: got %v, want ErrNoNode", err)
+	}
+	if _, err := store.GetValue(root + "/none"); err != ErrNoNode {
+		t.Errorf("GetValue: got %v, want ErrNoNode", err)
+	}
+	if err := store.Watch(root+"/none", make(chan Event, 1)); err == nil {
+		t.Error("Watch: got no error for a missing node")
+	}
+}
+
+func testWatch(t *testing.T, open func() Store, root string) {
+	store := open()
+	defer store.Close()
+	if err := store.UpdateDomain(PathToKey(root), testDomain(root), true); err != nil {
+		t.Fatal(err)
+	}
+	nodepath := root + "/config/agents/a1/processes/web/admin_state"
+	events := make(chan Event, 10)
+	if err := store.Watch(nodepath, events); err != nil {
+		t.Fatal(err)
+	}
+
+	// The watch is set again after each event
+	for _, value := range []string{"off", "on"} {
+		if err := store.SetValue(nodepath, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		expectEvent(t, events, EventNodeDataChanged, nodepath)
+	}
+	if err := store.RemoveRecursive(nodepath); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, events, EventNodeDeleted, nodepath)
+}
+
+func testWatchChildren(t *testing.T, open func() Store, root string) {
+	store := open()
+	defer store.Close()
+	if err := store.UpdateDomain(PathToKey(root), testDomain(root), true); err != nil {
+		t.Fatal(err)
+	}
+	nodepath := root + "/config/agents"
+	events := make(chan Event, 10)
+	if err := store.WatchChildren(nodepath, events); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.UpdateAgent(PathToKey(nodepath+"/a2"), Agent{Name: "a2"}, true); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, events, EventNodeChildrenChanged, nodepath)
+	// Changes below the children are not sent
+	if err := store.SetValue(nodepath+"/a1/processes/web/admin_state", []byte("off")); err != nil {
+		t.Fatal(err)
+	}
+	expectNoEvent(t, events)
+	if err := store.RemoveRecursive(nodepath + "/a2"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, events, EventNodeChildrenChanged, nodepath)
+}
+
+func testWatchTree(t *testing.T, open func() Store, root string) {
+	store := open()
+	defer store.Close()
+	if err := store.UpdateDomain(PathToKey(root), testDomain(root), true); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan Event, 100)
+	if err := store.WatchTree(root+"/config", events); err != nil {
+		t.Fatal(err)
+	}
+
+	nodepath := root + "/config/agents/a1/processes/web/admin_state"
+	if err := store.SetValue(nodepath, []byte("off")); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, events, EventNodeDataChanged, nodepath)
+
+	// Nodes added below the tree are watched too
+	if err := store.UpdateAgent(PathToKey(root+"/config/agents/a2"), Agent{Name: "a2"}, true); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, events, EventNodeChildrenChanged, root+"/config/agents")
+	drain(events)
+	if err := store.UpdateAgent(PathToKey(root+"/config/agents/a2"), Agent{Name: "a2", AgentClass: "web"}, false); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, events, EventNodeChildrenChanged, root+"/config/agents/a2")
+
+	// The watch ends once the root of the tree is deleted
+	if err := store.RemoveRecursive(root + "/config"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, events, EventNodeDeleted, root+"/config")
+}
+
+func testCreateEphemeral(t *testing.T, open func() Store, root string) {
+	owner := open()
+	other := open()
+	defer other.Close()
+	if err := owner.UpdateDomain(PathToKey(root), Domain{Name: path.Base(root)}, true); err != nil {
+		t.Fatal(err)
+	}
+	nodepath := root + "/runtime/agents/eph"
+	if _, err := owner.CreateEphemeral(nodepath, []byte("a1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.CreateEphemeral(nodepath, []byte("a2")); err != ErrNodeExists {
+		t.Errorf("CreateEphemeral of an existing node: got %v, want ErrNodeExists", err)
+	}
+	if value, err := other.GetValue(nodepath); err != nil || string(value) != "a1" {
+		t.Errorf("GetValue: got %q, %v", value, err)
+	}
+	events := make(chan Event, 10)
+	if err := other.Watch(nodepath, events); err != nil {
+		t.Fatal(err)
+	}
+
+	// The node goes with the session of its owner
+	owner.Close()
+	expectEvent(t, events, EventNodeDeleted, nodepath)
+	if _, err := other.GetValue(nodepath); err != ErrNoNode {
+		t.Errorf("GetValue after Close: got %v, want ErrNoNode", err)
+	}
+	if _, err := other.CreateEphemeral(nodepath, []byte("a2")); err != nil {
+		t.Errorf("CreateEphemeral after Close: %s", err)
+	}
+}
+
+func testCreateEphemeralSequential(t *testing.T, open func() Store, root string) {
+	owner := open()
+	other := open()
+	defer other.Close()
+	// The parents are created
+	prefix := root + "/runtime/locks/p1/" + LOCK_NODE_PREFIX
+	var nodes []string
+	var created int64
+	for i := 0; i < 3; i++ {
+		node, err := owner.CreateEphemeralSequential(prefix, []byte("a"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := sequenceOf(node); !ok || !strings.HasPrefix(node, path.Dir(prefix)+"/") {
+			t.Fatalf("CreateEphemeralSequential: got %s", node)
+		}
+		// Seen in the order of creation by every store
+		order, err := other.CreationOrder(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order <= created {
+			t.Errorf("CreationOrder of %s: got %d, want more than %d", node, order, created)
+		}
+		created = order
+		nodes = append(nodes, path.Base(node))
+	}
+	children, err := other.Children(path.Dir(prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != len(nodes) {
+		t.Errorf("Children: got %v, want %v", children, nodes)
+	}
+	if _, err := other.CreationOrder(root + "/missing"); err != ErrNoNode {
+		t.Errorf("CreationOrder of a missing node: got %v, want ErrNoNode", err)
+	}
+
+	// The nodes go with the session of their owner, and their numbers are
+	// not given again
+	owner.Close()
+	if children, _ = other.Children(path.Dir(prefix)); len(children) != 0 {
+		t.Errorf("Children after Close: got %v", children)
+	}
+	node, err := other.CreateEphemeralSequential(prefix, []byte("a3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, _ := sequenceOf(nodes[2])
+	if sequence, _ := sequenceOf(node); sequence <= last {
+		t.Errorf("Sequence number after Close: got %s, want more than %s", sequence, last)
+	}
+}
+
+func testElection(t *testing.T, open func() Store, root string) {
+	lock := root + "/runtime/locks/p1"
+	var elections []*Election
+	var leaderChans []chan bool
+	for i := 0; i < 3; i++ {
+		store := open()
+		defer store.Close()
+		leaderChan := make(chan bool, 10)
+		elections = append(elections, Elect(store, lock, "a"+strconv.Itoa(i), leaderChan))
+		leaderChans = append(leaderChans, leaderChan)
+		if i == 0 {
+			expectLeader(t, leaderChan, true)
+		}
+		// The members line up in the order they campaign
+		expectContenders(t, store, lock, i+1)
+	}
+	// Each member waits for the one before it
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			expectNoLeader(t, leaderChans[i])
+		}
+		// The contenders of each member are under its own node
+		nodes := expectContenders(t, elections[i].store, lock, 3-i)
+		if len(nodes) != 3-i || !strings.HasPrefix(nodes[0], lock+"/a"+strconv.Itoa(i)+"/") {
+			t.Errorf("Contenders: got %v, want the node of a%d first", nodes, i)
+		}
+		runtime, err := elections[i].store.LoadRuntimeConfig(PathToKey(root+"/runtime"), false)
+		if err != nil || len(runtime.Locks) != 1 || runtime.Locks[0].Holder != "a"+strconv.Itoa(i) {
+			t.Errorf("Locks: got %v, %v, want the lock held by a%d", runtime.Locks, err, i)
+		}
+		elections[i].Resign()
+		expectLeader(t, leaderChans[i], false)
+		if i < 2 {
+			expectLeader(t, leaderChans[i+1], true)
+		}
+	}
+}
+
+// expectContenders waits for the election to have count contenders, the
+// members create their nodes in the background
+func expectContenders(t *testing.T, store Store, lock string, count int) []string {
+	t.Helper()
+	deadline := time.Now().Add(TEST_WATCH_TIMEOUT)
+	for {
+		nodes, err := contenders(store, lock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) == count || time.Now().After(deadline) {
+			return nodes
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// expectLeader waits for the change of leadership, false being sent or the
+// channel being closed once the election is resigned
+func expectLeader(t *testing.T, leaderChan <-chan bool, leader bool) {
+	t.Helper()
+	select {
+	case got := <-leaderChan:
+		if got != leader {
+			t.Fatalf("Expected leader %v, got %v", leader, got)
+		}
+	case <-time.After(TEST_WATCH_TIMEOUT):
+		t.Fatalf("Expected leader %v, got nothing", leader)
+	}
+}
+
+func expectNoLeader(t *testing.T, leaderChan <-chan bool) {
+	t.Helper()
+	select {
+	case got, ok := <-leaderChan:
+		if ok {
+			t.Fatalf("Expected no change of leadership, got %v", got)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func testRemoveRecursive(t *testing.T, open func() Store, root string) {
+	store := open()
+	defer store.Close()
+	if err := store.UpdateDomain(PathToKey(root), testDomain(root), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveRecursive(root + "/config/agents/a1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.LoadAgent(PathToKey(root+"/config/agents/a1"), true); err != ErrNoNode {
+		t.Errorf("LoadAgent after RemoveRecursive: got %v, want ErrNoNode", err)
+	}
+	if _, err := store.GetValue(root + "/config/agents/a1/processes/web/admin_state"); err != ErrNoNode {
+		t.Errorf("GetValue below the removed node: got %v, want ErrNoNode", err)
+	}
+	if _, err := store.LoadProcess(PathToKey(root+"/config/processes/web"), true); err != nil {
+		t.Errorf("LoadProcess of a sibling: %s", err)
+	}
+	// Removing a missing node is not an error
+	if err := store.RemoveRecursive(root + "/config/agents/a1"); err != nil {
+		t.Errorf("RemoveRecursive of a missing node: %s", err)
+	}
+}
+
+// expectEvent waits for the event on events, skipping the events of the
+// other changes made on the way
+func expectEvent(t *testing.T, events <-chan Event, eventType EventType, nodepath string) {
+	t.Helper()
+	deadline := time.After(TEST_WATCH_TIMEOUT)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == eventType && e.Path == nodepath {
+				return
+			}
+			if e.Type == EventNotWatching {
+				t.Fatalf("Expected %s on %s, got %s on %s", eventType, nodepath, e.Type, e.Path)
+			}
+		case <-deadline:
+			t.Fatalf("Expected %s on %s, got nothing", eventType, nodepath)
+		}
+	}
+}
+
+// expectNoEvent checks that no event arrives on events for a while
+func expectNoEvent(t *testing.T, events <-chan Event) {
+	t.Helper()
+	select {
+	case e := <-events:
+		t.Fatalf("Expected no event, got %s on %s", e.Type, e.Path)
+	case <-time.After(2 * FILE_POLL_INTERVAL):
+	}
+}
+
+// drain drops the events already sent on events
+func drain(events <-chan Event) {
+	time.Sleep(2 * FILE_POLL_INTERVAL)
+	for {
+		select {
+		case <-events:
+		default:
+			return
+		}
+	}
+}
+
+// waitState waits for the store to reach the state
+func waitState(t *testing.T, store Store, state ConnectionState) {
+	t.Helper()
+	deadline := time.Now().Add(TEST_WATCH_TIMEOUT)
+	for store.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the store to be %s, it is %s", state, store.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,37 +1,225 @@
 package data
 
 type Domain struct {
-    Name string
-    Key string
-    Runtime RuntimeConfig
-    Config StaticConfig
+	Name string
+	Key  string
+	// The paths at which the server serves the node and the nodes related to
+	// it, by relation, e.g. "self". Set by the server, never stored.
+	Links   map[string]string
+	Runtime RuntimeConfig
+	Config  StaticConfig
 }
 
 type RuntimeConfig struct {
-	Agents[] Agent
+	Agents []Agent
+	// The locks of the singleton processes
+	Locks []Lock
+}
+
+// Lock is a lock held through an ephemeral node, see Election
+type Lock struct {
+	Name string
+	// The name of the agent holding the lock
+	Holder string
 }
 
 type StaticConfig struct {
-	Agents[] Agent
-	Processes[] Process
+	Agents    []Agent
+	Processes []Process
 }
 
 type Agent struct {
 	Name string
-	Key string
+	Key  string
+	// Set by the server, see Domain.Links
+	Links map[string]string
+	// The class of the agent, which scheduled processes can ask for
 	AgentClass string
-	OS string
+	// The operating system of the agent (its runtime.GOOS), published by the
+	// agent in its runtime node
+	OS  string
 	Eph string
-	Processes[] Process
+	// The host:port at which the agent serves process output
+	Address   string
+	Processes []Process
 }
 
 type Process struct {
 	Name string
-	Key string
+	Key  string
+	// Set by the server, see Domain.Links
+	Links map[string]string
+	// "service" (the default) keeps the process running, "oneshot" runs it to
+	// completion every time it is turned on and "cron" runs it on Schedule.
+	// Oneshot and cron processes are jobs.
+	Type string
+	// The cron expression of a cron job, e.g. "*/5 * * * *" or "@daily"
+	Schedule string
+	// What to do when a job is due while it is still running: "skip" the run
+	// (the default), "queue" it until the running one exits or "replace" the
+	// running one
+	Overlap string
 	Command string
+	// Arguments is the legacy, single string form of Args. It is split on
+	// white space and only used when Args is empty.
 	Arguments string
+	Args      []string
+	Env       map[string]string
+	// When set the process does not inherit the agent's environment, only Env
+	ClearEnv   bool
+	WorkingDir string
+	// The user and group the process runs as, as names or ids, the agent
+	// must run as root to use them. Groups are the supplementary groups,
+	// they default to the groups of User.
+	User   string
+	Group  string
+	Groups []string
+	// The octal umask of the process, e.g. "022"
+	Umask string
+	// The names of the processes on the same agent that must be running
+	// before this one is started
+	DependsOn    []string
 	ProcessClass string
-	AdminState string
-	OperState string
-	Pid int
-}
\ No newline at end of file
+	// When set only one agent of the domain runs the process at a time, the
+	// others keep it on standby until they are elected to take over
+	Singleton bool
+	// Where the scheduler may place the process, it is ignored unless
+	// Placement.Scheduled is set
+	Placement Placement
+	// The number of copies of the process each agent runs (defaults to 1)
+	Instances int
+	// The index of a runtime copy of the process, instance 0 is named after
+	// the process and instance i after the process with "-i" appended
+	Instance      int
+	AdminState    string
+	OperState     string
+	Pid           int
+	RestartPolicy RestartPolicy
+	// What the agent does with the running instances when the definition of
+	// the process changes: "restart" them (the default), apply the change
+	// "on-next-start" or "ignore" it until the agent restarts
+	UpdatePolicy string
+	Restarts     int
+	// How the last run of the process ended, LastExitTime is empty until
+	// the process has exited at least once
+	ExitCode   int
+	ExitSignal string
+	// "exited", "stopped" (by the agent), "unhealthy" or "oom" (killed by
+	// the kernel for going over Resources.MemoryMax)
+	ExitReason   string
+	LastExitTime string
+	// The number of descendants the agent killed after the process exited
+	Strays int
+	// How the agent stops the process: it runs StopCommand if set, otherwise
+	// it sends StopSignal (defaults to "SIGTERM"). If the process is still
+	// running after StopTimeout (defaults to "10s") it is killed.
+	StopSignal  string
+	StopTimeout string
+	StopCommand string
+	// The arguments of StopCommand. When empty, StopCommand is split on white
+	// space, as the legacy form of the command and its arguments.
+	StopArgs    []string
+	HealthCheck HealthCheck
+	Resources   Resources
+	// The resources used by the running process, updated by the agent
+	Usage ResourceUsage
+	// "starting", "healthy", "unhealthy" or "unknown" once the process has
+	// exited, empty when the process has no health check
+	Health string
+	// The last runs of a job, oldest first, kept by the agent
+	Runs []Run
+	// The time of the last run of the job requested through the server, the
+	// agent starts a run every time it changes
+	RunRequested string
+}
+
+// Run is one run of a job. Times use the time.RFC3339 format.
+type Run struct {
+	// Runs are numbered in the order they started, from 1
+	Number int
+	// "start" (the job was turned on), "schedule", "request" (through the
+	// server) or "retry" (by the restart policy)
+	Trigger    string
+	Start      string
+	End        string
+	ExitCode   int
+	ExitSignal string
+	// How long the run took, in the time.Duration format, e.g. "1.5s"
+	Duration string
+}
+
+// Placement constrains the agents to which the scheduler may assign a process.
+// The scheduler picks the eligible live agent with the fewest processes.
+type Placement struct {
+	// When set the scheduler assigns the process to an agent, and moves it to
+	// another agent when its agent dies
+	Scheduled bool
+	// Only agents of this class and with this OS are eligible, when set
+	AgentClass string
+	OS         string
+	// Only these agents are eligible, when not empty
+	Agents []string
+}
+
+// RestartPolicy controls what the agent does when a process exits without
+// being asked to. Durations use the time.ParseDuration format, e.g. "30s".
+type RestartPolicy struct {
+	// "always", "on-failure" or "never" (defaults to "always")
+	Policy string
+	// The number of restarts allowed within Window before the process is
+	// marked as failed, 0 means no limit
+	MaxRestarts int
+	Window      string
+	// The delay before the first restart, doubled for each further restart
+	// within Window up to MaxBackoff
+	Backoff    string
+	MaxBackoff string
+}
+
+// HealthCheck tells the agent how to check that a running process is healthy.
+// Durations use the time.ParseDuration format, e.g. "30s".
+type HealthCheck struct {
+	// "exec", "tcp" or "http", no check is done when empty
+	Type string
+	// exec: the command to run, healthy when it exits with 0
+	Command string
+	// tcp: the host:port to connect to
+	Address string
+	// http: the URL to GET, healthy when it answers with Status (defaults to 200)
+	URL    string
+	Status int
+	// How often to check (defaults to "10s") and how long a check may take
+	// (defaults to "5s"), the first check is done after InitialDelay
+	Interval     string
+	Timeout      string
+	InitialDelay string
+	// The number of consecutive failures after which the process is
+	// unhealthy (defaults to 3) and of consecutive successes after which it
+	// is healthy again (defaults to 1)
+	FailureThreshold int
+	SuccessThreshold int
+	// When set an unhealthy process is stopped and its restart policy applied
+	// as if it had failed
+	Restart bool
+}
+
+// Resources limits what a process may use, the agent enforces them with
+// cgroups v2 on Linux
+type Resources struct {
+	// The share of one CPU the process may use, e.g. "50%", or "200%" for two
+	CPUQuota string
+	// The memory the process may use in bytes, with an optional K, M or G suffix
+	MemoryMax string
+	// The maximum number of processes and threads
+	PidsMax int
+	// The IO weight, between 1 and 10000 (defaults to 100)
+	IOWeight int
+}
+
+// ResourceUsage is what a process currently uses
+type ResourceUsage struct {
+	MemoryCurrent int
+	// The CPU time used, in microseconds
+	CPUUsage    int
+	PidsCurrent int
+}
@@ -1,312 +1,317 @@
 package data
 
 import (
+	"errors"
 	"github.com/samuel/go-zookeeper/zk"
+	"log"
+	"net/url"
+	"os"
 	"path"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
-	"strconv"
-	"log"
-	"errors"
-	"bytes"
-	"encoding/base64" 
 )
 
+// Read for the password of the ZooKeeper user when the store URL has none
+const STORE_PASSWORD_ENV = "MAESTRO_STORE_PASSWORD"
+
+// ZkAuth is the digest credentials of the session and the principals the
+// nodes created under /maestro give access to. Principals are digest ids,
+// "user:base64(sha1(user:password))". Without a user every node is open to
+// everyone.
+type ZkAuth struct {
+	User     string
+	Password string
+	// May change everything under /maestro
+	Admins []string
+	// The agents, whose users are named after them. Each may change its own
+	// runtime subtree and its nodes in the elections of the locks, and add
+	// them, but not remove those of the other agents.
+	Agents []string
+}
+
+// Match the runtime subtree of an agent and its node in the election of a
+// lock, under which it adds its contenders, and the runtime nodes agents add
+// their nodes to: the runtime node of the agents, and the locks and their
+// elections
+var zkAgentRuntimeRegexp = regexp.MustCompile("^/maestro/[^/]+/runtime/(agents|locks/[^/]+)/([^/]+)(/.*)?$")
+var zkSharedRuntimeRegexp = regexp.MustCompile("^/maestro/[^/]+/runtime/(agents|locks|locks/[^/]+)$")
+
+// ZkDAO is the ZooKeeper implementation of Store
 type ZkDAO struct {
+	nodeDAO
 	client *zk.Conn
 }
 
 // #### CONSTRUCTOR ####
 
 func NewZkDAO(zookeeper []string) (*ZkDAO, error) {
-	client, _, err := zk.Connect(zookeeper, time.Second)
-	zkdao := new(ZkDAO)
-	zkdao.client = client
-	return zkdao, err
+	return NewZkDAOWithAuth(zookeeper, ZkAuth{})
 }
 
-
-// #### PUBLIC METHODS ####
-
-func (zkdao *ZkDAO) LoadDomains(key string, recursive bool) ([]Domain, error) {
-	nodepath := KeyToPath(key)
-	var domains[] Domain
-	domainNodes,_,_ := zkdao.client.Children(nodepath)
-	for _,domainNode := range domainNodes {
-		domain, err := zkdao.LoadDomain(PathToKey(nodepath + "/" + domainNode), recursive)
-		if err != nil { return domains, err }
-		domains = append(domains, domain) 
+// NewZkDAOWithAuth connects with the digest credentials of auth, the client
+// sends them again every time it reconnects
+func NewZkDAOWithAuth(zookeeper []string, auth ZkAuth) (*ZkDAO, error) {
+	client, sessionEvents, err := zk.Connect(zookeeper, time.Second)
+	zkdao := new(ZkDAO)
+	zkdao.client = client
+	nodes := &zkNodes{client: client, auth: auth, ephemerals: make(map[string][]byte)}
+	zkdao.nodes = nodes
+	zkdao.conn = newConnState(StateDisconnected)
+	if err == nil && auth.User != "" {
+		err = client.AddAuth("digest", []byte(auth.User+":"+auth.Password))
 	}
-	return domains, nil
-}
-
-func (zkdao *ZkDAO) LoadDomain(key string, recursive bool) (Domain, error) {
-	nodepath := KeyToPath(key)
-	var domain Domain
-	domain.Key  = key
-	domain.Name = path.Base(nodepath)
-	exists,_,_ := zkdao.client.Exists(nodepath)
-	if exists {
-		config, err := zkdao.LoadStaticConfig(PathToKey(nodepath + "/config"), recursive)
-		if err != nil { return domain, err }
-		domain.Config = config
-		runtime, err := zkdao.LoadRuntimeConfig(PathToKey(nodepath + "/runtime"), recursive)
-		if err != nil { return domain, err }
-		domain.Runtime = runtime
-	} else {
-        log.Println("Domain node does not exist: " + string(key))
+	if err == nil {
+		go watchSession(sessionEvents, nodes, zkdao.conn)
 	}
-	return domain, nil
+	return zkdao, err
 }
 
-func (zkdao *ZkDAO) LoadStaticConfig(key string, recursive bool) (StaticConfig, error) {
-	nodepath := KeyToPath(key)
-	var config StaticConfig
-	exists,_,_ := zkdao.client.Exists(nodepath)
-	if exists {
-		agentsNode,_,_ := zkdao.client.Children(nodepath + "/agents")
-		for _,agentNode := range agentsNode {
-			agent, err := zkdao.LoadAgent(PathToKey(nodepath + "/agents/" + agentNode), recursive)
-			if err != nil { return config, err }
-			config.Agents = append(config.Agents, agent) 
+// parseZkAddress parses the address of a zk:// store URL:
+// "[user[:password]@]host:port[,host:port...][?admins=id,...&agents=id,...]".
+// The password defaults to $MAESTRO_STORE_PASSWORD.
+func parseZkAddress(address string) ([]string, ZkAuth, error) {
+	var auth ZkAuth
+	if i := strings.Index(address, "?"); i >= 0 {
+		query, err := url.ParseQuery(address[i+1:])
+		if err != nil {
+			return nil, auth, err
 		}
-		
-		processesNode,_,_ := zkdao.client.Children(nodepath + "/processes")
-		for _,processNode := range processesNode {
-			process, err := zkdao.LoadProcess(PathToKey(nodepath + "/processes/" + processNode), recursive)
-			if err != nil { return config, err }
-			config.Processes = append(config.Processes, process) 
+		address = address[:i]
+		auth.Admins = digestIds(query.Get("admins"))
+		auth.Agents = digestIds(query.Get("agents"))
+		for _, id := range append(auth.Admins, auth.Agents...) {
+			if !strings.Contains(id, ":") {
+				return nil, auth, errors.New("Malformed digest id, expected 'user:digest': " + id)
+			}
 		}
-	} else {
-        log.Println("Static config node does not exist: " + nodepath)
 	}
-	return config, nil
-}
-
-func (zkdao *ZkDAO) LoadRuntimeConfig(key string, recursive bool) (RuntimeConfig, error) {
-	nodepath := KeyToPath(key)
-	var runtime RuntimeConfig
-	exists,_,_ := zkdao.client.Exists(nodepath)
-	if exists {
-		agentsNode,_,_ := zkdao.client.Children(nodepath + "/agents")
-		for _,agentNode := range agentsNode {
-			agent, err := zkdao.LoadAgent(PathToKey(nodepath + "/agents/" + agentNode), recursive)
-			if err != nil { return runtime, err }
-			runtime.Agents = append(runtime.Agents, agent) 
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		userinfo := strings.SplitN(address[:i], ":", 2)
+		address = address[i+1:]
+		var err error
+		auth.User, err = url.PathUnescape(userinfo[0])
+		if err != nil {
+			return nil, auth, err
+		}
+		if len(userinfo) == 2 {
+			auth.Password, err = url.PathUnescape(userinfo[1])
+			if err != nil {
+				return nil, auth, err
+			}
+		} else {
+			auth.Password = os.Getenv(STORE_PASSWORD_ENV)
 		}
-	} else {
-        log.Println("Runtime config node does not exist: " + nodepath)
 	}
-	return runtime, nil
+	if auth.User == "" && (len(auth.Admins) > 0 || len(auth.Agents) > 0) {
+		return nil, auth, errors.New("The principals of the ACLs require a ZooKeeper user")
+	}
+	return strings.Split(address, ","), auth, nil
 }
 
-func (zkdao *ZkDAO) LoadAgent(key string, recursive bool) (Agent, error) {
-	nodepath := KeyToPath(key)
-	var agent Agent
-	agent.Key  = key
-	agent.Name = path.Base(nodepath)
-	exists,_,_ := zkdao.client.Exists(nodepath)
-	if exists {
-		processesNode,_,_ := zkdao.client.Children(nodepath + "/processes")
-		for _,processNode := range processesNode {
-			process, err := zkdao.LoadProcess(PathToKey(nodepath + "/processes/" + processNode), recursive)
-			if err != nil { return agent, err }
-			agent.Processes = append(agent.Processes, process) 
-		}
-
-		exists,_,_ = zkdao.client.Exists(nodepath + "/eph")
-		if exists { 
-			data,_,err := zkdao.client.Get(nodepath + "/eph")
-			if err == nil {
-				agent.Eph = string(data)
-			}
+func digestIds(list string) []string {
+	var ids []string
+	for _, id := range strings.Split(list, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
 		}
-	} else {
-        log.Println("Agent node does not exist: " + nodepath)
 	}
-	return agent, nil
+	return ids
 }
 
-func (zkdao *ZkDAO) LoadProcess(key string, recursive bool) (Process, error) {
-	nodepath := KeyToPath(key)
-	process := Process {Pid : -1}
-	process.Key  = key
-	process.Name = path.Base(nodepath)
-	exists,_,_ := zkdao.client.Exists(nodepath)
-	if exists {
-		exists,_,_ = zkdao.client.Exists(nodepath + "/command")
-		if exists { 
-			data,_,err := zkdao.client.Get(nodepath + "/command")
-			if err == nil {
-				process.Command = string(data)
-			}
-			log.Println("Reading command " + process.Command)
-		}
-		exists,_,_ = zkdao.client.Exists(nodepath + "/arguments")
-		if exists { 
-			data,_,err := zkdao.client.Get(nodepath + "/arguments")
-			if err == nil {
-				process.Arguments = string(data)
-			}
-		}
-		exists,_,_ = zkdao.client.Exists(nodepath + "/process_class")
-		if exists { 
-			data,_,err := zkdao.client.Get(nodepath + "/process_class")
-			if err == nil {
-				process.ProcessClass = string(data)
-			}
-		}
-		exists,_,_ = zkdao.client.Exists(nodepath + "/admin_state")
-		if exists { 
-			data,_,err := zkdao.client.Get(nodepath + "/admin_state")
-			if err == nil {
-				process.AdminState = string(data)
-			}
+// watchSession follows the state of the ZooKeeper session. The client sets
+// the watches again by itself when it reconnects within the session, but
+// when the session expires the ephemeral nodes are gone and every watch ends
+// with EventNotWatching, so the ephemeral nodes are created again before the
+// store is connected again and nodeDAO sets the watches again.
+func watchSession(sessionEvents <-chan zk.Event, nodes *zkNodes, conn *connState) {
+	for e := range sessionEvents {
+		if e.Type != zk.EventSession {
+			continue
 		}
-		exists,_,_ = zkdao.client.Exists(nodepath + "/oper_state")
-		if exists { 
-			data,_,err := zkdao.client.Get(nodepath + "/oper_state")
-			if err == nil {
-				process.OperState = string(data)
+		switch e.State {
+		case zk.StateHasSession:
+			if conn.get() == StateExpired {
+				log.Println("ZooKeeper session re-established, restoring ephemeral nodes")
+				nodes.restoreEphemerals()
 			}
-		}
-		exists,_,_ = zkdao.client.Exists(nodepath + "/pid")
-		if exists { 
-			data,_,err := zkdao.client.Get(nodepath + "/pid")
-			if err == nil {
-				tempPid, err := strconv.ParseInt(string(data), 10, 32)
-				if err != nil {
-					log.Printf("Failed to parse pid '%s':\n%s", nodepath + "/pid", err)
-				} else {
-					process.Pid = int(tempPid)
-				}
+			conn.set(StateConnected)
+		case zk.StateExpired:
+			log.Println("ZooKeeper session expired")
+			conn.set(StateExpired)
+		case zk.StateDisconnected, zk.StateConnecting:
+			// Expired is kept until there is a new session
+			if conn.get() != StateExpired {
+				conn.set(StateDisconnected)
 			}
 		}
-	} else {
-        log.Println("Process node does not exist: " + nodepath)
 	}
-	return process, nil
+	conn.set(StateClosed)
 }
 
-func (zkdao *ZkDAO) UpdateDomain(key string, domain Domain, recursive bool) error {
-	nodepath := KeyToPath(key)
-	exists,_,_ := zkdao.client.Exists(nodepath)
-	if !exists {
-		_, err := zkdao.createWithParents(nodepath, []byte{}, 0, zk.WorldACL(zk.PermAll))
-		if err != nil { return err }
-	}
-	if recursive {
-		err := zkdao.UpdateStaticConfig(PathToKey(nodepath + "/config"), domain.Config, recursive)
-		if err != nil { return err }
-		err = zkdao.UpdateRuntimeConfig(PathToKey(nodepath + "/runtime"), domain.Runtime, recursive)
-		if err != nil { return err }
+// #### NODE STORE ####
+
+// zkNodes maps the nodeStore operations directly onto znodes
+type zkNodes struct {
+	client *zk.Conn
+	auth   ZkAuth
+	// The ephemeral nodes created through this store and their data, to
+	// create them again when the session expires
+	mutex      sync.Mutex
+	ephemerals map[string][]byte
+}
+
+// zkError maps the errors of the client to the errors callers compare with
+func zkError(err error) error {
+	switch err {
+	case zk.ErrNoNode:
+		return ErrNoNode
+	case zk.ErrNodeExists:
+		return ErrNodeExists
 	}
-	return nil
+	return err
+}
+
+func (z *zkNodes) exists(nodepath string) (bool, error) {
+	exists, _, err := z.client.Exists(nodepath)
+	return exists, zkError(err)
+}
+
+func (z *zkNodes) get(nodepath string) ([]byte, error) {
+	data, _, err := z.client.Get(nodepath)
+	return data, zkError(err)
 }
 
-func (zkdao *ZkDAO) UpdateStaticConfig(key string, config StaticConfig, recursive bool) error {
-	nodepath := KeyToPath(key)
-	exists,_,_ := zkdao.client.Exists(nodepath)
-	if !exists {
-		_, err := zkdao.createWithParents(nodepath, []byte{}, 0, zk.WorldACL(zk.PermAll))
-		if err != nil { return err }
+// created is the id of the transaction that created the node, which orders
+// the changes of the whole ensemble
+func (z *zkNodes) created(nodepath string) (int64, error) {
+	exists, stat, err := z.client.Exists(nodepath)
+	if err == nil && !exists {
+		err = ErrNoNode
 	}
-	if recursive {
-		for _, value := range config.Agents {
-			err := zkdao.UpdateAgent(PathToKey(nodepath + "/agents/" + value.Name), value, recursive)
-			if err != nil { return err }
-		}
-		for _, value := range config.Processes {
-			err := zkdao.UpdateProcess(PathToKey(nodepath + "/processes/" + value.Name), value, recursive)
-			if err != nil { return err }
-		}
+	if err != nil {
+		return 0, zkError(err)
 	}
-	return nil
+	return stat.Czxid, nil
 }
 
-func (zkdao *ZkDAO) UpdateRuntimeConfig(key string, runtime RuntimeConfig, recursive bool) error {
-	return nil
+func (z *zkNodes) children(nodepath string) ([]string, error) {
+	children, _, err := z.client.Children(nodepath)
+	return children, zkError(err)
 }
 
-func (zkdao *ZkDAO) UpdateAgent(key string, agent Agent, recursive bool) error {
-	nodepath := KeyToPath(key)
-	log.Println("Updating agent: " + nodepath)
-	exists,_,_ := zkdao.client.Exists(nodepath)
-	if !exists {
-		_, err := zkdao.createWithParents(nodepath, []byte{}, 0, zk.WorldACL(zk.PermAll))
-		if err != nil { return err }
+func (z *zkNodes) create(nodepath string, data []byte, ephemeral bool) (string, error) {
+	var flags int32
+	if ephemeral {
+		flags = zk.FlagEphemeral
 	}
-	if recursive {
-		for _, value := range agent.Processes {
-			err := zkdao.UpdateProcess(PathToKey(nodepath + "/processes/" + value.Name), value, recursive)
-			if err != nil { return err }
-		}
+	created, err := z.client.Create(nodepath, data, flags, z.acl(nodepath))
+	if err == nil && ephemeral {
+		z.mutex.Lock()
+		z.ephemerals[nodepath] = data
+		z.mutex.Unlock()
 	}
-	return nil
+	return created, zkError(err)
 }
 
-func (zkdao *ZkDAO) UpdateProcess(key string, process Process, recursive bool) error {
-	nodepath := KeyToPath(key)
-	log.Println("Updating process: " + nodepath)
-	exists,_,_ := zkdao.client.Exists(nodepath)
-	if !exists {
-		_, err := zkdao.createWithParents(nodepath, []byte{}, 0, zk.WorldACL(zk.PermAll))
-		if err != nil { return err }
-	}
-	if process.Command != "" {
-		_, err := zkdao.createOrSet(nodepath + "/command", []byte(process.Command), 0, zk.WorldACL(zk.PermAll))
-		if err != nil { return err }
+// createSequential uses the protected form of the sequential create, which
+// finds the node again when the connection is lost before the reply arrives.
+// Its name starts with a unique prefix, the sequence number is still last.
+func (z *zkNodes) createSequential(prefix string, data []byte) (string, error) {
+	created, err := z.client.CreateProtectedEphemeralSequential(prefix, data, z.acl(prefix))
+	return created, zkError(err)
+}
+
+func (z *zkNodes) set(nodepath string, data []byte) error {
+	_, err := z.client.Set(nodepath, data, -1)
+	if err == nil {
+		z.mutex.Lock()
+		if _, ok := z.ephemerals[nodepath]; ok {
+			z.ephemerals[nodepath] = data
+		}
+		z.mutex.Unlock()
 	}
-	if process.Arguments != "" {
-		_, err := zkdao.createOrSet(nodepath + "/arguments", []byte(process.Arguments), 0, zk.WorldACL(zk.PermAll))
-		if err != nil { return err }
+	return zkError(err)
+}
+
+func (z *zkNodes) remove(nodepath string) error {
+	err := z.client.Delete(nodepath, -1)
+	if err == nil || err == zk.ErrNoNode {
+		z.mutex.Lock()
+		delete(z.ephemerals, nodepath)
+		z.mutex.Unlock()
 	}
-	if process.ProcessClass != "" {
-		_, err := zkdao.createOrSet(nodepath + "/process_class", []byte(process.ProcessClass), 0, zk.WorldACL(zk.PermAll))
-		if err != nil { return err }
+	return zkError(err)
+}
+
+// restoreEphemerals creates the ephemeral nodes that were lost with the
+// session. A node that now exists belongs to someone else (a lock taken by
+// another agent) and a node whose parent is gone is no longer wanted, so
+// both are forgotten.
+func (z *zkNodes) restoreEphemerals() {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	for nodepath, data := range z.ephemerals {
+		_, err := z.client.Create(nodepath, data, zk.FlagEphemeral, z.acl(nodepath))
+		if err == nil {
+			log.Println("Restored ephemeral node: " + nodepath)
+			continue
+		}
+		log.Printf("Failed to restore ephemeral node '%s': %s\n", nodepath, err.Error())
+		if err == zk.ErrNodeExists || err == zk.ErrNoNode {
+			delete(z.ephemerals, nodepath)
+		}
 	}
-	if process.AdminState != "" {
-		_, err := zkdao.createOrSet(nodepath + "/admin_state", []byte(process.AdminState), 0, zk.WorldACL(zk.PermAll))
-		if err != nil { return err }
+}
+
+// acl is the ACL of a new node. Everyone may read, the user of the session
+// and the admins may do anything, and the agents get what they need to
+// maintain their runtime nodes.
+func (z *zkNodes) acl(nodepath string) []zk.ACL {
+	if z.auth.User == "" {
+		return zk.WorldACL(zk.PermAll)
 	}
-	if process.OperState != "" {
-		_, err := zkdao.createOrSet(nodepath + "/oper_state", []byte(process.OperState), 0, zk.WorldACL(zk.PermAll))
-		if err != nil { return err }
+	acl := zk.WorldACL(zk.PermRead)
+	acl = mergeACL(acl, zk.DigestACL(zk.PermAll, z.auth.User, z.auth.Password))
+	for _, id := range z.auth.Admins {
+		acl = mergeACL(acl, []zk.ACL{{Perms: zk.PermAll, Scheme: "digest", ID: id}})
 	}
-	if process.Pid != -1 {
-		_, err := zkdao.createOrSet(nodepath + "/pid", []byte(strconv.FormatInt(int64(process.Pid), 10)), 0, zk.WorldACL(zk.PermAll))
-		if err != nil { return err }
+	if match := zkAgentRuntimeRegexp.FindStringSubmatch(nodepath); match != nil {
+		for _, id := range z.auth.Agents {
+			if strings.HasPrefix(id, match[2]+":") {
+				acl = mergeACL(acl, []zk.ACL{{Perms: zk.PermAll, Scheme: "digest", ID: id}})
+			}
+		}
+	} else if zkSharedRuntimeRegexp.MatchString(nodepath) {
+		// Removing a node takes the delete permission on its parent, so the
+		// agents may only remove the nodes below their own
+		for _, id := range z.auth.Agents {
+			acl = mergeACL(acl, []zk.ACL{{Perms: zk.PermRead | zk.PermCreate, Scheme: "digest", ID: id}})
+		}
 	}
-	return nil
+	return acl
 }
 
-func (zkdao *ZkDAO) Watch(path string, watchChannel chan<- zk.Event) (error) {
-	log.Println("Adding watch: " + path)
-	exists,_,eventChan,err := zkdao.client.ExistsW(path)
+// SetACLs sets the ACL of the node at nodepath and of every node below it to
+// the ACL the node would get if it was created now, so that the principals of
+// the store also apply to the nodes created before they were given
+func (zkdao *ZkDAO) SetACLs(nodepath string) error {
+	nodes := zkdao.nodes.(*zkNodes)
+	_, err := zkdao.client.SetACL(nodepath, nodes.acl(nodepath), -1)
 	if err != nil {
-		return err
+		return zkError(err)
 	}
-	if !exists {
-		return errors.New("The path '" + path + "' does not exist" )
-	}
-	go func(to chan<- zk.Event, from <-chan zk.Event) {
-		e := <-from
-		to <-e
-		zkdao.Watch(path, to)
-	}(watchChannel, eventChan)
-	return nil
-}
-
-func (zkdao *ZkDAO) GetValue(path string) ([]byte, error) {
-	data,_,err := zkdao.client.Get(path)
-	return data,err;
-}
-func (zkdao *ZkDAO) SetValue(path string, data []byte) (error) {
-	exists,stat,err := zkdao.client.Exists(path)
+	children, err := nodes.children(nodepath)
 	if err != nil {
 		return err
 	}
-	if exists {
-		_, err = zkdao.client.Set(path, data, stat.Version)
+	for _, child := range children {
+		err := zkdao.SetACLs(path.Join(nodepath, child))
+		if err == ErrNoNode {
+			// Removed in the meantime
+			continue
+		}
 		if err != nil {
 			return err
 		}
@@ -314,74 +319,58 @@ func (zkdao *ZkDAO) SetValue(path string, data []byte) (error) {
 	return nil
 }
 
-func (zkdao *ZkDAO) RemoveRecursive(path string) (error) {
-	exists,stat,err := zkdao.client.Exists(path)
-	if exists && err != nil {
-		return err
-	}
-	if exists {
-		children,_,_ := zkdao.client.Children(path)
-		for _,child := range children {
-			err := zkdao.RemoveRecursive(path + "/" + child)
-			if err != nil {
-				return err
+// mergeACL adds the entries to the ACL, the permissions of an id that is
+// already in it are added to its entry
+func mergeACL(acl []zk.ACL, entries []zk.ACL) []zk.ACL {
+	for _, entry := range entries {
+		merged := false
+		for i := range acl {
+			if acl[i].Scheme == entry.Scheme && acl[i].ID == entry.ID {
+				acl[i].Perms |= entry.Perms
+				merged = true
 			}
 		}
-		return zkdao.client.Delete(path, stat.Version)
+		if !merged {
+			acl = append(acl, entry)
+		}
 	}
-	return nil
-}
-
-// Creates an ephemeral node for the given path
-func (zkdao ZkDAO) CreateEphemeral(path string, data []byte) (string, error) {
-	return zkdao.client.Create(path,data,zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	return acl
 }
 
-// Converts a key to a ZK path
-func KeyToPath(key string) (string) {
-	path, err := base64.StdEncoding.DecodeString(key)
+func (z *zkNodes) existsW(nodepath string) (bool, <-chan Event, error) {
+	exists, _, zkEvents, err := z.client.ExistsW(nodepath)
 	if err != nil {
-		return ""
-	} else {
-		return string(path)
+		return exists, nil, zkError(err)
 	}
+	events := make(chan Event, 1)
+	go func() {
+		e := <-zkEvents
+		events <- Event{Type: zkEventTypes[e.Type], Path: e.Path, Err: e.Err}
+	}()
+	return exists, events, nil
 }
 
-// Converts a ZK path to a key
-func PathToKey(path string) (string) {
-	return base64.StdEncoding.EncodeToString([]byte(path))
+func (z *zkNodes) childrenW(nodepath string) ([]string, <-chan Event, error) {
+	children, _, zkEvents, err := z.client.ChildrenW(nodepath)
+	if err != nil {
+		return nil, nil, zkError(err)
+	}
+	events := make(chan Event, 1)
+	go func() {
+		e := <-zkEvents
+		events <- Event{Type: zkEventTypes[e.Type], Path: e.Path, Err: e.Err}
+	}()
+	return children, events, nil
 }
 
-// #### PRIVATE METHODS ####
-
-func (zkdao *ZkDAO) createOrSet(nodepath string, data []byte, flags int32, acl []zk.ACL) (string, error) {
-	exists,stat,_ := zkdao.client.Exists(nodepath)
-	if exists {
-		oldData,_,_ := zkdao.client.Get(nodepath)
-		if bytes.Compare(oldData, data) != 0 {
-			_, err2 := zkdao.client.Set(nodepath, data, stat.Version)
-			return "", err2
-		}
-	} else {
-		return zkdao.client.Create(nodepath, data, flags, acl)
-	}
-	return "", nil
+var zkEventTypes = map[zk.EventType]EventType{
+	zk.EventNodeCreated:         EventNodeCreated,
+	zk.EventNodeDeleted:         EventNodeDeleted,
+	zk.EventNodeDataChanged:     EventNodeDataChanged,
+	zk.EventNodeChildrenChanged: EventNodeChildrenChanged,
+	zk.EventNotWatching:         EventNotWatching,
 }
 
-func (zkdao *ZkDAO) createWithParents(nodepath string, data []byte, flags int32, acl []zk.ACL) (string, error) {
-	parent := path.Dir(nodepath)
-	if parent == "." {
-		return "", nil
-	}
-	exists, _, err := zkdao.client.Exists(parent)
-	if err != nil {
-		return "", err
-	}
-	if !exists {
-		s, err := zkdao.createWithParents(parent, data, flags, acl)
-		if err != nil {
-			return s, err
-		}
-	}
-	return zkdao.client.Create(nodepath, data, flags, acl)
+func (z *zkNodes) close() {
+	z.client.Close()
 }
@@ -0,0 +1,107 @@
+package data
+
+import (
+	"github.com/samuel/go-zookeeper/zk"
+	"reflect"
+	"testing"
+)
+
+// permsOf is the permissions the ACL gives to the id
+func permsOf(acl []zk.ACL, scheme, id string) int32 {
+	for _, entry := range acl {
+		if entry.Scheme == scheme && entry.ID == id {
+			return entry.Perms
+		}
+	}
+	return 0
+}
+
+// TestZkACL checks the permissions of the principals on the nodes
+func TestZkACL(t *testing.T) {
+	nodes := &zkNodes{auth: ZkAuth{User: "server", Password: "secret",
+		Admins: []string{"ops:b3Bz"}, Agents: []string{"a01:YTAx", "a02:YTAy"}}}
+	user := zk.DigestACL(zk.PermAll, "server", "secret")[0].ID
+	const shared = zk.PermRead | zk.PermCreate
+	tests := []struct {
+		nodepath string
+		// The permissions of the first and the second agent
+		a01, a02 int32
+	}{
+		{"/maestro", 0, 0},
+		{"/maestro/d01/config/processes/web", 0, 0},
+		{"/maestro/d01/config/agents/a01", 0, 0},
+		{"/maestro/d01/runtime", 0, 0},
+		{"/maestro/d01/runtime/agents", shared, shared},
+		{"/maestro/d01/runtime/agents/a01", zk.PermAll, 0},
+		{"/maestro/d01/runtime/agents/a01/eph", zk.PermAll, 0},
+		{"/maestro/d01/runtime/agents/a02/processes/web-0/admin_state", 0, zk.PermAll},
+		{"/maestro/d01/runtime/agents/a0", 0, 0},
+		{"/maestro/d01/runtime/agents/a011", 0, 0},
+		{"/maestro/d01/runtime/locks", shared, shared},
+		{"/maestro/d01/runtime/locks/web", shared, shared},
+		{"/maestro/d01/runtime/locks/web/a02", 0, zk.PermAll},
+		{"/maestro/d01/runtime/locks/web/a01/lock-0000000001", zk.PermAll, 0},
+		{"/maestro/d01/runtime/scheduler/s01/lock-0000000001", 0, 0},
+		{"/maestro/d01/runtime/other/a01", 0, 0},
+	}
+	for _, test := range tests {
+		acl := nodes.acl(test.nodepath)
+		if perms := permsOf(acl, "world", "anyone"); perms != zk.PermRead {
+			t.Errorf("Node '%s': everyone has permissions %d", test.nodepath, perms)
+		}
+		if permsOf(acl, "digest", user) != zk.PermAll || permsOf(acl, "digest", "ops:b3Bz") != zk.PermAll {
+			t.Errorf("Node '%s': the user or the admins cannot do everything: %v", test.nodepath, acl)
+		}
+		if perms := permsOf(acl, "digest", "a01:YTAx"); perms != test.a01 {
+			t.Errorf("Node '%s': got permissions %d for a01, want %d", test.nodepath, perms, test.a01)
+		}
+		if perms := permsOf(acl, "digest", "a02:YTAy"); perms != test.a02 {
+			t.Errorf("Node '%s': got permissions %d for a02, want %d", test.nodepath, perms, test.a02)
+		}
+	}
+
+	// Without a user every node is open
+	open := &zkNodes{}
+	if acl := open.acl("/maestro/d01/runtime/agents/a01"); !reflect.DeepEqual(acl, zk.WorldACL(zk.PermAll)) {
+		t.Errorf("Got ACL %v without a user", acl)
+	}
+}
+
+// TestParseZkAddress checks the servers and the credentials of zk:// store
+// addresses
+func TestParseZkAddress(t *testing.T) {
+	t.Setenv(STORE_PASSWORD_ENV, "from-env")
+	tests := []struct {
+		address string
+		servers []string
+		auth    ZkAuth
+		valid   bool
+	}{
+		{"localhost:2181", []string{"localhost:2181"}, ZkAuth{}, true},
+		{"zk1:2181,zk2:2181", []string{"zk1:2181", "zk2:2181"}, ZkAuth{}, true},
+		{"server:secret@zk1:2181", []string{"zk1:2181"}, ZkAuth{User: "server", Password: "secret"}, true},
+		{"server@zk1:2181", []string{"zk1:2181"}, ZkAuth{User: "server", Password: "from-env"}, true},
+		{"ser%40ver:p%3Ass@zk1:2181", []string{"zk1:2181"}, ZkAuth{User: "ser@ver", Password: "p:ss"}, true},
+		{"a@b:pw@zk1:2181", []string{"zk1:2181"}, ZkAuth{User: "a@b", Password: "pw"}, true},
+		{"server:pw@zk1:2181,zk2:2181?admins=ops:b3Bz,%20&agents=a01:YTAx,a02:YTAy",
+			[]string{"zk1:2181", "zk2:2181"},
+			ZkAuth{User: "server", Password: "pw", Admins: []string{"ops:b3Bz"}, Agents: []string{"a01:YTAx", "a02:YTAy"}}, true},
+		{"zk1:2181?agents=a01:YTAx", nil, ZkAuth{}, false},
+		{"server:pw@zk1:2181?agents=a01", nil, ZkAuth{}, false},
+		{"server:pw@zk1:2181?admins=%zz", nil, ZkAuth{}, false},
+		{"ser%zzver:pw@zk1:2181", nil, ZkAuth{}, false},
+	}
+	for _, test := range tests {
+		servers, auth, err := parseZkAddress(test.address)
+		if (err == nil) != test.valid {
+			t.Errorf("Address '%s': got error %v, want valid %v", test.address, err, test.valid)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if !reflect.DeepEqual(servers, test.servers) || !reflect.DeepEqual(auth, test.auth) {
+			t.Errorf("Address '%s': got %v %+v, want %v %+v", test.address, servers, auth, test.servers, test.auth)
+		}
+	}
+}
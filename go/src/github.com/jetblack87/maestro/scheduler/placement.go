@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/jetblack87/maestro/data"
+	"log"
+	"sort"
+)
+
+// assignment is the node under config/agents/<agent>/processes that assigns
+// a process to an agent
+type assignment struct {
+	agent string
+	node  string
+}
+
+// schedule assigns the scheduled processes of the domain to live agents,
+// moving them off the agents that died or are no longer eligible. It returns
+// the live agents by name.
+func schedule(domainPath string) map[string]data.Agent {
+	config, err := store.LoadStaticConfig(data.PathToKey(domainPath+"/config"), false)
+	if err != nil {
+		log.Println("Error loading the configuration:\n" + err.Error())
+		return nil
+	}
+	liveAgents := loadLiveAgents(domainPath, config)
+
+	// The load of an agent is the number of process instances assigned to it,
+	// an assignment runs the definition named by its ProcessClass whatever
+	// the name of its node is
+	instances := make(map[string]int)
+	for _, definition := range config.Processes {
+		instances[domainPath+"/config/processes/"+definition.Name] = data.InstanceCount(definition)
+	}
+	load := make(map[string]int)
+	assignments := make(map[string][]assignment)
+	for _, agent := range config.Agents {
+		for _, process := range agent.Processes {
+			load[agent.Name] += instances[process.ProcessClass]
+			assignments[process.ProcessClass] = append(assignments[process.ProcessClass], assignment{agent.Name, process.Name})
+		}
+	}
+
+	for _, definition := range config.Processes {
+		if !definition.Placement.Scheduled {
+			continue
+		}
+		class := domainPath + "/config/processes/" + definition.Name
+		placed := false
+		for _, a := range assignments[class] {
+			agent, live := liveAgents[a.agent]
+			if !placed && live && eligible(definition.Placement, agent) {
+				placed = true
+				continue
+			}
+			log.Printf("Removing process '%s' from agent '%s'\n", a.node, a.agent)
+			err := store.RemoveRecursive(domainPath + "/config/agents/" + a.agent + "/processes/" + a.node)
+			if err != nil {
+				log.Printf("Failed to remove process '%s' from agent '%s': %s\n", a.node, a.agent, err.Error())
+				continue
+			}
+			load[a.agent] -= instances[class]
+		}
+		if placed {
+			continue
+		}
+
+		best := ""
+		for _, agent := range sortedAgents(liveAgents) {
+			if eligible(definition.Placement, agent) && (best == "" || load[agent.Name] < load[best]) {
+				best = agent.Name
+			}
+		}
+		if best == "" {
+			log.Printf("No live agent is eligible to run process '%s'\n", definition.Name)
+			continue
+		}
+		log.Printf("Assigning process '%s' to agent '%s'\n", definition.Name, best)
+		err := store.UpdateProcess(data.PathToKey(domainPath+"/config/agents/"+best+"/processes/"+definition.Name),
+			data.Process{Pid: -1, ProcessClass: class}, false)
+		if err != nil {
+			log.Printf("Failed to assign process '%s' to agent '%s': %s\n", definition.Name, best, err.Error())
+			continue
+		}
+		load[best] += instances[class]
+	}
+	return liveAgents
+}
+
+// loadLiveAgents loads the runtime nodes of the agents whose ephemeral node
+// exists, the class of an agent is taken from its configuration
+func loadLiveAgents(domainPath string, config data.StaticConfig) map[string]data.Agent {
+	classes := make(map[string]string)
+	for _, agent := range config.Agents {
+		classes[agent.Name] = agent.AgentClass
+	}
+	agents := make(map[string]data.Agent)
+	runtime, err := store.LoadRuntimeConfig(data.PathToKey(domainPath+"/runtime"), false)
+	if err != nil {
+		log.Println("Error loading the runtime configuration:\n" + err.Error())
+		return agents
+	}
+	for _, agent := range runtime.Agents {
+		if agent.Eph == "" {
+			continue
+		}
+		agent.AgentClass = classes[agent.Name]
+		agents[agent.Name] = agent
+	}
+	return agents
+}
+
+// eligible tells whether the placement allows the process on the agent
+func eligible(placement data.Placement, agent data.Agent) bool {
+	if placement.AgentClass != "" && placement.AgentClass != agent.AgentClass {
+		return false
+	}
+	if placement.OS != "" && placement.OS != agent.OS {
+		return false
+	}
+	if len(placement.Agents) == 0 {
+		return true
+	}
+	for _, name := range placement.Agents {
+		if name == agent.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedAgents orders the agents by name, so that ties go to the same agent
+func sortedAgents(agents map[string]data.Agent) []data.Agent {
+	var sorted []data.Agent
+	for _, agent := range agents {
+		sorted = append(sorted, agent)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
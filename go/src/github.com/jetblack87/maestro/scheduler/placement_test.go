@@ -0,0 +1,159 @@
+package main
+
+import (
+	"github.com/jetblack87/maestro/data"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const TEST_DOMAIN = "/maestro/d01"
+
+// An agent of the test domain
+type testAgent struct {
+	name     string
+	class    string
+	os       string
+	live     bool
+	assigned []string
+}
+
+// setupDomain creates the agents and the process definitions of the test
+// domain in a new memory store
+func setupDomain(t *testing.T, agents []testAgent, processes []data.Process) {
+	t.Helper()
+	store = data.NewMemoryStore()
+	for _, process := range processes {
+		err := store.UpdateProcess(data.PathToKey(TEST_DOMAIN+"/config/processes/"+process.Name), process, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, agent := range agents {
+		agentPath := TEST_DOMAIN + "/config/agents/" + agent.name
+		err := store.UpdateAgent(data.PathToKey(agentPath), data.Agent{Name: agent.name, AgentClass: agent.class}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range agent.assigned {
+			err = store.UpdateProcess(data.PathToKey(agentPath+"/processes/"+name),
+				data.Process{Pid: -1, ProcessClass: TEST_DOMAIN + "/config/processes/" + name}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !agent.live {
+			continue
+		}
+		runtimePath := TEST_DOMAIN + "/runtime/agents/" + agent.name
+		err = store.UpdateAgent(data.PathToKey(runtimePath), data.Agent{Name: agent.name, OS: agent.os}, false)
+		if err == nil {
+			_, err = store.CreateEphemeral(runtimePath+"/eph", []byte("I am alive"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// assignedProcesses returns the names of the processes assigned to each agent
+func assignedProcesses(t *testing.T) map[string][]string {
+	t.Helper()
+	config, err := store.LoadStaticConfig(data.PathToKey(TEST_DOMAIN+"/config"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assigned := make(map[string][]string)
+	for _, agent := range config.Agents {
+		for _, process := range agent.Processes {
+			assigned[agent.Name] = append(assigned[agent.Name], process.Name)
+		}
+		sort.Strings(assigned[agent.Name])
+	}
+	return assigned
+}
+
+func scheduled(name string, instances int) data.Process {
+	return data.Process{Name: name, Command: "sleep", Instances: instances, Placement: data.Placement{Scheduled: true}}
+}
+
+// TestSchedule checks where the scheduled processes are placed
+func TestSchedule(t *testing.T) {
+	web := scheduled("web", 1)
+	big := scheduled("big", 3)
+	linux := scheduled("web", 1)
+	linux.Placement.OS = "linux"
+	batch := scheduled("web", 1)
+	batch.Placement.AgentClass = "batch"
+	pinned := scheduled("web", 1)
+	pinned.Placement.Agents = []string{"a02"}
+	manual := data.Process{Name: "manual", Command: "sleep"}
+	tests := []struct {
+		name      string
+		agents    []testAgent
+		processes []data.Process
+		want      map[string][]string
+	}{
+		{"ties go to the first agent by name",
+			[]testAgent{{name: "a02", live: true}, {name: "a01", live: true}},
+			[]data.Process{web},
+			map[string][]string{"a01": {"web"}}},
+		{"least loaded agent",
+			[]testAgent{{name: "a01", live: true, assigned: []string{"big"}}, {name: "a02", live: true}},
+			[]data.Process{big, web},
+			map[string][]string{"a01": {"big"}, "a02": {"web"}}},
+		{"load counts instances",
+			[]testAgent{{name: "a01", live: true, assigned: []string{"big"}}, {name: "a02", live: true, assigned: []string{"manual", "other"}}},
+			[]data.Process{big, manual, scheduled("other", 1), web},
+			map[string][]string{"a01": {"big"}, "a02": {"manual", "other", "web"}}},
+		{"down agents are skipped",
+			[]testAgent{{name: "a01"}, {name: "a02", live: true, assigned: []string{"big"}}},
+			[]data.Process{big, web},
+			map[string][]string{"a02": {"big", "web"}}},
+		{"moved off a down agent",
+			[]testAgent{{name: "a01", assigned: []string{"web"}}, {name: "a02", live: true}},
+			[]data.Process{web},
+			map[string][]string{"a02": {"web"}}},
+		{"kept on a live agent",
+			[]testAgent{{name: "a01", live: true}, {name: "a02", live: true, assigned: []string{"web"}}},
+			[]data.Process{web},
+			map[string][]string{"a02": {"web"}}},
+		{"extra assignments are removed",
+			[]testAgent{{name: "a01", live: true, assigned: []string{"web"}}, {name: "a02", live: true, assigned: []string{"web"}}},
+			[]data.Process{web},
+			map[string][]string{"a01": {"web"}}},
+		{"unscheduled processes are left alone",
+			[]testAgent{{name: "a01", assigned: []string{"manual"}}, {name: "a02", live: true}},
+			[]data.Process{manual},
+			map[string][]string{"a01": {"manual"}}},
+		{"os",
+			[]testAgent{{name: "a01", live: true, os: "windows"}, {name: "a02", live: true, os: "linux"}},
+			[]data.Process{linux},
+			map[string][]string{"a02": {"web"}}},
+		{"agent class",
+			[]testAgent{{name: "a01", live: true, assigned: []string{"web"}}, {name: "a02", live: true, class: "batch"}},
+			[]data.Process{batch},
+			map[string][]string{"a02": {"web"}}},
+		{"listed agents",
+			[]testAgent{{name: "a01", live: true}, {name: "a02", live: true, assigned: []string{"big"}}},
+			[]data.Process{big, pinned},
+			map[string][]string{"a02": {"big", "web"}}},
+		{"no eligible agent",
+			[]testAgent{{name: "a01", live: true}, {name: "a02", class: "batch"}},
+			[]data.Process{batch},
+			map[string][]string{}},
+	}
+	for _, test := range tests {
+		setupDomain(t, test.agents, test.processes)
+		liveAgents := schedule(TEST_DOMAIN)
+		for _, agent := range test.agents {
+			if _, live := liveAgents[agent.name]; live != agent.live {
+				t.Errorf("%s: agent '%s' live %v, want %v", test.name, agent.name, live, agent.live)
+			}
+		}
+		got := assignedProcesses(t)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
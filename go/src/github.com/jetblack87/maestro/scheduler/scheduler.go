@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"github.com/jetblack87/maestro/data"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const APP_VERSION = "0.1"
+
+// The flag package provides a default help printer via -h switch
+var versionFlag *bool = flag.Bool("v", false, "Print the version number.")
+var zookeeper *string = flag.String("zookeeper", "localhost:2181", "The ZooKeeper connection string (defaults to 'localhost:2182').")
+var storeURL *string = flag.String("store", "", "The configuration store URL, e.g. 'zk://localhost:2181', 'etcd://localhost:2379' or 'file:///var/lib/maestro/maestro.db' (defaults to the -zookeeper connection).")
+var domainName *string = flag.String("domain", "", "REQUIRED: The name of the domain whose processes are scheduled.")
+var schedulerName *string = flag.String("name", "", "The name of this scheduler, shown in the leader node (defaults to the host name).")
+var interval *time.Duration = flag.Duration("interval", 30*time.Second, "How often the placement of all processes is checked, besides when agents come and go.")
+var logfilePath *string = flag.String("logfile", "stdout", "The path to the logfile.")
+
+var store data.Store
+
+func main() {
+	flag.Parse() // Scan the arguments list
+
+	// Setup logging
+	if *logfilePath != "stdout" {
+		f, err := os.OpenFile(*logfilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			log.Printf("error opening file: %v", err)
+		}
+		defer f.Close()
+		log.SetOutput(f)
+	}
+
+	if *versionFlag {
+		log.Println("Version:", APP_VERSION)
+		os.Exit(0)
+	}
+	if *domainName == "" {
+		panic("-domain is required")
+	}
+	if *schedulerName == "" {
+		*schedulerName, _ = os.Hostname()
+	}
+
+	if *storeURL == "" {
+		*storeURL = "zk://" + *zookeeper
+	}
+	var err error
+	store, err = data.OpenStore(*storeURL)
+	if err != nil {
+		panic(err)
+	}
+
+	// Closing the store releases the leadership
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signalChannel
+		log.Println("Received signal to end")
+		store.Close()
+		os.Exit(0)
+	}()
+
+	domainPath := "/maestro/" + *domainName
+	err = store.UpdateStaticConfig(data.PathToKey(domainPath+"/config"), data.StaticConfig{}, false)
+	if err != nil {
+		panic(err)
+	}
+	err = store.UpdateRuntimeConfig(data.PathToKey(domainPath+"/runtime"), data.RuntimeConfig{}, false)
+	if err != nil {
+		panic(err)
+	}
+
+	// Agents and processes that come and go trigger a placement, as do the
+	// ephemeral nodes of the agents
+	watchChannel := make(chan data.Event, 1)
+	watched := make(map[string]bool)
+	for _, nodepath := range []string{domainPath + "/runtime/agents", domainPath + "/config/processes"} {
+		err = store.WatchChildren(nodepath, watchChannel)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Only one scheduler of the domain places processes, the others wait to
+	// take over
+	leaderChan := make(chan bool, 1)
+	data.Elect(store, domainPath+"/runtime/scheduler", *schedulerName, leaderChan)
+	for !<-leaderChan {
+	}
+	log.Printf("Scheduling the processes of domain '%s'\n", *domainName)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		liveAgents := schedule(domainPath)
+		// Watch the agents that are alive, a watch ends when its agent dies
+		for name := range liveAgents {
+			ephPath := domainPath + "/runtime/agents/" + name + "/eph"
+			if watched[ephPath] {
+				continue
+			}
+			err := store.Watch(ephPath, watchChannel)
+			if err != nil {
+				log.Println("Failed to add watch to agent node:\n" + err.Error())
+				continue
+			}
+			watched[ephPath] = true
+		}
+		select {
+		case w := <-watchChannel:
+			if w.Type == data.EventNodeDeleted {
+				delete(watched, w.Path)
+			}
+		case <-ticker.C:
+		case <-leaderChan:
+			// Stop placing processes until the lock is acquired again
+			log.Println("No longer the scheduler of the domain, waiting to take over")
+			for !<-leaderChan {
+			}
+			log.Printf("Scheduling the processes of domain '%s'\n", *domainName)
+		}
+	}
+}
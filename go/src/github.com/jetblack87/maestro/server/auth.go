@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/jetblack87/maestro/data"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var authTokens *string = flag.String("auth-tokens", "", "A file of API tokens, one 'user:token' per line, sent as 'Authorization: Bearer <token>'.")
+var authUsers *string = flag.String("auth-users", "", "A file of users for HTTP basic authentication, one 'user:bcrypt hash' per line as written by 'htpasswd -B'.")
+var authRoles *string = flag.String("auth-roles", "", "A JSON file of the roles of the users by domain, e.g. {\"alice\":{\"d01\":\"operator\",\"*\":\"viewer\"}}. Required with authentication.")
+
+// The roles of the users, each role may do what the roles before it may do
+const (
+	ROLE_NONE = iota
+	// May read everything in the domain
+	ROLE_VIEWER
+	// May also turn processes on and off and run jobs
+	ROLE_OPERATOR
+	// May also change the configuration
+	ROLE_ADMIN
+)
+
+var roleNames = map[string]int{"viewer": ROLE_VIEWER, "operator": ROLE_OPERATOR, "admin": ROLE_ADMIN}
+
+// The domain name given roles on all of the domains
+const ALL_DOMAINS = "*"
+
+// Used to keep the name of the authenticated user in the request context
+type contextKey string
+
+const USER_KEY contextKey = "user"
+
+// authenticator identifies the user that sent a request with one method of
+// authentication
+type authenticator interface {
+	// authenticate returns the name of the user, "" when the request carries
+	// no credentials for the method, or an error when they are wrong
+	authenticate(r *http.Request) (string, error)
+	// challenge is the WWW-Authenticate header asking for the credentials,
+	// "" if there is none
+	challenge() string
+}
+
+// accessControl authenticates the requests and checks the roles of their
+// users, it is nil when authentication is disabled
+type accessControl struct {
+	authenticators []authenticator
+	roles          map[string]map[string]int
+}
+
+// newAccessControl loads the credentials and the roles given by the flags.
+// It returns nil when no method of authentication is configured.
+func newAccessControl(clientCAs bool) (*accessControl, error) {
+	ac := &accessControl{}
+	if clientCAs {
+		ac.authenticators = append(ac.authenticators, certAuthenticator{})
+	}
+	if *authTokens != "" {
+		tokens, err := loadCredentials(*authTokens)
+		if err != nil {
+			return nil, err
+		}
+		ac.authenticators = append(ac.authenticators, tokenAuthenticator{tokens: tokens})
+	}
+	if *authUsers != "" {
+		hashes, err := loadCredentials(*authUsers)
+		if err != nil {
+			return nil, err
+		}
+		ac.authenticators = append(ac.authenticators, &basicAuthenticator{hashes: hashes, verified: make(map[string][32]byte)})
+	}
+	if len(ac.authenticators) == 0 {
+		if *authRoles != "" {
+			return nil, errors.New("-auth-roles requires -auth-tokens, -auth-users or -tls-client-ca")
+		}
+		return nil, nil
+	}
+	if *authRoles == "" {
+		return nil, errors.New("-auth-roles is required with authentication")
+	}
+	roles, err := loadRoles(*authRoles)
+	if err != nil {
+		return nil, err
+	}
+	ac.roles = roles
+	return ac, nil
+}
+
+// loadCredentials reads a file of 'name:secret' lines, blank lines and lines
+// starting with '#' are skipped
+func loadCredentials(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	credentials := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("Malformed line in " + filename + ", expected 'name:secret'")
+		}
+		credentials[parts[0]] = parts[1]
+	}
+	return credentials, scanner.Err()
+}
+
+// loadRoles reads the JSON file of the roles of the users by domain
+func loadRoles(filename string) (map[string]map[string]int, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var names map[string]map[string]string
+	err = json.Unmarshal(content, &names)
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[string]map[string]int)
+	for user, domains := range names {
+		roles[user] = make(map[string]int)
+		for domain, name := range domains {
+			role, ok := roleNames[name]
+			if !ok {
+				return nil, errors.New("Unknown role '" + name + "' of user '" + user + "'")
+			}
+			roles[user][domain] = role
+		}
+	}
+	return roles, nil
+}
+
+// role is the role of the user in the domain, the greater of its role in
+// the domain and its role in all of the domains
+func (ac *accessControl) role(user, domain string) int {
+	role := ac.roles[user][ALL_DOMAINS]
+	if ac.roles[user][domain] > role {
+		role = ac.roles[user][domain]
+	}
+	return role
+}
+
+// authenticate is the user that sent the request, found by the first method
+// for which the request has credentials
+func (ac *accessControl) authenticate(r *http.Request) (string, error) {
+	for _, a := range ac.authenticators {
+		user, err := a.authenticate(r)
+		if err != nil || user != "" {
+			return user, err
+		}
+	}
+	return "", errors.New("No credentials")
+}
+
+// authorized wraps the handler so that it only serves the requests of users
+// whose role allows them, answering 401 to unauthenticated requests and 403
+// to the others
+func authorized(ac *accessControl, handler http.Handler) http.Handler {
+	if ac == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Preflight requests of browsers carry no credentials
+		if r.Method == "OPTIONS" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		user, err := ac.authenticate(r)
+		if err != nil {
+			for _, a := range ac.authenticators {
+				if challenge := a.challenge(); challenge != "" {
+					w.Header().Add("WWW-Authenticate", challenge)
+				}
+			}
+			writeError(w, http.StatusUnauthorized, "Authentication required", err)
+			return
+		}
+		domain, required, err := requiredRole(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Bad request", err)
+			return
+		}
+		if ac.role(user, domain) < required {
+			writeError(w, http.StatusForbidden, "User '"+user+"' is not allowed to "+r.Method+" "+r.URL.Path, nil)
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), USER_KEY, user)))
+	})
+}
+
+// requiredRole is the domain the request is about and the role it requires
+// in the domain. Requests whose path is not valid require no role, they are
+// rejected by the handlers.
+func requiredRole(r *http.Request) (string, int, error) {
+	if r.URL.Path == "/events" {
+		return r.URL.Query().Get("domain"), ROLE_VIEWER, nil
+	}
+	nodepath, action := requestPath(r)
+	if !validNodePath(nodepath) {
+		return "", ROLE_NONE, nil
+	}
+	domain := ""
+	if nodepath != ROOT_PATH {
+		domain = strings.Split(strings.TrimPrefix(nodepath, ROOT_PATH+"/"), "/")[0]
+	}
+	switch {
+	case r.Method == "GET" && nodepath == ROOT_PATH:
+		// Only the domains the user may view are listed
+		return "", ROLE_NONE, nil
+	case r.Method == "GET":
+		return domain, ROLE_VIEWER, nil
+	case nodepath == ROOT_PATH:
+		// Only an admin of all of the domains may create one with POST
+		return ALL_DOMAINS, ROLE_ADMIN, nil
+	case action == "run":
+		return domain, ROLE_OPERATOR, nil
+	case r.Method == "PATCH" && runtimeProcessRegexp.MatchString(nodepath):
+		adminStateOnly, err := patchesAdminStateOnly(r)
+		if err != nil {
+			return domain, ROLE_ADMIN, err
+		}
+		if adminStateOnly {
+			return domain, ROLE_OPERATOR, nil
+		}
+	}
+	return domain, ROLE_ADMIN, nil
+}
+
+// requestPath is the node path the request is about and the action asked for
+// on it, the way the handlers find them
+func requestPath(r *http.Request) (string, string) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/domains/"):
+		readable := strings.TrimPrefix(r.URL.Path, "/domains/")
+		if keyPath := data.KeyToPath(readable); underRoot(keyPath) {
+			return keyPath, ""
+		}
+		return resolvePath(readable)
+	case strings.HasPrefix(r.URL.Path, "/agents/"):
+		return data.KeyToPath(strings.TrimPrefix(r.URL.Path, "/agents/")), ""
+	case strings.HasPrefix(r.URL.Path, "/processes/"):
+		key := strings.TrimPrefix(r.URL.Path, "/processes/")
+		if strings.HasSuffix(key, "/logs") && r.Method == "GET" {
+			return data.KeyToPath(strings.TrimSuffix(key, "/logs")), "logs"
+		}
+		if strings.HasSuffix(key, "/run") && r.Method == "POST" {
+			return data.KeyToPath(strings.TrimSuffix(key, "/run")), "run"
+		}
+		return data.KeyToPath(key), ""
+	}
+	return "", ""
+}
+
+// patchesAdminStateOnly tells whether the body of the PATCH request changes
+// nothing but the admin state, the body is kept for the handler
+func patchesAdminStateOnly(r *http.Request) (bool, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return false, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		// Malformed, the handler answers
+		return false, nil
+	}
+	for field := range fields {
+		// Fields are matched regardless of case when decoded
+		if !strings.EqualFold(field, "AdminState") && !strings.EqualFold(field, "Name") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// visibleDomains is the domains the user of the request may view
+func visibleDomains(r *http.Request, domains []data.Domain) []data.Domain {
+	if serverAccess == nil {
+		return domains
+	}
+	user, _ := r.Context().Value(USER_KEY).(string)
+	visible := []data.Domain{}
+	for _, domain := range domains {
+		if serverAccess.role(user, domain.Name) >= ROLE_VIEWER {
+			visible = append(visible, domain)
+		}
+	}
+	return visible
+}
+
+// certAuthenticator authenticates the clients by their certificate, the user
+// is the common name of a certificate verified against -tls-client-ca
+type certAuthenticator struct{}
+
+func (certAuthenticator) authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", nil
+	}
+	user := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if user == "" {
+		return "", errors.New("The client certificate has no common name")
+	}
+	return user, nil
+}
+
+func (certAuthenticator) challenge() string {
+	return ""
+}
+
+// tokenAuthenticator authenticates the clients by their API token
+type tokenAuthenticator struct {
+	// The tokens of the users, by user
+	tokens map[string]string
+}
+
+func (ta tokenAuthenticator) authenticate(r *http.Request) (string, error) {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return "", nil
+	}
+	token := []byte(strings.TrimPrefix(authorization, "Bearer "))
+	for user, expected := range ta.tokens {
+		if subtle.ConstantTimeCompare(token, []byte(expected)) == 1 {
+			return user, nil
+		}
+	}
+	return "", errors.New("Invalid API token")
+}
+
+func (tokenAuthenticator) challenge() string {
+	return `Bearer realm="maestro"`
+}
+
+// basicAuthenticator authenticates the clients with HTTP basic
+// authentication against bcrypt hashes of their passwords
+type basicAuthenticator struct {
+	hashes map[string]string
+	// The SHA-256 of the last password verified for each user, as bcrypt is
+	// slow on purpose
+	mutex    sync.Mutex
+	verified map[string][32]byte
+}
+
+func (ba *basicAuthenticator) authenticate(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", nil
+	}
+	hash, known := ba.hashes[user]
+	if !known {
+		return "", errors.New("Unknown user: " + user)
+	}
+	sum := sha256.Sum256([]byte(password))
+	ba.mutex.Lock()
+	last, cached := ba.verified[user]
+	ba.mutex.Unlock()
+	if cached && subtle.ConstantTimeCompare(sum[:], last[:]) == 1 {
+		return user, nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return "", errors.New("Invalid password for user: " + user)
+	}
+	ba.mutex.Lock()
+	ba.verified[user] = sum
+	ba.mutex.Unlock()
+	return user, nil
+}
+
+func (*basicAuthenticator) challenge() string {
+	return `Basic realm="maestro"`
+}
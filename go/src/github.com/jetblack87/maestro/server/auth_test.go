@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/jetblack87/maestro/data"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRequiredRole checks the domain and the role each request requires
+func TestRequiredRole(t *testing.T) {
+	instance := "/domains/d01/agents/a01/processes/web-0"
+	tests := []struct {
+		method string
+		url    string
+		body   string
+		domain string
+		role   int
+	}{
+		{"GET", "/domains/", "", "", ROLE_NONE},
+		{"GET", "/domains/d01", "", "d01", ROLE_VIEWER},
+		{"GET", instance + "/logs", "", "d01", ROLE_VIEWER},
+		{"GET", "/events?domain=d01", "", "d01", ROLE_VIEWER},
+		{"GET", "/domains/" + data.PathToKey("/maestro/d02/config/processes/web"), "", "d02", ROLE_VIEWER},
+		{"GET", "/processes/" + data.PathToKey("/maestro/d02/runtime/agents/a01/processes/web-0") + "/logs", "", "d02", ROLE_VIEWER},
+		{"POST", "/domains/", `{"Name":"d03"}`, ALL_DOMAINS, ROLE_ADMIN},
+		{"PUT", "/domains/d01", `{"Name":"d01"}`, "d01", ROLE_ADMIN},
+		{"DELETE", "/domains/d01/processes/web", "", "d01", ROLE_ADMIN},
+		{"POST", instance + "/run", "", "d01", ROLE_OPERATOR},
+		{"POST", "/processes/" + data.PathToKey("/maestro/d02/runtime/agents/a01/processes/web-0") + "/run", "", "d02", ROLE_OPERATOR},
+		{"PATCH", instance, `{"AdminState":"off"}`, "d01", ROLE_OPERATOR},
+		{"PATCH", instance, `{"adminState":"on","Name":"web-0"}`, "d01", ROLE_OPERATOR},
+		{"PATCH", instance, `{"AdminState":"on","Command":"sh"}`, "d01", ROLE_ADMIN},
+		{"PATCH", instance, `not json`, "d01", ROLE_ADMIN},
+		{"PATCH", "/domains/d01/processes/web", `{"AdminState":"off"}`, "d01", ROLE_ADMIN},
+		{"PATCH", "/domains/d01/config/agents/a01/processes/web", `{"AdminState":"off"}`, "d01", ROLE_ADMIN},
+		{"PATCH", "/processes/" + data.PathToKey("/maestro/d02/runtime/agents/a01/processes/web-0"), `{"AdminState":"off"}`, "d02", ROLE_OPERATOR},
+		{"GET", "/domains/d01/../d02", "", "", ROLE_NONE},
+		{"DELETE", "/domains/d01/unknown/web", "", "", ROLE_NONE},
+		{"DELETE", "/agents/" + data.PathToKey("/other/agent"), "", "", ROLE_NONE},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		domain, role, err := requiredRole(request)
+		if err != nil {
+			t.Errorf("%s %s: %s", test.method, test.url, err)
+			continue
+		}
+		if domain != test.domain || role != test.role {
+			t.Errorf("%s %s %s: got domain '%s' role %d, want '%s' %d", test.method, test.url, test.body, domain, role, test.domain, test.role)
+		}
+	}
+}
+
+// TestPatchesAdminStateOnly checks which bodies only change the admin state,
+// and that the body is left for the handler
+func TestPatchesAdminStateOnly(t *testing.T) {
+	tests := []struct {
+		body string
+		only bool
+	}{
+		{`{"AdminState":"off"}`, true},
+		{`{"ADMINSTATE":"on"}`, true},
+		{`{"AdminState":"on","Name":"web-0"}`, true},
+		{`{}`, true},
+		{`{"AdminState":"on","Env":["A=b"]}`, false},
+		{`{"Command":"sh"}`, false},
+		{`["AdminState"]`, false},
+		{``, false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("PATCH", "/domains/d01/agents/a01/processes/web-0", strings.NewReader(test.body))
+		only, err := patchesAdminStateOnly(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if only != test.only {
+			t.Errorf("Body '%s': got %v, want %v", test.body, only, test.only)
+		}
+		body, _ := ioutil.ReadAll(request.Body)
+		if string(body) != test.body {
+			t.Errorf("Body '%s': the handler reads '%s'", test.body, body)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jetblack87/maestro/data"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to wait for more changes to a domain before looking for events,
+// changes usually come a few nodes at a time
+const EVENT_SETTLE_DELAY = 500 * time.Millisecond
+
+// The number of events kept by domain for the clients that resume a stream
+const EVENT_HISTORY = 1000
+
+// The number of events waiting to be sent to a client, a client that falls
+// further behind is disconnected and has to resume its stream
+const EVENT_BUFFER = 100
+
+// How often a comment, or a ping over WebSocket, is sent on an idle stream
+const EVENT_KEEPALIVE = 30 * time.Second
+
+// How long to wait before watching a domain again after it was deleted
+const EVENT_RETRY_INTERVAL = 5 * time.Second
+
+// event is a change of the state of a domain, streamed by /events
+type event struct {
+	// The epoch of the stream of the domain and the number of the event,
+	// e.g. "1700000000-42"
+	ID string
+	// "oper_state" or "admin_state" when the state of an instance changes,
+	// "agent" when an agent comes up or goes down, "config" when a node of
+	// the configuration is created, updated or deleted and "reset" when the
+	// events after the ID a client resumes from are no longer known
+	Type   string
+	Domain string
+	// The canonical path of the node
+	Path string
+	// The new and previous states, empty when the instance does not exist,
+	// "up" or "down" for an agent and "created", "updated" or "deleted" for
+	// the configuration
+	Value    string
+	Previous string
+	Time     string
+}
+
+// snapshot is the state of a domain that events are made of, by the
+// canonical paths of the nodes
+type snapshot struct {
+	operStates  map[string]string
+	adminStates map[string]string
+	agents      map[string]bool
+	// The JSON of the process definitions, agents and assignments
+	config map[string]string
+}
+
+// eventHub watches a domain and sends the events of the domain to its
+// subscribers. Hubs are created by the first request for their domain and
+// removed once the domain is deleted and no request uses them.
+type eventHub struct {
+	store  data.Store
+	domain string
+	epoch  string
+	// The number of requests using the hub, guarded by hubsMutex
+	clients int
+	mutex   sync.Mutex
+	// The number of the last event, and the last events
+	last        int64
+	history     []event
+	subscribers map[chan event]bool
+}
+
+var hubs = make(map[string]*eventHub)
+var hubsMutex sync.Mutex
+
+// domainHub is the hub of the domain, started if needed. It returns
+// data.ErrNoNode when the domain does not exist and has no hub yet. The hub
+// must be released once the request is done with it.
+func domainHub(store data.Store, domain string) (*eventHub, error) {
+	hubsMutex.Lock()
+	defer hubsMutex.Unlock()
+	if hub, ok := hubs[domain]; ok {
+		hub.clients++
+		return hub, nil
+	}
+	hub := &eventHub{
+		store:       store,
+		domain:      domain,
+		epoch:       strconv.FormatInt(time.Now().Unix(), 10),
+		subscribers: make(map[chan event]bool),
+	}
+	watchChannel := make(chan data.Event, EVENT_BUFFER)
+	err := store.WatchTree(hub.rootPath(), watchChannel)
+	if err != nil {
+		if _, getErr := store.GetValue(hub.rootPath()); getErr == data.ErrNoNode {
+			return nil, data.ErrNoNode
+		}
+		return nil, err
+	}
+	current, err := hub.load()
+	if err != nil {
+		return nil, err
+	}
+	go hub.run(current, watchChannel)
+	hubs[domain] = hub
+	hub.clients++
+	return hub, nil
+}
+
+// release tells the hub that a request is done with it
+func (h *eventHub) release() {
+	hubsMutex.Lock()
+	defer hubsMutex.Unlock()
+	h.clients--
+}
+
+// remove removes the hub unless a request uses it, it returns whether the
+// hub was removed
+func (h *eventHub) remove() bool {
+	hubsMutex.Lock()
+	defer hubsMutex.Unlock()
+	if h.clients > 0 {
+		return false
+	}
+	if hubs[h.domain] == h {
+		delete(hubs, h.domain)
+	}
+	return true
+}
+
+func (h *eventHub) rootPath() string {
+	return ROOT_PATH + "/" + h.domain
+}
+
+// run turns the changes to the domain into events. It ends once the domain
+// has been deleted, its events have been sent and no request uses the hub.
+func (h *eventHub) run(current snapshot, watchChannel chan data.Event) {
+	// Changes made while the store was disconnected may not have fired
+	stateChannel := make(chan data.ConnectionState, 1)
+	h.store.WatchState(stateChannel)
+	watching := true
+	retry := time.NewTicker(EVENT_RETRY_INTERVAL)
+	defer retry.Stop()
+	var settled <-chan time.Time
+	for {
+		select {
+		case e := <-watchChannel:
+			if e.Type == data.EventNodeDeleted && e.Path == h.rootPath() {
+				watching = false
+			}
+			if settled == nil {
+				settled = time.After(EVENT_SETTLE_DELAY)
+			}
+		case state := <-stateChannel:
+			if state == data.StateConnected && settled == nil {
+				settled = time.After(EVENT_SETTLE_DELAY)
+			}
+		case <-retry.C:
+			if watching {
+				continue
+			}
+			// The domain may have been created again
+			if h.store.WatchTree(h.rootPath(), watchChannel) == nil {
+				watching = true
+				if settled == nil {
+					settled = time.After(EVENT_SETTLE_DELAY)
+				}
+			} else if settled == nil && h.remove() {
+				log.Printf("Domain '%s' was deleted, no longer watching it for events\n", h.domain)
+				return
+			}
+		case <-settled:
+			settled = nil
+			next, err := h.load()
+			if err != nil {
+				log.Printf("Error loading domain '%s' for events: %s\n", h.domain, err)
+				continue
+			}
+			for _, e := range h.diff(current, next) {
+				h.publish(e)
+			}
+			current = next
+		}
+	}
+}
+
+// load takes a snapshot of the domain, which is empty once it is deleted
+func (h *eventHub) load() (snapshot, error) {
+	s := snapshot{
+		operStates:  make(map[string]string),
+		adminStates: make(map[string]string),
+		agents:      make(map[string]bool),
+		config:      make(map[string]string),
+	}
+	domain, err := h.store.LoadDomain(data.PathToKey(h.rootPath()), true)
+	if err == data.ErrNoNode {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	for _, agent := range domain.Runtime.Agents {
+		s.agents[canonicalPath(data.KeyToPath(agent.Key))] = agent.Eph != ""
+		for _, process := range agent.Processes {
+			processPath := canonicalPath(data.KeyToPath(process.Key))
+			s.operStates[processPath] = process.OperState
+			s.adminStates[processPath] = process.AdminState
+		}
+	}
+	for _, agent := range domain.Config.Agents {
+		for _, process := range agent.Processes {
+			s.config[canonicalPath(data.KeyToPath(process.Key))] = toJSON(process)
+		}
+		// The assignments are compared on their own
+		agent.Processes = nil
+		s.config[canonicalPath(data.KeyToPath(agent.Key))] = toJSON(agent)
+	}
+	for _, process := range domain.Config.Processes {
+		s.config[canonicalPath(data.KeyToPath(process.Key))] = toJSON(process)
+	}
+	return s, nil
+}
+
+// toJSON is the JSON of the value, or "" if it cannot be encoded
+func toJSON(value interface{}) string {
+	content, _ := json.Marshal(value)
+	return string(content)
+}
+
+// diff is the events that lead from one snapshot of the domain to the next
+func (h *eventHub) diff(previous, next snapshot) []event {
+	var events []event
+	for _, p := range unionKeys(previous.operStates, next.operStates) {
+		if previous.operStates[p] != next.operStates[p] {
+			events = append(events, event{Type: "oper_state", Path: p, Value: next.operStates[p], Previous: previous.operStates[p]})
+		}
+	}
+	for _, p := range unionKeys(previous.adminStates, next.adminStates) {
+		if previous.adminStates[p] != next.adminStates[p] {
+			events = append(events, event{Type: "admin_state", Path: p, Value: next.adminStates[p], Previous: previous.adminStates[p]})
+		}
+	}
+	for _, p := range unionKeys(boolStrings(previous.agents), boolStrings(next.agents)) {
+		if previous.agents[p] != next.agents[p] {
+			events = append(events, event{Type: "agent", Path: p, Value: upDown(next.agents[p]), Previous: upDown(previous.agents[p])})
+		}
+	}
+	for _, p := range unionKeys(previous.config, next.config) {
+		before, existed := previous.config[p]
+		after, exists := next.config[p]
+		switch {
+		case !existed:
+			events = append(events, event{Type: "config", Path: p, Value: "created"})
+		case !exists:
+			events = append(events, event{Type: "config", Path: p, Value: "deleted"})
+		case before != after:
+			events = append(events, event{Type: "config", Path: p, Value: "updated"})
+		}
+	}
+	return events
+}
+
+// unionKeys is the keys of both maps, sorted
+func unionKeys(a, b map[string]string) []string {
+	var keys []string
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func boolStrings(m map[string]bool) map[string]string {
+	result := make(map[string]string)
+	for key, value := range m {
+		result[key] = strconv.FormatBool(value)
+	}
+	return result
+}
+
+func upDown(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
+
+// publish numbers the event, keeps it and sends it to the subscribers
+func (h *eventHub) publish(e event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.last++
+	e.ID = h.epoch + "-" + strconv.FormatInt(h.last, 10)
+	e.Domain = h.domain
+	e.Time = time.Now().Format(time.RFC3339Nano)
+	h.history = append(h.history, e)
+	if len(h.history) > EVENT_HISTORY {
+		h.history = h.history[len(h.history)-EVENT_HISTORY:]
+	}
+	for subscriber := range h.subscribers {
+		select {
+		case subscriber <- e:
+		default:
+			log.Printf("Event stream of domain '%s' fell behind, disconnecting it\n", h.domain)
+			delete(h.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// subscribe returns the channel on which the events of the domain are sent,
+// which is closed if the subscriber falls behind, and the events to send
+// first: the events after lastID, or a "reset" event if they are not known
+func (h *eventHub) subscribe(lastID string) (chan event, []event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var replay []event
+	if lastID != "" {
+		first := h.last - int64(len(h.history)) + 1
+		last, err := strconv.ParseInt(strings.TrimPrefix(lastID, h.epoch+"-"), 10, 64)
+		if !strings.HasPrefix(lastID, h.epoch+"-") || err != nil || last < first-1 || last > h.last {
+			replay = append(replay, event{
+				ID:     h.epoch + "-" + strconv.FormatInt(h.last, 10),
+				Type:   "reset",
+				Domain: h.domain,
+				Path:   canonicalPath(h.rootPath()),
+				Time:   time.Now().Format(time.RFC3339Nano),
+			})
+		} else {
+			replay = append(replay, h.history[last-first+1:]...)
+		}
+	}
+	subscriber := make(chan event, EVENT_BUFFER)
+	h.subscribers[subscriber] = true
+	return subscriber, replay
+}
+
+func (h *eventHub) unsubscribe(subscriber chan event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.subscribers[subscriber] {
+		delete(h.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+type eventsHandler struct{ store data.Store }
+
+// ServeHTTP streams the events of a domain as Server-Sent Events, or over a
+// WebSocket when the request asks to upgrade
+func (eh eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("HTTP '%s' request for url '%s'", r.Method, r.URL)
+
+	setCORSHeaders(w, r, "GET, OPTIONS",
+		"Accept, Last-Event-ID, Cache-Control, X-CSRF-Token, Authorization")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET, OPTIONS")
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed: "+r.Method, nil)
+		return
+	}
+	if !storeConnected(eh.store, w) {
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if !validName(domain) {
+		writeError(w, http.StatusBadRequest, "The name of a domain is required", nil)
+		return
+	}
+	hub, err := domainHub(eh.store, domain)
+	if err == data.ErrNoNode {
+		writeError(w, http.StatusNotFound, "No such domain: "+domain, nil)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error occurred watching domain", err)
+		return
+	}
+	defer hub.release()
+	// Browsers resume a stream with the header, other clients may use the
+	// parameter
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+
+	if isWebSocket(r) {
+		serveWebSocket(hub, lastID, w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming is not supported", nil)
+		return
+	}
+	subscriber, replay := hub.subscribe(lastID)
+	defer hub.unsubscribe(subscriber)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range replay {
+		writeEvent(w, e)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(EVENT_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-subscriber:
+			if !ok {
+				return
+			}
+			writeEvent(w, e)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes the event in the Server-Sent Events format
+func writeEvent(w http.ResponseWriter, e event) {
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, toJSON(e))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"github.com/jetblack87/maestro/data"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newSnapshot() snapshot {
+	return snapshot{
+		operStates:  make(map[string]string),
+		adminStates: make(map[string]string),
+		agents:      make(map[string]bool),
+		config:      make(map[string]string),
+	}
+}
+
+// TestDiff checks the events made of two snapshots of a domain
+func TestDiff(t *testing.T) {
+	hub := &eventHub{domain: "d01"}
+	previous := newSnapshot()
+	previous.operStates["/domains/d01/agents/a01/processes/web"] = "on"
+	previous.operStates["/domains/d01/agents/a01/processes/db"] = "on"
+	previous.adminStates["/domains/d01/agents/a01/processes/web"] = "on"
+	previous.agents["/domains/d01/agents/a01"] = true
+	previous.config["/domains/d01/processes/web"] = `{"Name":"web"}`
+	previous.config["/domains/d01/processes/db"] = `{"Name":"db"}`
+	next := newSnapshot()
+	next.operStates["/domains/d01/agents/a01/processes/web"] = "failed"
+	next.operStates["/domains/d01/agents/a02/processes/cache"] = "waiting"
+	next.adminStates["/domains/d01/agents/a01/processes/web"] = "off"
+	next.agents["/domains/d01/agents/a01"] = false
+	next.agents["/domains/d01/agents/a02"] = true
+	next.config["/domains/d01/processes/web"] = `{"Name":"web","Instances":2}`
+	next.config["/domains/d01/processes/cache"] = `{"Name":"cache"}`
+
+	want := []event{
+		{Type: "oper_state", Path: "/domains/d01/agents/a01/processes/db", Value: "", Previous: "on"},
+		{Type: "oper_state", Path: "/domains/d01/agents/a01/processes/web", Value: "failed", Previous: "on"},
+		{Type: "oper_state", Path: "/domains/d01/agents/a02/processes/cache", Value: "waiting", Previous: ""},
+		{Type: "admin_state", Path: "/domains/d01/agents/a01/processes/web", Value: "off", Previous: "on"},
+		{Type: "agent", Path: "/domains/d01/agents/a01", Value: "down", Previous: "up"},
+		{Type: "agent", Path: "/domains/d01/agents/a02", Value: "up", Previous: "down"},
+		{Type: "config", Path: "/domains/d01/processes/cache", Value: "created"},
+		{Type: "config", Path: "/domains/d01/processes/db", Value: "deleted"},
+		{Type: "config", Path: "/domains/d01/processes/web", Value: "updated"},
+	}
+	got := hub.diff(previous, next)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got events:\n%v\nwant:\n%v", got, want)
+	}
+	if events := hub.diff(next, next); len(events) != 0 {
+		t.Errorf("Got events %v between equal snapshots", events)
+	}
+}
+
+// eventIDs is the IDs of the events, or "reset" for a reset event
+func eventIDs(events []event) []string {
+	var ids []string
+	for _, e := range events {
+		if e.Type == "reset" {
+			ids = append(ids, "reset")
+		} else {
+			ids = append(ids, e.ID)
+		}
+	}
+	return ids
+}
+
+// TestSubscribe checks the events replayed to a client resuming its stream
+func TestSubscribe(t *testing.T) {
+	hub := &eventHub{domain: "d01", epoch: "100", subscribers: make(map[chan event]bool)}
+	for i := 0; i < 3; i++ {
+		hub.publish(event{Type: "config"})
+	}
+	tests := []struct {
+		lastID string
+		want   []string
+	}{
+		{"", nil},
+		{"100-0", []string{"100-1", "100-2", "100-3"}},
+		{"100-2", []string{"100-3"}},
+		{"100-3", nil},
+		{"100-4", []string{"reset"}},
+		{"99-1", []string{"reset"}},
+		{"100-x", []string{"reset"}},
+		{"1", []string{"reset"}},
+	}
+	for _, test := range tests {
+		subscriber, replay := hub.subscribe(test.lastID)
+		hub.unsubscribe(subscriber)
+		if got := eventIDs(replay); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Resuming from '%s': got %v, want %v", test.lastID, got, test.want)
+		}
+	}
+
+	// The reset event carries the last ID, to resume from once the client
+	// has loaded the domain again
+	_, replay := hub.subscribe("99-1")
+	if replay[0].ID != "100-3" || replay[0].Path != "/domains/d01" {
+		t.Errorf("Got reset event %+v", replay[0])
+	}
+
+	// Events older than the history are no longer known
+	for i := 0; i < EVENT_HISTORY; i++ {
+		hub.publish(event{Type: "config"})
+	}
+	last := strconv.Itoa(3 + EVENT_HISTORY)
+	for lastID, want := range map[string][]string{
+		"100-1": {"reset"},
+		"100-3": eventIDs(hub.history),
+		"100-" + strconv.Itoa(2+EVENT_HISTORY): {"100-" + last},
+	} {
+		subscriber, replay := hub.subscribe(lastID)
+		hub.unsubscribe(subscriber)
+		if got := eventIDs(replay); !reflect.DeepEqual(got, want) {
+			t.Errorf("Resuming from '%s': got %d events, want %d", lastID, len(got), len(want))
+		}
+	}
+
+	// Subscribers receive the events published after they subscribe
+	subscriber, _ := hub.subscribe("")
+	defer hub.unsubscribe(subscriber)
+	hub.publish(event{Type: "agent"})
+	if e := <-subscriber; e.Type != "agent" || e.Domain != "d01" {
+		t.Errorf("Got event %+v", e)
+	}
+}
+
+// TestHubRemoved checks that the hub of a deleted domain is removed once no
+// request uses it
+func TestHubRemoved(t *testing.T) {
+	store := data.NewMemoryStore()
+	err := store.UpdateDomain(data.PathToKey(ROOT_PATH+"/d01"), data.Domain{Name: "d01"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub, err := domainHub(store, "d01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := domainHub(store, "d01")
+	if err != nil || other != hub {
+		t.Fatalf("Got another hub for the domain: %v", err)
+	}
+	other.release()
+	if hub.remove() {
+		t.Fatal("Removed a hub used by a request")
+	}
+
+	err = store.RemoveRecursive(ROOT_PATH + "/d01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.release()
+	deadline := time.Now().Add(2 * EVENT_RETRY_INTERVAL)
+	for {
+		hubsMutex.Lock()
+		_, ok := hubs["d01"]
+		hubsMutex.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The hub of the deleted domain was not removed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := domainHub(store, "d01"); err != data.ErrNoNode {
+		t.Errorf("Got error %v for the deleted domain, want %v", err, data.ErrNoNode)
+	}
+}
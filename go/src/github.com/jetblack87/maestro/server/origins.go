@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var corsOrigins *string = flag.String("cors-origins", "", "A comma separated list of the origins allowed to send cross-origin requests, e.g. 'https://ui.example.com'. Only same-origin requests are allowed when empty.")
+
+// allowedOrigin tells whether the request may be served given the origin of
+// the page that sent it: requests sent by browsers from other origins are only
+// allowed from the origins given to -cors-origins
+func allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Not sent by a browser, or sent by a page of the server
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	for _, allowed := range strings.Split(*corsOrigins, ",") {
+		if strings.TrimSpace(allowed) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// setCORSHeaders allows the origin of the request to send it with the
+// methods and headers, when the origin is allowed
+func setCORSHeaders(w http.ResponseWriter, r *http.Request, methods string, headers string) {
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !allowedOrigin(r) {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", headers)
+}
+
+// sameOriginChecked wraps the handler so that browsers cannot use the
+// credentials they keep for the server from the pages of other sites: the
+// requests of origins that are not allowed are answered 403, and requests
+// with a body or a content type must be JSON, which browsers only send to
+// other origins once they have been allowed by a preflight request. Requests
+// without a body, such as running a job, need no content type.
+func sameOriginChecked(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowedOrigin(r) {
+			writeError(w, http.StatusForbidden, "Origin not allowed: "+r.Header.Get("Origin"), nil)
+			return
+		}
+		hasBody := r.ContentLength != 0 || len(r.TransferEncoding) > 0 || r.Header.Get("Content-Type") != ""
+		if hasBody && (r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH") {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, "The body must be sent with 'Content-Type: application/json'", nil)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
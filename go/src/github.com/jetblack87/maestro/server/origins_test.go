@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestSameOriginChecked checks the requests refused for their origin or the
+// type of their body
+func TestSameOriginChecked(t *testing.T) {
+	allowed := *corsOrigins
+	*corsOrigins = "https://ui.example.com, https://other.example.com"
+	defer func() { *corsOrigins = allowed }()
+	handler := sameOriginChecked(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		method      string
+		origin      string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"GET", "", "", "", http.StatusOK},
+		{"GET", "http://maestro.example.com", "", "", http.StatusOK},
+		{"GET", "https://ui.example.com", "", "", http.StatusOK},
+		{"GET", "https://other.example.com", "", "", http.StatusOK},
+		{"GET", "https://evil.example.com", "", "", http.StatusForbidden},
+		{"DELETE", "https://evil.example.com", "", "", http.StatusForbidden},
+		{"PATCH", "", "application/json", `{"AdminState":"on"}`, http.StatusOK},
+		{"PATCH", "", "application/json; charset=utf-8", `{"AdminState":"on"}`, http.StatusOK},
+		{"PATCH", "", "", `{"AdminState":"on"}`, http.StatusUnsupportedMediaType},
+		{"PUT", "", "text/plain", `{"Name":"web"}`, http.StatusUnsupportedMediaType},
+		{"POST", "https://ui.example.com", "application/x-www-form-urlencoded", "a=b", http.StatusUnsupportedMediaType},
+		// Running a job has no body
+		{"POST", "", "", "", http.StatusOK},
+		{"POST", "https://ui.example.com", "", "", http.StatusOK},
+		// Forms have a content type even when they are empty
+		{"POST", "", "application/x-www-form-urlencoded", "", http.StatusUnsupportedMediaType},
+		{"POST", "https://evil.example.com", "", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "http://maestro.example.com/domains/d01", strings.NewReader(test.body))
+		request.Host = "maestro.example.com"
+		if test.origin != "" {
+			request.Header.Set("Origin", test.origin)
+		}
+		if test.contentType != "" {
+			request.Header.Set("Content-Type", test.contentType)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%s from '%s' with '%s' and body '%s': got status %d, want %d",
+				test.method, test.origin, test.contentType, test.body, recorder.Code, test.status)
+		}
+	}
+
+	// Chunked bodies have no length
+	request := httptest.NewRequest("PUT", "/domains/d01", strings.NewReader(`{"Name":"d01"}`))
+	request.ContentLength = -1
+	request.TransferEncoding = []string{"chunked"}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Chunked PUT without a content type: got status %d", recorder.Code)
+	}
+}
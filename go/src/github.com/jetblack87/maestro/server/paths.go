@@ -0,0 +1,192 @@
+package main
+
+import (
+	"github.com/jetblack87/maestro/data"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// The configuration is kept under this node, every key must resolve under it
+const ROOT_PATH = "/maestro"
+
+// The readable paths of the nodes under /domains/, the canonical paths:
+//
+//	/domains/<domain>                                    the domain
+//	/domains/<domain>/processes/<process>                a process definition
+//	/domains/<domain>/agents/<agent>                     a running agent
+//	/domains/<domain>/agents/<agent>/processes/<process> an instance it runs
+//	/domains/<domain>/config/agents/<agent>              the configuration of an agent
+//	/domains/<domain>/config/agents/<agent>/processes/<process>
+//	                                                     a process assigned to it
+//
+// Each of them, and the collection it is in, matches a node path below. The
+// first group is the domain and the second the rest of the readable path.
+var canonicalPaths = []struct {
+	nodeRegexp *regexp.Regexp
+	prefix     string
+}{
+	{regexp.MustCompile("^/maestro/([^/]+)()$"), ""},
+	{regexp.MustCompile("^/maestro/([^/]+)/config/processes(/[^/]+)?$"), "/processes"},
+	{regexp.MustCompile("^/maestro/([^/]+)/runtime/agents((/[^/]+)(/processes(/[^/]+)?)?)?$"), "/agents"},
+	{regexp.MustCompile("^/maestro/([^/]+)/config/agents((/[^/]+)(/processes(/[^/]+)?)?)?$"), "/config/agents"},
+}
+
+// canonicalPath is the readable path of the node or of the collection, or ""
+// when the node cannot be served
+func canonicalPath(nodepath string) string {
+	if !validNodePath(nodepath) {
+		return ""
+	}
+	if nodepath == ROOT_PATH {
+		return "/domains/"
+	}
+	for _, canonical := range canonicalPaths {
+		if match := canonical.nodeRegexp.FindStringSubmatch(nodepath); match != nil {
+			return "/domains/" + url.PathEscape(match[1]) + canonical.prefix + escapePath(match[2])
+		}
+	}
+	return ""
+}
+
+// escapePath escapes each segment of the path
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// resolvePath is the node path of a readable path, given as the part after
+// /domains/, and the action asked for on it: "logs" or "run" on an instance,
+// "" otherwise. The node path is "" when the readable path is not one of the
+// canonical paths or of their collections.
+func resolvePath(readable string) (string, string) {
+	readable = strings.TrimSuffix(readable, "/")
+	if readable == "" {
+		return ROOT_PATH, ""
+	}
+	segments := strings.Split(readable, "/")
+	nodepath := ROOT_PATH + "/" + segments[0]
+	rest := segments[1:]
+	if len(rest) > 0 {
+		switch rest[0] {
+		case "processes":
+			nodepath += "/config"
+		case "agents":
+			nodepath += "/runtime"
+		case "config":
+			nodepath += "/config"
+			rest = rest[1:]
+			if len(rest) == 0 || rest[0] != "agents" {
+				return "", ""
+			}
+		default:
+			return "", ""
+		}
+	}
+	action := ""
+	if len(rest) == 5 && rest[0] == "agents" && (rest[4] == "logs" || rest[4] == "run") && strings.HasSuffix(nodepath, "/runtime") {
+		action = rest[4]
+		rest = rest[:4]
+	}
+	if len(rest) > 0 {
+		nodepath += "/" + strings.Join(rest, "/")
+	}
+	if canonicalPath(nodepath) == "" {
+		return "", ""
+	}
+	return nodepath, action
+}
+
+// underRoot tells whether the path is under the root of the configuration,
+// or is the root
+func underRoot(nodepath string) bool {
+	return nodepath == ROOT_PATH || strings.HasPrefix(nodepath, ROOT_PATH+"/")
+}
+
+// validNodePath tells whether the path is a clean path under the root of the
+// configuration, so that a key cannot reach other nodes of the store
+func validNodePath(nodepath string) bool {
+	if nodepath == ROOT_PATH {
+		return true
+	}
+	if !strings.HasPrefix(nodepath, ROOT_PATH+"/") || path.Clean(nodepath) != nodepath {
+		return false
+	}
+	for _, segment := range strings.Split(strings.TrimPrefix(nodepath, ROOT_PATH+"/"), "/") {
+		if !validName(segment) {
+			return false
+		}
+	}
+	return true
+}
+
+// withLinks is the value with the Links of the nodes in it set to the
+// canonical paths of the nodes related to them
+func withLinks(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []data.Domain:
+		for i := range v {
+			v[i] = withLinks(v[i]).(data.Domain)
+		}
+	case []data.Agent:
+		for i := range v {
+			v[i] = withLinks(v[i]).(data.Agent)
+		}
+	case []data.Process:
+		for i := range v {
+			v[i] = withLinks(v[i]).(data.Process)
+		}
+	case data.Domain:
+		nodepath := data.KeyToPath(v.Key)
+		v.Links = map[string]string{
+			"self":      canonicalPath(nodepath),
+			"processes": canonicalPath(nodepath + "/config/processes"),
+			"agents":    canonicalPath(nodepath + "/runtime/agents"),
+			"config":    canonicalPath(nodepath + "/config/agents"),
+		}
+		withLinks(v.Config.Agents)
+		withLinks(v.Config.Processes)
+		withLinks(v.Runtime.Agents)
+		return v
+	case data.Agent:
+		nodepath := data.KeyToPath(v.Key)
+		domainPath := path.Dir(path.Dir(path.Dir(nodepath)))
+		v.Links = map[string]string{
+			"self":      canonicalPath(nodepath),
+			"domain":    canonicalPath(domainPath),
+			"processes": canonicalPath(nodepath + "/processes"),
+		}
+		if path.Base(path.Dir(path.Dir(nodepath))) == "runtime" {
+			v.Links["config"] = canonicalPath(domainPath + "/config/agents/" + v.Name)
+		} else {
+			v.Links["runtime"] = canonicalPath(domainPath + "/runtime/agents/" + v.Name)
+		}
+		withLinks(v.Processes)
+		return v
+	case data.Process:
+		nodepath := data.KeyToPath(v.Key)
+		v.Links = map[string]string{"self": canonicalPath(nodepath)}
+		parent := path.Dir(path.Dir(nodepath))
+		if path.Base(parent) == "config" {
+			v.Links["domain"] = canonicalPath(path.Dir(parent))
+			return v
+		}
+		v.Links["agent"] = canonicalPath(parent)
+		v.Links["domain"] = canonicalPath(path.Dir(path.Dir(path.Dir(parent))))
+		if definition := canonicalPath(v.ProcessClass); definition != "" {
+			v.Links["definition"] = definition
+		}
+		if runtimeProcessRegexp.MatchString(nodepath) {
+			v.Links["logs"] = v.Links["self"] + "/logs"
+			if v.Type == "oneshot" || v.Type == "cron" {
+				v.Links["run"] = v.Links["self"] + "/run"
+			}
+		}
+		return v
+	}
+	return value
+}
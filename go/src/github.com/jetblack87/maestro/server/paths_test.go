@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestResolvePath checks the node paths of the readable paths, and that
+// paths that are not canonical resolve to nothing
+func TestResolvePath(t *testing.T) {
+	tests := []struct {
+		readable string
+		nodepath string
+		action   string
+	}{
+		{"", "/maestro", ""},
+		{"d01", "/maestro/d01", ""},
+		{"d01/", "/maestro/d01", ""},
+		{"d01/processes", "/maestro/d01/config/processes", ""},
+		{"d01/processes/web", "/maestro/d01/config/processes/web", ""},
+		{"d01/agents", "/maestro/d01/runtime/agents", ""},
+		{"d01/agents/a01/processes/web-0", "/maestro/d01/runtime/agents/a01/processes/web-0", ""},
+		{"d01/agents/a01/processes/web-0/logs", "/maestro/d01/runtime/agents/a01/processes/web-0", "logs"},
+		{"d01/agents/a01/processes/web-0/run", "/maestro/d01/runtime/agents/a01/processes/web-0", "run"},
+		{"d01/config/agents/a01/processes/web", "/maestro/d01/config/agents/a01/processes/web", ""},
+		{"d01/processes/web/logs", "", ""},
+		{"d01/config/agents/a01/processes/web/run", "", ""},
+		{"d01/agents/a01/processes/web-0/logs/more", "", ""},
+		{"d01/config", "", ""},
+		{"d01/config/processes", "", ""},
+		{"d01/runtime/agents", "", ""},
+		{"d01/locks", "", ""},
+		{"..", "", ""},
+		{"d01/..", "", ""},
+		{"d01/../d02", "", ""},
+		{"d01/processes/..", "", ""},
+		{"d01/processes/../../d02/processes", "", ""},
+		{"d01/processes/.", "", ""},
+		{"./d01", "", ""},
+		{"/d01", "", ""},
+		{"d01//processes", "", ""},
+		{"d01/processes//web", "", ""},
+		{"d01/processes/web//", "", ""},
+	}
+	for _, test := range tests {
+		nodepath, action := resolvePath(test.readable)
+		if nodepath != test.nodepath || action != test.action {
+			t.Errorf("Path '%s': got '%s' '%s', want '%s' '%s'", test.readable, nodepath, action, test.nodepath, test.action)
+		}
+	}
+}
+
+// TestRequestPath checks that escaped slashes cannot make a segment reach
+// another node, and that other escapes are decoded
+func TestRequestPath(t *testing.T) {
+	tests := []struct {
+		url      string
+		nodepath string
+	}{
+		{"/domains/d01/processes/we%62", "/maestro/d01/config/processes/web"},
+		{"/domains/d%2001", "/maestro/d 01"},
+		{"/domains/d01/processes/a%2Fb", ""},
+		{"/domains/d01%2F..%2Fd02", ""},
+		{"/domains/d01/processes/%2E%2E", ""},
+		{"/domains/d01/agents/a01/processes/web-0%2Flogs", "/maestro/d01/runtime/agents/a01/processes/web-0"},
+	}
+	for _, test := range tests {
+		nodepath, _ := requestPath(httptest.NewRequest("GET", test.url, nil))
+		if nodepath != test.nodepath {
+			t.Errorf("URL '%s': got '%s', want '%s'", test.url, nodepath, test.nodepath)
+		}
+	}
+}
+
+// TestValidNodePath checks that only clean paths under the root are valid
+func TestValidNodePath(t *testing.T) {
+	tests := []struct {
+		nodepath string
+		valid    bool
+	}{
+		{"/maestro", true},
+		{"/maestro/d01", true},
+		{"/maestro/d01/config/processes/web", true},
+		{"/maestro/d01/runtime/locks/web/a01/lock-0000000001", true},
+		{"", false},
+		{"/", false},
+		{"maestro/d01", false},
+		{"/maestro/", false},
+		{"/maestro/d01/", false},
+		{"/maestro//d01", false},
+		{"/maestro/./d01", false},
+		{"/maestro/d01/..", false},
+		{"/maestro/d01/../../etc", false},
+		{"/maestro/..", false},
+		{"/maestros", false},
+		{"/maestros/d01", false},
+		{"/other/d01", false},
+	}
+	for _, test := range tests {
+		if valid := validNodePath(test.nodepath); valid != test.valid {
+			t.Errorf("Path '%s': got valid %v, want %v", test.nodepath, valid, test.valid)
+		}
+	}
+}
+
+// TestCanonicalPath checks the readable paths of the nodes, and that they
+// resolve back to the nodes
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		nodepath string
+		readable string
+	}{
+		{"/maestro", "/domains/"},
+		{"/maestro/d01", "/domains/d01"},
+		{"/maestro/d01/config/processes", "/domains/d01/processes"},
+		{"/maestro/d01/config/processes/web", "/domains/d01/processes/web"},
+		{"/maestro/d01/runtime/agents", "/domains/d01/agents"},
+		{"/maestro/d01/runtime/agents/a01", "/domains/d01/agents/a01"},
+		{"/maestro/d01/runtime/agents/a01/processes", "/domains/d01/agents/a01/processes"},
+		{"/maestro/d01/runtime/agents/a01/processes/web-0", "/domains/d01/agents/a01/processes/web-0"},
+		{"/maestro/d01/config/agents/a01/processes/web", "/domains/d01/config/agents/a01/processes/web"},
+		{"/maestro/d 01/config/processes/a?b", "/domains/d%2001/processes/a%3Fb"},
+		{"/maestro/d01/config", ""},
+		{"/maestro/d01/runtime", ""},
+		{"/maestro/d01/runtime/locks/web", ""},
+		{"/maestro/d01/config/processes/web/args", ""},
+		{"/maestro/d01/runtime/agents/a01/eph", ""},
+		{"/maestro/d01/../d02", ""},
+		{"/other", ""},
+	}
+	for _, test := range tests {
+		readable := canonicalPath(test.nodepath)
+		if readable != test.readable {
+			t.Errorf("Path '%s': got '%s', want '%s'", test.nodepath, readable, test.readable)
+			continue
+		}
+		if readable == "" || strings.Contains(readable, "%") {
+			continue
+		}
+		if nodepath, _ := resolvePath(strings.TrimPrefix(readable, "/domains/")); nodepath != test.nodepath {
+			t.Errorf("Path '%s': '%s' resolves to '%s'", test.nodepath, readable, nodepath)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/jetblack87/maestro/data"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// resourceType is a kind of node that can be read and written through the
+// API: domains, agents and processes. Nodes are addressed by their key, GET
+// and POST requests may address the key of a collection.
+type resourceType struct {
+	name string
+	// Match the paths of the nodes and of their collections
+	itemRegexp       *regexp.Regexp
+	collectionRegexp *regexp.Regexp
+	// decode unmarshals a request body, it returns the node and its name
+	decode func(body []byte) (interface{}, string, error)
+	load   func(store data.Store, key string) (interface{}, error)
+	// list loads the nodes of a collection
+	list   func(store data.Store, key string) (interface{}, error)
+	update func(store data.Store, key string, value interface{}) error
+	// The nodes below the node of each field that PATCH replaces when the
+	// field is given, including when it is given its zero value
+	fields map[string][]string
+}
+
+var domainResource = resourceType{
+	name:             "domain",
+	itemRegexp:       regexp.MustCompile("^/maestro/[^/]+$"),
+	collectionRegexp: regexp.MustCompile("^/maestro$"),
+	decode: func(body []byte) (interface{}, string, error) {
+		var domain data.Domain
+		err := json.Unmarshal(body, &domain)
+		return domain, domain.Name, err
+	},
+	load: func(store data.Store, key string) (interface{}, error) {
+		return store.LoadDomain(key, true)
+	},
+	list: func(store data.Store, key string) (interface{}, error) {
+		return store.LoadDomains(key, true)
+	},
+	update: func(store data.Store, key string, value interface{}) error {
+		return store.UpdateDomain(key, value.(data.Domain), true)
+	},
+}
+
+var agentResource = resourceType{
+	name:             "agent",
+	itemRegexp:       regexp.MustCompile("^/maestro/[^/]+/(config|runtime)/agents/[^/]+$"),
+	collectionRegexp: regexp.MustCompile("^/maestro/[^/]+/(config|runtime)/agents$"),
+	decode: func(body []byte) (interface{}, string, error) {
+		var agent data.Agent
+		err := json.Unmarshal(body, &agent)
+		return agent, agent.Name, err
+	},
+	load: func(store data.Store, key string) (interface{}, error) {
+		return store.LoadAgent(key, true)
+	},
+	list: func(store data.Store, key string) (interface{}, error) {
+		parent := path.Dir(data.KeyToPath(key))
+		if path.Base(parent) == "config" {
+			config, err := store.LoadStaticConfig(data.PathToKey(parent), true)
+			return config.Agents, err
+		}
+		runtime, err := store.LoadRuntimeConfig(data.PathToKey(parent), true)
+		return runtime.Agents, err
+	},
+	update: func(store data.Store, key string, value interface{}) error {
+		return store.UpdateAgent(key, value.(data.Agent), true)
+	},
+	fields: map[string][]string{
+		"Address":    {"address"},
+		"AgentClass": {"agent_class"},
+		"OS":         {"os"},
+	},
+}
+
+var processResource = resourceType{
+	name:             "process",
+	itemRegexp:       regexp.MustCompile("^/maestro/[^/]+/(config/processes|(config|runtime)/agents/[^/]+/processes)/[^/]+$"),
+	collectionRegexp: regexp.MustCompile("^/maestro/[^/]+/(config/processes|(config|runtime)/agents/[^/]+/processes)$"),
+	decode: func(body []byte) (interface{}, string, error) {
+		// The pid is only written when it is given
+		process := data.Process{Pid: -1}
+		err := json.Unmarshal(body, &process)
+		return process, process.Name, err
+	},
+	load: func(store data.Store, key string) (interface{}, error) {
+		return store.LoadProcess(key, true)
+	},
+	list: func(store data.Store, key string) (interface{}, error) {
+		parent := path.Dir(data.KeyToPath(key))
+		if path.Base(parent) == "config" {
+			config, err := store.LoadStaticConfig(data.PathToKey(parent), true)
+			return config.Processes, err
+		}
+		agent, err := store.LoadAgent(data.PathToKey(parent), true)
+		return agent.Processes, err
+	},
+	update: func(store data.Store, key string, value interface{}) error {
+		return store.UpdateProcess(key, value.(data.Process), true)
+	},
+	fields: map[string][]string{
+		"Type":          {"type"},
+		"Schedule":      {"schedule"},
+		"Overlap":       {"overlap"},
+		"Command":       {"command"},
+		"Arguments":     {"arguments"},
+		"Args":          {"args"},
+		"Env":           {"env"},
+		"ClearEnv":      {"clear_env"},
+		"WorkingDir":    {"working_dir"},
+		"User":          {"user"},
+		"Group":         {"group"},
+		"Groups":        {"groups"},
+		"Umask":         {"umask"},
+		"DependsOn":     {"depends_on"},
+		"ProcessClass":  {"process_class"},
+		"Singleton":     {"singleton"},
+		"Placement":     {"placement"},
+		"Instances":     {"instances"},
+		"Instance":      {"instance"},
+		"AdminState":    {"admin_state"},
+		"OperState":     {"oper_state"},
+		"Pid":           {"pid"},
+		"RestartPolicy": {"restart_policy"},
+		"UpdatePolicy":  {"update_policy"},
+		"Restarts":      {"restarts"},
+		// The exit is only stored along with its time
+		"ExitCode":     exitNodes,
+		"ExitSignal":   exitNodes,
+		"ExitReason":   exitNodes,
+		"LastExitTime": exitNodes,
+		"Strays":       exitNodes,
+		"StopSignal":   {"stop_signal"},
+		"StopTimeout":  {"stop_timeout"},
+		"StopCommand":  {"stop_command"},
+		"StopArgs":     {"stop_args"},
+		"HealthCheck":  {"health_check"},
+		"Resources":    {"resources"},
+		"Usage":        {"usage"},
+		"Health":       {"health"},
+		"Runs":         {"runs"},
+		"RunRequested": {"run_requested"},
+	},
+}
+
+var exitNodes = []string{"exit_code", "exit_signal", "exit_reason", "last_exit_time", "strays"}
+
+// Matches the runtime nodes of an agent, which the agent maintains
+var agentRuntimeRegexp = regexp.MustCompile("^(/maestro/[^/]+)/runtime/agents/([^/]+)(/.*)?$")
+
+// serveResource answers the requests on the nodes of the resource type:
+//
+// GET returns the node, or the nodes of a collection, POST on a collection
+// creates the node named in the body, PUT creates or replaces the node, PATCH
+// updates the fields given in the body and DELETE removes the node and
+// everything below it.
+func serveResource(store data.Store, rt resourceType, key string, w http.ResponseWriter, r *http.Request) {
+	nodepath := data.KeyToPath(key)
+	if !validNodePath(nodepath) {
+		writeError(w, http.StatusBadRequest, "The key must resolve to a node under "+ROOT_PATH, nil)
+		return
+	}
+	if r.Method == "GET" && rt.collectionRegexp.MatchString(nodepath) {
+		listResource(store, rt, key, w, r)
+		return
+	}
+	if r.Method == "POST" {
+		if !rt.collectionRegexp.MatchString(nodepath) {
+			writeError(w, http.StatusBadRequest, "The key of a collection of "+rt.name+"s is required", nil)
+			return
+		}
+	} else if !rt.itemRegexp.MatchString(nodepath) {
+		writeError(w, http.StatusBadRequest, "The key of a "+rt.name+" is required", nil)
+		return
+	}
+
+	var value interface{}
+	// The fields given in the body of a PATCH request
+	var given map[string]json.RawMessage
+	if r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Bad request", err)
+			return
+		}
+		log.Printf("Request for %s '%s' with body:\n%s\n", rt.name, nodepath, string(body))
+		var name string
+		value, name, err = rt.decode(body)
+		if err == nil && r.Method == "PATCH" {
+			err = json.Unmarshal(body, &given)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Malformed request", err)
+			return
+		}
+		if r.Method == "PATCH" && runtimeProcessRegexp.MatchString(nodepath) && !validAdminState(given) {
+			writeError(w, http.StatusBadRequest, "The AdminState of an instance must be 'on' or 'off'", nil)
+			return
+		}
+		if r.Method == "POST" {
+			if !validName(name) {
+				writeError(w, http.StatusBadRequest, "A valid name is required to create a "+rt.name, nil)
+				return
+			}
+			nodepath = nodepath + "/" + name
+			key = data.PathToKey(nodepath)
+		} else if name != "" && name != path.Base(nodepath) {
+			writeError(w, http.StatusBadRequest, "The name of a "+rt.name+" cannot be changed", nil)
+			return
+		}
+	}
+
+	_, err := rt.load(store, key)
+	exists := err == nil
+	if err != nil && err != data.ErrNoNode {
+		writeError(w, http.StatusInternalServerError, "Error occurred retrieving "+rt.name, err)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		if !exists {
+			writeError(w, http.StatusNotFound, "No such "+rt.name+": "+nodepath, nil)
+			return
+		}
+		writeResource(store, rt, key, http.StatusOK, w, r)
+		return
+	case "POST":
+		if exists {
+			writeError(w, http.StatusConflict, "The "+rt.name+" already exists: "+nodepath, nil)
+			return
+		}
+	case "PATCH", "DELETE":
+		if !exists {
+			writeError(w, http.StatusNotFound, "No such "+rt.name+": "+nodepath, nil)
+			return
+		}
+	}
+
+	// Only PATCH may change what a running agent maintains, such as the
+	// admin state of its processes
+	if r.Method != "PATCH" {
+		if agent := runningAgent(store, nodepath); agent != "" {
+			writeError(w, http.StatusConflict, "The "+rt.name+" is maintained by agent '"+agent+"', which is running", nil)
+			return
+		}
+	}
+
+	if r.Method == "DELETE" {
+		err = store.RemoveRecursive(nodepath)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Internal server error while trying to remove "+rt.name, err)
+			return
+		}
+		log.Printf("Removed %s '%s'\n", rt.name, nodepath)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// The node is written to a memory store first, so that a value that
+	// cannot be written is refused before anything is changed, and then the
+	// nodes that the value does not have are removed from the store
+	staged := data.NewMemoryStore()
+	defer staged.Close()
+	err = rt.update(staged, key, value)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "The "+rt.name+" cannot be written", err)
+		return
+	}
+	err = rt.update(store, key, value)
+	if err == nil && r.Method == "PUT" {
+		err = pruneNode(store, staged, nodepath)
+	}
+	if err == nil && r.Method == "PATCH" {
+		for _, node := range patchedNodes(rt, given) {
+			err = pruneNode(store, staged, nodepath+"/"+node)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Internal server error while trying to update "+rt.name, err)
+		return
+	}
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+		w.Header().Set("Location", canonicalPath(nodepath))
+	}
+	writeResource(store, rt, key, status, w, r)
+}
+
+// patchedNodes returns the nodes replaced by the fields given to PATCH. Field
+// names match case insensitively, as they do when the body is decoded.
+func patchedNodes(rt resourceType, given map[string]json.RawMessage) []string {
+	var nodes []string
+	for field := range given {
+		for name, fieldNodes := range rt.fields {
+			if strings.EqualFold(field, name) {
+				nodes = append(nodes, fieldNodes...)
+			}
+		}
+	}
+	return nodes
+}
+
+// validAdminState tells whether the AdminState given to PATCH, if any, is "on"
+// or "off". Clearing it would remove the node the agent watches.
+func validAdminState(given map[string]json.RawMessage) bool {
+	for field, value := range given {
+		if !strings.EqualFold(field, "AdminState") {
+			continue
+		}
+		var adminState string
+		if json.Unmarshal(value, &adminState) != nil || (adminState != "on" && adminState != "off") {
+			return false
+		}
+	}
+	return true
+}
+
+// pruneNode makes the node and the nodes below it in the store match those
+// in staged: it removes the nodes that staged does not have and sets the data
+// of the others to their data in staged
+func pruneNode(store data.Store, staged data.Store, nodepath string) error {
+	value, err := staged.GetValue(nodepath)
+	if err == data.ErrNoNode {
+		return store.RemoveRecursive(nodepath)
+	}
+	if err != nil {
+		return err
+	}
+	current, err := store.GetValue(nodepath)
+	if err == data.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, value) {
+		err = store.SetValue(nodepath, value)
+		if err != nil {
+			return err
+		}
+	}
+	children, err := store.Children(nodepath)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		err = pruneNode(store, staged, nodepath+"/"+child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeResource answers with the node as JSON
+func writeResource(store data.Store, rt resourceType, key string, status int, w http.ResponseWriter, r *http.Request) {
+	value, err := rt.load(store, key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error occurred retrieving "+rt.name, err)
+		return
+	}
+	writeJSON(withLinks(value), status, w, r)
+}
+
+// listResource answers with the nodes of the collection as JSON
+func listResource(store data.Store, rt resourceType, key string, w http.ResponseWriter, r *http.Request) {
+	nodepath := data.KeyToPath(key)
+	// The root of the configuration only exists once a domain has been created
+	_, err := store.GetValue(nodepath)
+	if err == data.ErrNoNode && nodepath != ROOT_PATH {
+		writeError(w, http.StatusNotFound, "No such collection: "+nodepath, nil)
+		return
+	}
+	if err != nil && err != data.ErrNoNode {
+		writeError(w, http.StatusInternalServerError, "Error occurred retrieving collection", err)
+		return
+	}
+	values, err := rt.list(store, key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error occurred retrieving collection", err)
+		return
+	}
+	if domains, ok := values.([]data.Domain); ok {
+		values = visibleDomains(r, domains)
+	}
+	// An empty collection is an empty array rather than null
+	if reflect.ValueOf(values).Len() == 0 {
+		values = []struct{}{}
+	}
+	writeJSON(withLinks(values), http.StatusOK, w, r)
+}
+
+// writeJSON answers with the value as JSON, indented when asked for
+func writeJSON(value interface{}, status int, w http.ResponseWriter, r *http.Request) {
+	var responseJson []byte
+	var err error
+	if r.URL.Query().Get(PRETTY_PRINT_PARAM) == "true" {
+		responseJson, err = json.MarshalIndent(value, "", "   ")
+	} else {
+		responseJson, err = json.Marshal(value)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error occurred encoding the response", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responseJson)
+}
+
+// writeError answers with the status and the message, which is logged along
+// with err if there is one
+func writeError(w http.ResponseWriter, status int, errMsg string, err error) {
+	w.WriteHeader(status)
+	w.Write([]byte(errMsg))
+	if err != nil {
+		log.Println(errMsg + "\n" + err.Error())
+	} else {
+		log.Println(errMsg)
+	}
+}
+
+// validName tells whether name can be the name of a node
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// runningAgent is the name of the running agent that maintains the node, or
+// "" if there is none. The runtime nodes of an agent belong to it while it
+// runs, and a domain to all of its agents.
+func runningAgent(store data.Store, nodepath string) string {
+	if match := agentRuntimeRegexp.FindStringSubmatch(nodepath); match != nil {
+		agent, err := store.LoadAgent(data.PathToKey(match[1]+"/runtime/agents/"+match[2]), false)
+		if err == nil && agent.Eph != "" {
+			return agent.Name
+		}
+		return ""
+	}
+	if domainResource.itemRegexp.MatchString(nodepath) {
+		runtime, err := store.LoadRuntimeConfig(data.PathToKey(nodepath+"/runtime"), false)
+		if err != nil {
+			return ""
+		}
+		for _, agent := range runtime.Agents {
+			if agent.Eph != "" {
+				return agent.Name
+			}
+		}
+	}
+	return ""
+}
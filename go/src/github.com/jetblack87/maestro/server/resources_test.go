@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/jetblack87/maestro/data"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestPatchAdminState checks the admin states PATCH accepts, an instance
+// keeps the node its agent watches
+func TestPatchAdminState(t *testing.T) {
+	instancePath := "/maestro/d01/runtime/agents/a01/processes/web-0"
+	definitionPath := "/maestro/d01/config/processes/web"
+	tests := []struct {
+		nodepath   string
+		body       string
+		status     int
+		adminState string
+	}{
+		{instancePath, `{"AdminState":"off"}`, http.StatusOK, "off"},
+		{instancePath, `{"adminstate":"on"}`, http.StatusOK, "on"},
+		{instancePath, `{"AdminState":""}`, http.StatusBadRequest, "on"},
+		{instancePath, `{"AdminState":"maybe"}`, http.StatusBadRequest, "on"},
+		{instancePath, `{"AdminState":null}`, http.StatusBadRequest, "on"},
+		{instancePath, `{"Command":"true"}`, http.StatusOK, "on"},
+		{definitionPath, `{"AdminState":"off"}`, http.StatusOK, "off"},
+		// A definition without an AdminState starts its instances
+		{definitionPath, `{"AdminState":""}`, http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		store := data.NewMemoryStore()
+		err := store.UpdateProcess(data.PathToKey(test.nodepath), data.Process{Name: "web", Command: "sleep", AdminState: "on"}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("PATCH", "/", strings.NewReader(test.body))
+		serveResource(store, processResource, data.PathToKey(test.nodepath), recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("PATCH %s on '%s': got status %d, want %d", test.body, test.nodepath, recorder.Code, test.status)
+		}
+		process, err := store.LoadProcess(data.PathToKey(test.nodepath), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if process.AdminState != test.adminState {
+			t.Errorf("PATCH %s on '%s': got AdminState '%s', want '%s'", test.body, test.nodepath, process.AdminState, test.adminState)
+		}
+		_, err = store.GetValue(test.nodepath + "/admin_state")
+		if exists := err == nil; exists != (test.adminState != "") {
+			t.Errorf("PATCH %s on '%s': admin_state node exists %v", test.body, test.nodepath, exists)
+		}
+	}
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"github.com/jetblack87/maestro/data"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const APP_VERSION = "0.1"
@@ -18,13 +24,31 @@ const APP_VERSION = "0.1"
 // The flag package provides a default help printer via -h switch
 var versionFlag *bool = flag.Bool("v", false, "Print the version number.")
 var zookeeper *string = flag.String("zookeeper", "localhost:2181", "The ZooKeeper connection string (defaults to 'localhost:2182').")
+var storeURL *string = flag.String("store", "", "The configuration store URL, e.g. 'zk://localhost:2181', 'etcd://localhost:2379' or 'file:///var/lib/maestro/maestro.db' (defaults to the -zookeeper connection).")
 var port *int = flag.Int("port", 8080, "Port on which to listen.")
 var logfilePath *string = flag.String("logfile", "stdout", "The path to the logfile.")
-
-var zkdao data.ZkDAO
+var tlsCert *string = flag.String("tls-cert", "", "The certificate file of the server, HTTPS is served when set along with -tls-key.")
+var tlsKey *string = flag.String("tls-key", "", "The private key file of the server.")
+var agentToken *string = flag.String("agent-token", "", "A file holding the token sent to the agents to read process output, as given to their -listenToken.")
+var agentTLS *bool = flag.Bool("agent-tls", false, "Read the output of the processes from the agents over HTTPS (implied by -agent-ca).")
+var agentCA *string = flag.String("agent-ca", "", "A file of CA certificates that sign the certificates of the agents, the system CAs are used when empty.")
+var tlsClientCA *string = flag.String("tls-client-ca", "", "A file of CA certificates, clients presenting a certificate they signed are authenticated by its common name (requires -tls-cert).")
 
 const PRETTY_PRINT_PARAM = "pretty"
 
+// Matches the path of a process that has been assigned to an agent
+var runtimeProcessRegexp = regexp.MustCompile("^/maestro/[^/]+/runtime/agents/[^/]+/processes/[^/]+$")
+
+// Authenticates the requests, nil when authentication is disabled
+var serverAccess *accessControl
+
+// Used to proxy requests to the agents
+var agentClient = &http.Client{Timeout: 10 * time.Second}
+
+// The scheme and token with which requests are sent to the agents
+var agentScheme = "http"
+var agentAuthorization string
+
 func main() {
 	flag.Parse() // Scan the arguments list
 
@@ -43,176 +67,291 @@ func main() {
 		os.Exit(0)
 	}
 
-	zkdao, err := data.NewZkDAO(strings.Split(*zookeeper, ","))
+	if *storeURL == "" {
+		*storeURL = "zk://" + *zookeeper
+	}
+	store, err := data.OpenStore(*storeURL)
+	if err != nil {
+		panic(err)
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		panic("-tls-cert and -tls-key must be given together")
+	}
+	if *tlsClientCA != "" && *tlsCert == "" {
+		panic("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+	err = setupAgentClient()
+	if err != nil {
+		panic(err)
+	}
+	serverAccess, err = newAccessControl(*tlsClientCA != "")
 	if err != nil {
 		panic(err)
 	}
+	if serverAccess == nil {
+		log.Println("Authentication is disabled, anyone who can reach the server may change the configuration")
+	}
 
 	// Setup handlers
-	dh := domainHandler{zkdao: zkdao}
-	http.Handle("/domains/", dh)
-	ph := processesHandler{zkdao: zkdao}
-	http.Handle("/processes/", ph)
+	dh := domainHandler{store: store}
+	http.Handle("/domains/", sameOriginChecked(authorized(serverAccess, dh)))
+	ah := agentsHandler{store: store}
+	http.Handle("/agents/", sameOriginChecked(authorized(serverAccess, ah)))
+	ph := processesHandler{store: store}
+	http.Handle("/processes/", sameOriginChecked(authorized(serverAccess, ph)))
+	eh := eventsHandler{store: store}
+	http.Handle("/events", sameOriginChecked(authorized(serverAccess, eh)))
 
-	log.Fatal(http.ListenAndServe(":"+strconv.FormatInt(int64(*port), 10), nil))
+	address := ":" + strconv.FormatInt(int64(*port), 10)
+	if *tlsCert == "" {
+		log.Fatal(http.ListenAndServe(address, nil))
+	}
+	server := &http.Server{Addr: address, TLSConfig: &tls.Config{}}
+	if *tlsClientCA != "" {
+		pem, err := ioutil.ReadFile(*tlsClientCA)
+		if err != nil {
+			panic(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			panic("No certificate found in " + *tlsClientCA)
+		}
+		// Clients may still authenticate with a token or a password
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		server.TLSConfig.ClientCAs = pool
+	}
+	log.Fatal(server.ListenAndServeTLS(*tlsCert, *tlsKey))
 }
 
-type domainHandler struct{ zkdao *data.ZkDAO }
+// setupAgentClient configures how the output of the processes is read from
+// the agents: over HTTPS when -agent-tls or -agent-ca is given, with the token
+// of -agent-token
+func setupAgentClient() error {
+	if *agentToken != "" {
+		token, err := ioutil.ReadFile(*agentToken)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(token)) == "" {
+			return errors.New("No token found in " + *agentToken)
+		}
+		agentAuthorization = "Bearer " + strings.TrimSpace(string(token))
+	}
+	if !*agentTLS && *agentCA == "" {
+		return nil
+	}
+	agentScheme = "https"
+	if *agentCA != "" {
+		pem, err := ioutil.ReadFile(*agentCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("No certificate found in " + *agentCA)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		agentClient.Transport = transport
+	}
+	return nil
+}
+
+// storeConnected answers 503 when the store has lost its connection, as the
+// data could be stale and updates would fail
+func storeConnected(store data.Store, w http.ResponseWriter) bool {
+	state := store.State()
+	if state == data.StateConnected {
+		return true
+	}
+	w.Header().Set("Retry-After", "5")
+	writeError(w, http.StatusServiceUnavailable, "The configuration store is not connected: "+state.String(), nil)
+	return false
+}
+
+type domainHandler struct{ store data.Store }
 
 func (dh domainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("HTTP '%s' request for url '%s'", r.Method, r.URL)
 
-	if origin := r.Header.Get("Origin"); origin != "" {
-		w.Header().Set("Access-Control-Allow-Origin", origin)
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, PATCH")
-		w.Header().Set("Access-Control-Allow-Headers",
-			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	setCORSHeaders(w, r, "POST, GET, OPTIONS, PUT, DELETE, PATCH",
+		"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+
+	if r.Method != "OPTIONS" && !storeConnected(dh.store, w) {
+		return
 	}
 
-	domainKeyRegexp := regexp.MustCompile("/domains/(.*)")
-	domainKey := string(domainKeyRegexp.FindSubmatch([]byte(r.URL.Path))[1])
-	switch r.Method {
-	case "GET":
-		dh.getDomains(domainKey, w, r)
-	case "PATCH":
-	case "OPTIONS":
+	if r.Method == "OPTIONS" {
 		return
+	}
+	readable := strings.TrimPrefix(r.URL.Path, "/domains/")
+	// Domains may still be addressed by their key
+	if keyPath := data.KeyToPath(readable); underRoot(keyPath) {
+		switch r.Method {
+		case "GET", "POST", "PUT", "PATCH", "DELETE":
+			serveResource(dh.store, domainResource, readable, w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+		return
+	}
+
+	nodepath, action := resolvePath(readable)
+	if nodepath == "" {
+		writeError(w, http.StatusNotFound, "No such path: "+r.URL.Path, nil)
+		return
+	}
+	key := data.PathToKey(nodepath)
+	ph := processesHandler{store: dh.store}
+	switch {
+	case action == "logs" && r.Method == "GET":
+		ph.getLogs(key, w, r)
+	case action == "run" && r.Method == "POST":
+		ph.runProcess(key, w, r)
+	case action != "":
+		methodNotAllowed(w, r)
+	case r.Method != "GET" && r.Method != "POST" && r.Method != "PUT" && r.Method != "PATCH" && r.Method != "DELETE":
+		methodNotAllowed(w, r)
+	case domainResource.itemRegexp.MatchString(nodepath) || domainResource.collectionRegexp.MatchString(nodepath):
+		serveResource(dh.store, domainResource, key, w, r)
+	case agentResource.itemRegexp.MatchString(nodepath) || agentResource.collectionRegexp.MatchString(nodepath):
+		serveResource(dh.store, agentResource, key, w, r)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("Method not allowed: " + r.Method))
+		serveResource(dh.store, processResource, key, w, r)
 	}
 }
 
-func (dh domainHandler) getDomains(domainKey string, w http.ResponseWriter, r *http.Request) {
-	var domains []data.Domain
-	var err error
-	if domainKey == "" {
-		domains, err = dh.zkdao.LoadDomains(data.PathToKey("/maestro"), true)
-	} else {
-		var domain data.Domain
-		domain, err = dh.zkdao.LoadDomain(domainKey, true)
-		domains = []data.Domain{domain}
+type agentsHandler struct{ store data.Store }
+
+func (ah agentsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("HTTP '%s' request for url '%s'", r.Method, r.URL)
+
+	setCORSHeaders(w, r, "POST, GET, OPTIONS, PUT, DELETE, PATCH",
+		"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+
+	if r.Method != "OPTIONS" && !storeConnected(ah.store, w) {
+		return
 	}
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		errMsg := "Error occurred retrieving domain"
-		w.Write([]byte(errMsg))
-		log.Println(errMsg + "\n" + err.Error())
-	} else {
-		var responseJson []byte
-		if domainKey == "" {
-			if r.URL.Query().Get(PRETTY_PRINT_PARAM) == "true" {
-				responseJson, err = json.MarshalIndent(domains, "", "   ")
-			} else {
-				responseJson, err = json.Marshal(domains)
-			}
-		} else {
-			if r.URL.Query().Get(PRETTY_PRINT_PARAM) == "true" {
-				responseJson, err = json.MarshalIndent(domains[0], "", "   ")
-			} else {
-				responseJson, err = json.Marshal(domains[0])
-			}
-		}
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			errMsg := "Error occurred retrieving domain"
-			w.Write([]byte(errMsg))
-			log.Println(errMsg + "\n" + err.Error())
-		} else {
-			w.Write(responseJson)
-		}
+
+	agentKey := strings.TrimPrefix(r.URL.Path, "/agents/")
+	switch r.Method {
+	case "GET", "POST", "PUT", "PATCH", "DELETE":
+		serveResource(ah.store, agentResource, agentKey, w, r)
+	case "OPTIONS":
+		return
+	default:
+		methodNotAllowed(w, r)
 	}
 }
 
-type processesHandler struct{ zkdao *data.ZkDAO }
+type processesHandler struct{ store data.Store }
 
 func (ph processesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("HTTP '%s' request for url '%s'", r.Method, r.URL)
 
-	if origin := r.Header.Get("Origin"); origin != "" {
-		w.Header().Set("Access-Control-Allow-Origin", origin)
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, PATCH")
-		w.Header().Set("Access-Control-Allow-Headers",
-			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	setCORSHeaders(w, r, "POST, GET, OPTIONS, PUT, DELETE, PATCH",
+		"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+
+	if r.Method != "OPTIONS" && !storeConnected(ph.store, w) {
+		return
 	}
 
 	processesKeyRegexp := regexp.MustCompile("/processes/(.*)")
 	processKey := string(processesKeyRegexp.FindSubmatch([]byte(r.URL.Path))[1])
+	// A key is never a valid key once "/logs" has been added to it
+	if strings.HasSuffix(processKey, "/logs") && r.Method == "GET" {
+		ph.getLogs(strings.TrimSuffix(processKey, "/logs"), w, r)
+		return
+	}
+	// POST on a process, rather than on a collection, runs a job
+	if strings.HasSuffix(processKey, "/run") && r.Method == "POST" {
+		ph.runProcess(strings.TrimSuffix(processKey, "/run"), w, r)
+		return
+	}
 	switch r.Method {
-	case "GET":
-		ph.getProcess(processKey, w, r)
-	case "PATCH":
-		requestJson, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			w.Write([]byte("Bad request: " + err.Error()))
-			w.WriteHeader(http.StatusBadRequest)
-		} else {
-			ph.updateProcess(processKey, requestJson, w, r)
-		}
+	case "GET", "POST", "PUT", "PATCH", "DELETE":
+		serveResource(ph.store, processResource, processKey, w, r)
 	case "OPTIONS":
 		return
 	default:
-		w.Write([]byte("Method not allowed: " + r.Method))
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
 	}
 }
 
-func (ph processesHandler) getProcess(processKey string, w http.ResponseWriter, r *http.Request) {
-	if processKey == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		errMsg := "Process key is required"
-		w.Write([]byte(errMsg))
-		log.Println(errMsg)
-	} else {
-		process, err := ph.zkdao.LoadProcess(processKey, true)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			errMsg := "Error occurred retrieving process"
-			w.Write([]byte(errMsg))
-			log.Println(errMsg + "\n" + err.Error())
-		} else {
-			var responseJson []byte
-			if r.URL.Query().Get(PRETTY_PRINT_PARAM) == "true" {
-				responseJson, err = json.MarshalIndent(process, "", "   ")
-			} else {
-				responseJson, err = json.Marshal(process)
-			}
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				errMsg := "Error occurred retrieving process"
-				w.Write([]byte(errMsg))
-				log.Println(errMsg + "\n" + err.Error())
-			} else {
-				w.Write(responseJson)
-			}
-		}
+// methodNotAllowed answers 405 with the methods the API supports
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+	writeError(w, http.StatusMethodNotAllowed, "Method not allowed: "+r.Method, nil)
+}
+
+// runProcess asks the agent that runs the job to start a run of it
+func (ph processesHandler) runProcess(processKey string, w http.ResponseWriter, r *http.Request) {
+	processPath := data.KeyToPath(processKey)
+	if !validNodePath(processPath) || !runtimeProcessRegexp.MatchString(processPath) {
+		writeError(w, http.StatusBadRequest, "The key of a runtime process is required", nil)
+		return
+	}
+	process, err := ph.store.LoadProcess(processKey, false)
+	if err == data.ErrNoNode {
+		writeError(w, http.StatusNotFound, "No such process: "+processPath, nil)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error occurred retrieving process", err)
+		return
+	}
+	if process.Type != "oneshot" && process.Type != "cron" {
+		writeError(w, http.StatusBadRequest, "Only oneshot and cron processes can be run: "+process.Name, nil)
+		return
+	}
+	err = ph.store.UpdateProcess(processKey, data.Process{Pid: -1, RunRequested: time.Now().Format(time.RFC3339Nano)}, false)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Internal server error while trying to run process", err)
+		return
 	}
+	writeResource(ph.store, processResource, processKey, http.StatusAccepted, w, r)
 }
 
-func (ph processesHandler) updateProcess(processKey string, requestJson []byte, w http.ResponseWriter, r *http.Request) {
-	log.Printf("Process request for process '%s' with body:\n%s\n", processKey, string(requestJson))
-	if processKey == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		errMsg := "Process key is required"
-		w.Write([]byte(errMsg))
-		log.Println(errMsg)
-	} else {
-		var process data.Process
-		err := json.Unmarshal(requestJson, &process)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			errMsg := "Malformed request:\n" + err.Error()
-			w.Write([]byte(errMsg))
-			log.Println(errMsg)
-		} else {
-			err = ph.zkdao.UpdateProcess(processKey, process, true)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				errMsg := "Internal server error while trying to update process"
-				w.Write([]byte(errMsg))
-				log.Println(errMsg + "\n" + err.Error())
-			}
-			ph.getProcess(processKey, w, r)
-		}
+// getLogs proxies the request for the output of the process to the agent that
+// runs it
+func (ph processesHandler) getLogs(processKey string, w http.ResponseWriter, r *http.Request) {
+	processPath := data.KeyToPath(processKey)
+	if !validNodePath(processPath) || !runtimeProcessRegexp.MatchString(processPath) {
+		writeError(w, http.StatusBadRequest, "The key of a runtime process is required", nil)
+		return
+	}
+	agent, err := ph.store.LoadAgent(data.PathToKey(path.Dir(path.Dir(processPath))), false)
+	if err == data.ErrNoNode {
+		writeError(w, http.StatusNotFound, "No such agent: "+path.Dir(path.Dir(processPath)), nil)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error occurred retrieving agent", err)
+		return
+	}
+	if agent.Eph == "" || agent.Address == "" {
+		writeError(w, http.StatusServiceUnavailable, "Agent is not running or does not serve output: "+agent.Name, nil)
+		return
+	}
+
+	agentURL := agentScheme + "://" + agent.Address + "/logs/" + url.PathEscape(path.Base(processPath)) + "?" + r.URL.RawQuery
+	log.Println("Proxying request to agent: " + agentURL)
+	agentRequest, err := http.NewRequest("GET", agentURL, nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error occurred contacting agent "+agent.Name, err)
+		return
+	}
+	if agentAuthorization != "" {
+		agentRequest.Header.Set("Authorization", agentAuthorization)
+	}
+	response, err := agentClient.Do(agentRequest)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "Error occurred contacting agent "+agent.Name, err)
+		return
 	}
+	defer response.Body.Close()
+	w.Header().Set("Content-Type", response.Header.Get("Content-Type"))
+	w.WriteHeader(response.StatusCode)
+	io.Copy(w, response.Body)
 }
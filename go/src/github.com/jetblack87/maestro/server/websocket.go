@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The events are sent over the WebSocket protocol (RFC 6455), only what the
+// stream needs of it is implemented: the server sends text messages and
+// answers the control frames of the client.
+
+// Appended to the key of the client to accept the handshake
+const WEBSOCKET_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The largest frame accepted from a client, which is not expected to send
+// anything but control frames
+const WEBSOCKET_MAX_FRAME = 4096
+
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xA
+)
+
+// wsFrame is a frame received from the client
+type wsFrame struct {
+	opcode  byte
+	payload []byte
+}
+
+// isWebSocket tells whether the request asks to upgrade to a WebSocket
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, token := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveWebSocket completes the handshake and sends the events of the domain
+// as JSON text messages until the client closes the connection
+func serveWebSocket(hub *eventHub, lastID string, w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, http.StatusBadRequest, "Unsupported WebSocket handshake", nil)
+		return
+	}
+	// Browsers let any page open a WebSocket, with the credentials they keep
+	// for the server
+	if !allowedOrigin(r) {
+		writeError(w, http.StatusForbidden, "Origin not allowed: "+r.Header.Get("Origin"), nil)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "WebSocket is not supported", nil)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error occurred upgrading to WebSocket", err)
+		return
+	}
+	defer conn.Close()
+
+	accept := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	subscriber, replay := hub.subscribe(lastID)
+	defer hub.unsubscribe(subscriber)
+	for _, e := range replay {
+		if writeFrame(conn, opText, []byte(toJSON(e))) != nil {
+			return
+		}
+	}
+
+	// Only this goroutine writes, the reader hands it the control frames
+	frames := make(chan wsFrame)
+	done := make(chan struct{})
+	defer close(done)
+	go readFrames(rw.Reader, frames, done)
+
+	keepalive := time.NewTicker(EVENT_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case e, ok := <-subscriber:
+			if !ok {
+				writeFrame(conn, opClose, closePayload(1008, "fell behind"))
+				return
+			}
+			err = writeFrame(conn, opText, []byte(toJSON(e)))
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+			switch frame.opcode {
+			case opClose:
+				writeFrame(conn, opClose, frame.payload)
+				return
+			case opPing:
+				err = writeFrame(conn, opPong, frame.payload)
+			}
+		case <-keepalive.C:
+			err = writeFrame(conn, opPing, nil)
+		}
+		if err != nil {
+			log.Println("Error occurred writing to WebSocket: " + err.Error())
+			return
+		}
+	}
+}
+
+// readFrames sends the frames of the client on frames, and closes it once
+// the connection fails or done is closed
+func readFrames(reader *bufio.Reader, frames chan<- wsFrame, done <-chan struct{}) {
+	defer close(frames)
+	for {
+		frame, err := readFrame(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Error occurred reading from WebSocket: " + err.Error())
+			}
+			return
+		}
+		select {
+		case frames <- frame:
+		case <-done:
+			return
+		}
+	}
+}
+
+// readFrame reads a frame of the client, which must be masked
+func readFrame(reader *bufio.Reader) (wsFrame, error) {
+	var frame wsFrame
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return frame, err
+	}
+	frame.opcode = header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		return frame, errors.New("Unmasked frame from client")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(reader, extended); err != nil {
+			return frame, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(reader, extended); err != nil {
+			return frame, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > WEBSOCKET_MAX_FRAME {
+		return frame, errors.New("Frame from client is too large")
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(reader, mask); err != nil {
+		return frame, err
+	}
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(reader, frame.payload); err != nil {
+		return frame, err
+	}
+	for i := range frame.payload {
+		frame.payload[i] ^= mask[i%4]
+	}
+	return frame, nil
+}
+
+// writeFrame writes an unfragmented, unmasked frame
+func writeFrame(conn net.Conn, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	length := len(payload)
+	switch {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	conn.SetWriteDeadline(time.Now().Add(EVENT_KEEPALIVE))
+	_, err := conn.Write(append(header, payload...))
+	return err
+}
+
+// closePayload is the payload of a close frame with the status code
+func closePayload(code uint16, reason string) []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+	return append(payload, reason...)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// clientFrame is a frame as a client sends it, masked unless mask is nil
+func clientFrame(opcode byte, payload []byte, mask []byte, lengthBytes int) []byte {
+	frame := []byte{0x80 | opcode, 0}
+	if mask != nil {
+		frame[1] = 0x80
+	}
+	switch lengthBytes {
+	case 0:
+		frame[1] |= byte(len(payload))
+	case 2:
+		frame[1] |= 126
+		frame = append(frame, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	case 8:
+		frame[1] |= 127
+		frame = append(frame, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// TestReadFrame checks the frames accepted from a client
+func TestReadFrame(t *testing.T) {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	medium := bytes.Repeat([]byte("m"), 300)
+	tests := []struct {
+		name    string
+		frame   []byte
+		opcode  byte
+		payload []byte
+		valid   bool
+	}{
+		{"masked", clientFrame(opPing, []byte("hello"), mask, 0), opPing, []byte("hello"), true},
+		{"empty", clientFrame(opClose, nil, mask, 0), opClose, []byte{}, true},
+		{"unmasked", clientFrame(opPing, []byte("hello"), nil, 0), 0, nil, false},
+		{"16 bit length", clientFrame(opText, medium, mask, 2), opText, medium, true},
+		{"64 bit length", clientFrame(opText, medium, mask, 8), opText, medium, true},
+		{"largest", clientFrame(opText, make([]byte, WEBSOCKET_MAX_FRAME), mask, 2), opText, make([]byte, WEBSOCKET_MAX_FRAME), true},
+		{"oversized", clientFrame(opText, make([]byte, WEBSOCKET_MAX_FRAME+1), mask, 2), 0, nil, false},
+		{"oversized 64 bit length", append([]byte{0x81, 0x80 | 127, 0x80, 0, 0, 0, 0, 0, 0, 0}, mask...), 0, nil, false},
+		{"truncated", clientFrame(opText, []byte("hello"), mask, 0)[:8], 0, nil, false},
+		{"truncated length", []byte{0x81, 0x80 | 126, 0x01}, 0, nil, false},
+	}
+	for _, test := range tests {
+		frame, err := readFrame(bufio.NewReader(bytes.NewReader(test.frame)))
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got error %v, want valid %v", test.name, err, test.valid)
+			continue
+		}
+		if test.valid && (frame.opcode != test.opcode || !bytes.Equal(frame.payload, test.payload)) {
+			t.Errorf("%s: got opcode %x payload %q", test.name, frame.opcode, frame.payload)
+		}
+	}
+}
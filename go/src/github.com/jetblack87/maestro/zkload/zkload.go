@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"github.com/jetblack87/maestro/data"
 	"io/ioutil"
-	"strings"
 )
 
 const APP_VERSION = "0.1"
@@ -14,8 +13,10 @@ const APP_VERSION = "0.1"
 // The flag package provides a default help printer via -h switch
 var versionFlag *bool = flag.Bool("v", false, "Print the version number.")
 var zookeeper *string = flag.String("zookeeper", "localhost:2181", "The ZooKeeper connection string (defaults to 'localhost:2182').")
+var storeURL *string = flag.String("store", "", "The configuration store URL, e.g. 'zk://localhost:2181', 'etcd://localhost:2379' or 'file:///var/lib/maestro/maestro.db' (defaults to the -zookeeper connection).")
 var filename *string = flag.String("file", "maestro_data.json", "Supply the file to load.")
 var dump *bool = flag.Bool("dump", false, "Dumps the zookeeper config.")
+var setACLs *bool = flag.Bool("set-acls", false, "Sets the ACLs of the existing nodes under /maestro to those given by the zk:// store URL to the nodes it creates.")
 
 func main() {
 	flag.Parse() // Scan the arguments list
@@ -24,40 +25,51 @@ func main() {
 		fmt.Println("Version:", APP_VERSION)
 	}
 
+	if *storeURL == "" {
+		*storeURL = "zk://" + *zookeeper
+	}
+
 	if *dump {
-		DumpFile(*zookeeper)	
+		DumpFile(*storeURL)	
+	} else if *setACLs {
+		SetACLs(*storeURL)
 	} else {
 		jsonData, err := ioutil.ReadFile(*filename)
 		if err != nil {
 			panic(err)
 		}
-		LoadFile(*zookeeper, jsonData)
+		LoadFile(*storeURL, jsonData)
 	}
 }
 
-func LoadFile(zookeeper string, jsonData []byte) {
+func LoadFile(storeURL string, jsonData []byte) {
 	var domain data.Domain
 	err := json.Unmarshal(jsonData, &domain)
 	if err != nil {
 		panic(err)
 	}
-	zkdao, err := data.NewZkDAO(strings.Split(zookeeper, ","))
+	// Refuse to load processes whose dependencies form a cycle
+	_, err = data.SortByDependencies(domain.Config.Processes)
 	if err != nil {
 		panic(err)
 	}
-	err = zkdao.UpdateDomain(data.PathToKey("/maestro/" + domain.Name), domain, true)
+	store, err := data.OpenStore(storeURL)
+	if err != nil {
+		panic(err)
+	}
+	err = store.UpdateDomain(data.PathToKey("/maestro/" + domain.Name), domain, true)
 	if err != nil {
 		panic(err)
 	}
 	fmt.Println("Completed load successfully")
 }
 
-func DumpFile(zookeeper string) {
-	zkdao, err := data.NewZkDAO(strings.Split(zookeeper, ","))
+func DumpFile(storeURL string) {
+	store, err := data.OpenStore(storeURL)
 	if err != nil {
 		panic(err)
 	}
-	domains, err := zkdao.LoadDomains(data.PathToKey("/maestro"), true)
+	domains, err := store.LoadDomains(data.PathToKey("/maestro"), true)
 		if err != nil {
 		panic(err)
 	}
@@ -67,3 +79,21 @@ func DumpFile(zookeeper string) {
 	}
 	fmt.Println(string(json))
 }
+
+// SetACLs gives the existing nodes the ACLs of the principals of the store URL,
+// as the ACLs of the nodes are only set when they are created
+func SetACLs(storeURL string) {
+	store, err := data.OpenStore(storeURL)
+	if err != nil {
+		panic(err)
+	}
+	zkdao, ok := store.(*data.ZkDAO)
+	if !ok {
+		panic("-set-acls requires a zk:// store")
+	}
+	err = zkdao.SetACLs("/maestro")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Completed setting the ACLs successfully")
+}